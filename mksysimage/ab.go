@@ -0,0 +1,69 @@
+package main
+
+import "flag"
+
+var abRoot = flag.Bool("ab", false,
+	"Lay out two root partitions of the same size, populating slot A and leaving slot B empty for updates, along with a state partition and boot entries for both")
+
+var stateSize = flag.Uint64("state-size", 64,
+	"Size in MB of the state partition -ab layouts get, labelled state, for update clients to keep which slot to boot in")
+
+const stateLabel = "state"
+
+// CheckAb checks -ab, and unless -kernel-args says otherwise, boots
+// slot A by PARTUUID, as slot B's entries boot B.
+func CheckAb() {
+	if !*abRoot {
+		return
+	}
+	switch {
+	case *noPartition:
+		Exit("-ab needs a partition table")
+	case *lvmGroup != "":
+		Exit("-ab can't be used with -lvm")
+	case *verity:
+		Exit("-ab can't be used with -verity")
+	case *stateSize == 0:
+		Exit("-state-size must be at least 1 MB")
+	}
+	if !FlagSet("kernel-args") {
+		*kernelArgs = SetRootArg(*kernelArgs, "PARTUUID="+PartitionUUID(1))
+	}
+}
+
+// StatePartition returns the state partition -ab adds to the layout.
+// Like the overlay partition, it's formatted but not mounted.
+func StatePartition() *Partition {
+	return &Partition{Size: *stateSize, Fs: WritableFs(), Label: stateLabel}
+}
+
+// AbLayout splits root, slot A, in two, with slot B right after it in
+// the partition table. B is typed like A but left unformatted, for an
+// update to write a filesystem to. It returns every partition, root
+// first.
+func AbLayout(root *Partition, extras []*Partition) []*Partition {
+	end := FirstSector() + root.Size*sectorsPerMiB
+	slot := root.Size / 2
+	// B starts on a boundary, so A may be a little smaller than half.
+	for slot > 0 && alignUp(FirstSector()+slot*sectorsPerMiB)+slot*sectorsPerMiB > end {
+		slot--
+	}
+	if slot == 0 {
+		Exit("Two root partitions don't fit in the disk image")
+	}
+	root.Size = slot
+	b := &Partition{Size: slot, Type: TableType(root)}
+	return append([]*Partition{root, b}, extras...)
+}
+
+// SlotBEntries returns a copy of entries booting the root in slot B,
+// labelled with a -b suffix.
+func SlotBEntries(entries []BootEntry) []BootEntry {
+	var b []BootEntry
+	for _, e := range entries {
+		e.Label += "-b"
+		e.Args = SetRootArg(e.Args, "PARTUUID="+PartitionUUID(2))
+		b = append(b, e)
+	}
+	return b
+}
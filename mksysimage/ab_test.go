@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestAbLayout(t *testing.T) {
+	defer func(align, first uint64) {
+		*alignment, *firstSector = align, first
+	}(*alignment, *firstSector)
+	for _, c := range []struct {
+		align, first, root uint64
+		slot               uint64 // 0 if it doesn't fit
+	}{
+		{1, 0, 100, 50},
+		{1, 0, 101, 50},
+		// B rounds up to the next 4 MiB boundary, so A shrinks to fit.
+		{4, 0, 100, 48},
+		{4, 0, 104, 52},
+		// Past a small -first-sector, B's boundary comes well after A's half.
+		{1, 34, 10, 4},
+		{1, 0, 1, 0},
+	} {
+		*alignment, *firstSector = c.align, c.first
+		root := &Partition{Size: c.root, Mount: "/"}
+		extra := &Partition{Size: 8, Mount: "/home"}
+		var parts []*Partition
+		err := exits(func() { parts = AbLayout(root, []*Partition{extra}) })
+		if c.slot == 0 {
+			if err == nil {
+				t.Errorf("-align %d -first-sector %d, root %d: laid out %d MB slots, want a failure",
+					c.align, c.first, c.root, parts[0].Size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-align %d -first-sector %d, root %d: %s", c.align, c.first, c.root, err)
+			continue
+		}
+		if len(parts) != 3 || parts[0] != root || parts[2] != extra {
+			t.Errorf("-align %d -first-sector %d, root %d: got %d partitions, want root, B, extra",
+				c.align, c.first, c.root, len(parts))
+			continue
+		}
+		if root.Size != c.slot || parts[1].Size != c.slot {
+			t.Errorf("-align %d -first-sector %d, root %d: slots of %d and %d MB, want %d",
+				c.align, c.first, c.root, root.Size, parts[1].Size, c.slot)
+		}
+		// B must start on a boundary and end within the space root had.
+		bStart := alignUp(FirstSector() + c.slot*sectorsPerMiB)
+		if bStart+c.slot*sectorsPerMiB > FirstSector()+c.root*sectorsPerMiB {
+			t.Errorf("-align %d -first-sector %d, root %d: slot B overruns root's space",
+				c.align, c.first, c.root)
+		}
+		if parts[1].Type != TableType(root) || parts[1].Fs != "" {
+			t.Errorf("-align %d -first-sector %d, root %d: slot B is %q %q, want an unformatted %q",
+				c.align, c.first, c.root, parts[1].Type, parts[1].Fs, TableType(root))
+		}
+	}
+}
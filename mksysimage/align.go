@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var alignment = flag.Uint64("align", 1,
+	"Alignment of each partition's start in MiB, such as 4 for SD cards with 4 MiB erase blocks")
+
+var firstSector = flag.Uint64("first-sector", 0,
+	"Sector the first partition starts at, rather than the first -align boundary")
+
+// Sectors are always 512 bytes in the images this builds.
+const sectorsPerMiB = 2048
+
+// CheckAlignment checks -align and -first-sector.
+func CheckAlignment() {
+	if *alignment == 0 {
+		Exit("-align must be at least 1 MiB")
+	}
+	if *noPartition && (*alignment != 1 || *firstSector != 0) {
+		Exit("-align and -first-sector need a partition table")
+	}
+	// The partition table itself comes first: the MBR, and for GPT the
+	// header and 32 sectors of entries after it.
+	min := uint64(1)
+	if *dps {
+		min = 34
+	}
+	if *firstSector != 0 && *firstSector < min {
+		Exit(fmt.Sprintf("-first-sector %d overlaps the partition table, which takes the first %d sectors",
+			*firstSector, min))
+	}
+}
+
+// FirstSector returns the sector the first partition starts at.
+func FirstSector() uint64 {
+	if *firstSector != 0 {
+		return *firstSector
+	}
+	return *alignment * sectorsPerMiB
+}
+
+// alignUp rounds sector up to the next -align boundary.
+func alignUp(sector uint64) uint64 {
+	return alignDown(sector + *alignment*sectorsPerMiB - 1)
+}
+
+// alignDown rounds sector down to the previous -align boundary.
+func alignDown(sector uint64) uint64 {
+	align := *alignment * sectorsPerMiB
+	return sector / align * align
+}
+
+// RootSize returns the size in MB of a root partition taking whatever
+// space extras, following it, leave over, or 0 if there's none.
+func RootSize(extras []*Partition) uint64 {
+	end := *diskSize * sectorsPerMiB
+	if *dps {
+		// The backup GPT at the end of the disk.
+		end -= sectorsPerMiB
+	}
+	// Every partition but the last is padded out to the next boundary,
+	// so that the one after it starts aligned.
+	var need uint64
+	for i, p := range extras {
+		need += p.Size * sectorsPerMiB
+		if i < len(extras)-1 {
+			need = alignUp(need)
+		}
+	}
+	if need >= end {
+		return 0
+	}
+	rootEnd := end - need
+	if len(extras) > 0 {
+		rootEnd = alignDown(rootEnd)
+	}
+	if rootEnd <= FirstSector() {
+		return 0
+	}
+	return (rootEnd - FirstSector()) / sectorsPerMiB
+}
+
+// PartitionStarts returns the sector each of parts starts at.
+func PartitionStarts(parts []*Partition) []uint64 {
+	starts := make([]uint64, len(parts))
+	start := FirstSector()
+	for i, p := range parts {
+		starts[i] = start
+		start = alignUp(start + p.Size*sectorsPerMiB)
+	}
+	return starts
+}
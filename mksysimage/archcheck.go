@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// The architecture of ELF binaries, by machine.
+var elfArches = map[elf.Machine]string{
+	elf.EM_X86_64:  "amd64",
+	elf.EM_386:     "386",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_ARM:     "arm",
+	elf.EM_PPC64:   "ppc64le",
+	elf.EM_S390:    "s390x",
+	elf.EM_RISCV:   "riscv64",
+}
+
+// The architecture of EFI stub kernels, by PE machine.
+var peArches = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_AMD64:   "amd64",
+	pe.IMAGE_FILE_MACHINE_I386:    "386",
+	pe.IMAGE_FILE_MACHINE_ARM64:   "arm64",
+	pe.IMAGE_FILE_MACHINE_ARMNT:   "arm",
+	pe.IMAGE_FILE_MACHINE_RISCV64: "riscv64",
+}
+
+// Binaries that every root filesystem worth booting has one of.
+var rootBinaries = []string{"bin/sh", "usr/bin/sh", "sbin/init", "bin/busybox"}
+
+// KernelArch works out the architecture a kernel image was built for,
+// from the boot headers of the various formats, or returns "" if it
+// can't tell.
+func KernelArch(kernel string) string {
+	data, err := ioutil.ReadFile(kernel)
+	if err != nil {
+		Exit(err)
+	}
+	at := func(off int, magic string) bool {
+		return len(data) >= off+len(magic) && string(data[off:off+len(magic)]) == magic
+	}
+	switch {
+	case at(0x202, "HdrS"):
+		// x86 bzImage, whose xloadflags say if it's 64 bit.
+		if len(data) > 0x236 && data[0x236]&1 != 0 {
+			return "amd64"
+		}
+		return "386"
+	case at(0x38, "ARM\x64"):
+		return "arm64"
+	case at(0x38, "RSC\x05"):
+		return "riscv64"
+	case len(data) >= 0x28 && binary.LittleEndian.Uint32(data[0x24:]) == 0x016f2818:
+		return "arm"
+	case at(0, "\x7fELF"):
+		if f, err := elf.NewFile(bytes.NewReader(data)); err == nil {
+			return elfArches[f.Machine]
+		}
+	case at(0, "MZ"):
+		if f, err := pe.NewFile(bytes.NewReader(data)); err == nil {
+			return peArches[f.Machine]
+		}
+	}
+	return ""
+}
+
+// RootArch works out the architecture of the root filesystem mounted
+// at mountpoint from its shell or init, or returns "" if it can't tell.
+func RootArch(mountpoint string) string {
+	for _, bin := range rootBinaries {
+		file, ok := resolveInImage(mountpoint, bin)
+		if !ok {
+			continue
+		}
+		f, err := elf.Open(file)
+		if err != nil {
+			continue
+		}
+		arch := elfArches[f.Machine]
+		f.Close()
+		return arch
+	}
+	return ""
+}
+
+// resolveInImage follows symlinks in the image, taking absolute ones
+// relative to mountpoint rather than the host's root.
+func resolveInImage(mountpoint, file string) (string, bool) {
+	for i := 0; i < 16; i++ {
+		full := path.Join(mountpoint, file)
+		st, err := os.Lstat(full)
+		if err != nil {
+			return "", false
+		}
+		if st.Mode()&os.ModeSymlink == 0 {
+			return full, true
+		}
+		target, err := os.Readlink(full)
+		if err != nil {
+			return "", false
+		}
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(file), target)
+		}
+		file = target
+	}
+	return "", false
+}
+
+// CheckKernelArch fails the build early when the kernel was given
+// explicitly and plainly doesn't match -arch.
+func CheckKernelArch(kernel string) {
+	if !FlagSet("arch") {
+		return
+	}
+	if k := KernelArch(kernel); k != "" && k != *arch {
+		Exit(fmt.Sprintf("Kernel %s is for %s, not %s", kernel, k, *arch))
+	}
+}
+
+// CheckRootArch fails the build when the kernels in boot can't run the
+// root filesystem at mountpoint. Kernels and binaries of unknown
+// architecture are given the benefit of the doubt.
+func CheckRootArch(mountpoint, boot string, kernels []BootKernel) {
+	root := RootArch(mountpoint)
+	if root == "" {
+		Log("Warning: couldn't tell the architecture of the root filesystem")
+		return
+	}
+	if root != *arch && *dps {
+		Log(fmt.Sprintf("Warning: the root filesystem is for %s, but the partition types are for %s", root, *arch))
+	}
+	for _, k := range kernels {
+		ka := KernelArch(path.Join(boot, k.Kernel))
+		// 64 bit x86 kernels run 32 bit binaries, but not the
+		// other way around.
+		if ka != "" && ka != root && !(ka == "amd64" && root == "386") {
+			Exit(fmt.Sprintf("Kernel %s is for %s, but the root filesystem is for %s", k.Kernel, ka, root))
+		}
+	}
+}
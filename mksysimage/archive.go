@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var allowUnsafeArchives = flag.Bool("allow-unsafe-archives", false,
+	"Extract tarball sources with the host's tar rather than chrooted into the image")
+
+// ExtractPrograms returns the programs ExtractArchive runs.
+func ExtractPrograms() []string {
+	if *allowUnsafeArchives {
+		return []string{"tar"}
+	}
+	return []string{"unshare"}
+}
+
+// The hidden command the chrooted extraction runs as.
+const extractCommand = "extract-archive"
+
+// ExtractArchive extracts the tarball file at dir in the image mounted
+// at mountpoint. tar runs as root, so an entry with an absolute path,
+// one climbing out with .., or one written through a symlink pointing
+// out could write anywhere on the build host. Instead, this program
+// extracts it again in a private mount namespace, chrooted into the
+// image, where everything resolves within the image.
+func ExtractArchive(file, mountpoint, dir string) {
+	if *allowUnsafeArchives {
+		root := filepath.Join(mountpoint, dir)
+		if err := ImageMkdirAll(root, 0700); err != nil {
+			Exit(err)
+		}
+		if err := exe.HeavyPriv("tar", "-C", root, "-xvf", file).Run(); err != nil {
+			Exit(err)
+		}
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		Exit(err)
+	}
+	in, closer := OpenDecompressed(file)
+	defer closer()
+	cmd := exe.HeavyPriv("unshare", "--mount", "--propagation", "private",
+		self, extractCommand, mountpoint, dir)
+	cmd.Stdin = in
+	if err = cmd.Run(); err != nil {
+		Exit(errors.New(fmt.Sprintf("Extracting %s: %s", file, err)))
+	}
+}
+
+// ExtractArchiveCommand is the chrooted side of ExtractArchive,
+// extracting the uncompressed tarball on stdin at dir in the image
+// mounted at mountpoint. It runs before anything in main, so it fails
+// by itself.
+func ExtractArchiveCommand(mountpoint, dir string) {
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := syscall.Chroot(mountpoint); err != nil {
+		fail(err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		fail(err)
+	}
+	root := filepath.Join("/", dir)
+	if err := os.MkdirAll(root, 0700); err != nil {
+		fail(err)
+	}
+	archive := tar.NewReader(os.Stdin)
+	var dirs []*tar.Header
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fail(err)
+		}
+		fmt.Println(hdr.Name)
+		if err = extractEntry(root, hdr, archive); err != nil {
+			fail(errors.New(fmt.Sprintf("%s: %s", hdr.Name, err)))
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+	// Extracting into directories changes their times, so they're
+	// set last.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		name := filepath.Join(root, dirs[i].Name)
+		os.Chtimes(name, entryAccessTime(dirs[i]), dirs[i].ModTime)
+	}
+}
+
+// extractEntry creates the file hdr describes under root, as GNU tar
+// would, except that it keeps symlinks to directories the way
+// --keep-directory-symlink does, since earlier sources often leave
+// merged /usr links for later ones to extract through.
+func extractEntry(root string, hdr *tar.Header, r io.Reader) error {
+	name := filepath.Join(root, hdr.Name)
+	if name == root && hdr.Typeflag != tar.TypeDir {
+		return errors.New("not a directory")
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if st, err := os.Lstat(name); err == nil && !st.IsDir() {
+			if err = os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(name, 0700); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+		return os.Lchown(name, hdr.Uid, hdr.Gid)
+	case tar.TypeLink:
+		return os.Link(filepath.Join(root, hdr.Linkname), name)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := map[byte]uint32{
+			tar.TypeChar:  syscall.S_IFCHR,
+			tar.TypeBlock: syscall.S_IFBLK,
+			tar.TypeFifo:  syscall.S_IFIFO,
+		}[hdr.Typeflag]
+		dev := mkdev(uint64(hdr.Devmajor), uint64(hdr.Devminor))
+		if err := syscall.Mknod(name, kind|uint32(mode.Perm()), dev); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Skipping %s of unsupported type %c\n", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+	// Changing the owner clears the setuid and setgid bits, so the
+	// mode comes after.
+	if err := os.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(name, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	for key, value := range hdr.PAXRecords {
+		if attr := strings.TrimPrefix(key, "SCHILY.xattr."); attr != key {
+			if err := syscall.Setxattr(name, attr, []byte(value), 0); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Chtimes(name, entryAccessTime(hdr), hdr.ModTime)
+}
+
+func entryAccessTime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
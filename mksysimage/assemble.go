@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var assemble = flag.Bool("assemble", false,
+	"Build each partition's filesystem from a populated directory and assemble the image from them, without loop devices or mounts, for unprivileged containers")
+
+// The filesystems -assemble can make populated, with the option or
+// tool that populates them from a directory.
+var assembleFs = map[string]bool{
+	"ext3":  true,
+	"ext4":  true,
+	"btrfs": true,
+	"vfat":  true,
+}
+
+func init() {
+	RegisterCapability("-assemble", func(plan *BuildPlan) []string {
+		if !*assemble || plan.Parts == nil {
+			return nil
+		}
+		for _, p := range plan.Parts {
+			if p.Fs == "vfat" && p.Mount != "" {
+				return []string{"mcopy"}
+			}
+		}
+		return nil
+	})
+}
+
+// CheckAssemble fails if -assemble is given with options that need the
+// image mounted. extlinux only installs onto a mounted /boot, so
+// partitioned images boot with -uefi alone.
+func CheckAssemble() {
+	if !*assemble {
+		return
+	}
+	switch {
+	case *useSudo:
+		Exit("-assemble runs nothing privileged, so it doesn't need -sudo")
+	case *lvmGroup != "":
+		Exit("-assemble can't build -lvm volumes without device mapper")
+	case len(subvolumes) > 0:
+		Exit("-assemble can't create btrfs subvolumes without mounting the root")
+	case *infoSize > 0:
+		Exit("-assemble can't write the -info-size partition without mounting it")
+	case !*noPartition && (ArchBootloader().Name != "extlinux" || !*uefi):
+		Exit("-assemble images boot only with -uefi, since bootloaders install onto a mounted /boot")
+	}
+}
+
+// checkAssembleFs fails if -assemble can't make the filesystems of parts
+// that get populated.
+func checkAssembleFs(parts []*Partition) {
+	if !*assemble {
+		return
+	}
+	for _, p := range MountOrder(parts) {
+		if !assembleFs[p.Fs] && !ReadOnlyFs(p.Fs) {
+			Exit(fmt.Sprintf("-assemble can't populate %s filesystems, as the %s partition is", p.Fs, p.Mount))
+		}
+	}
+}
+
+// StagePartitions gives each of parts in the partition table a file of
+// its own to be built in, as its device, for AssembleImage to copy into
+// the image once they're all built.
+func StagePartitions(parts []*Partition) {
+	dir := TempDir("partitions")
+	for i, p := range TablePartitions(parts) {
+		p.Device = filepath.Join(dir, fmt.Sprintf("p%d", i+1))
+		if err := CreateImage(p.Device, p.Size); err != nil {
+			Exit(err)
+		}
+	}
+}
+
+// PackPartitions makes the filesystems of the partitions populated in
+// the plain directory mountpoint, deepest mount points first. Each is
+// moved aside once it's packed, leaving an empty mount point behind, as
+// mounting it would have. A read-only root has been packed already.
+func PackPartitions(mountpoint string, parts []*Partition) {
+	order := MountOrder(parts)
+	aside := TempDir("packed")
+	for i := len(order) - 1; i >= 0; i-- {
+		p := order[i]
+		if ReadOnlyFs(p.Fs) {
+			continue
+		}
+		dir := filepath.Join(mountpoint, p.Mount)
+		Log(fmt.Sprintf("Packing the %s partition", p.Mount))
+		packFs(p, dir, parts)
+		if p.Mount == "/" {
+			continue
+		}
+		if err := os.Rename(dir, filepath.Join(aside, strconv.Itoa(i))); err != nil {
+			Exit(err)
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			Exit(err)
+		}
+		if err := os.Lchown(dir, 0, 0); err != nil {
+			Exit(err)
+		}
+		if t, ok := FixedBuildTime(); ok {
+			if err := os.Chtimes(dir, t, t); err != nil {
+				Exit(err)
+			}
+		}
+	}
+}
+
+// packFs makes the filesystem of p on its device, from the contents of
+// dir. mke2fs and mkfs.btrfs populate it as they make it, and mcopy
+// copies into FAT filesystems afterwards.
+func packFs(p *Partition, dir string, parts []*Partition) {
+	args := MkfsArgs(p, parts)
+	device := args[len(args)-1]
+	args = args[:len(args)-1]
+	if p.Fs == "btrfs" {
+		args = append(args, "--rootdir", dir)
+	} else if p.Fs != "vfat" {
+		args = append(args, "-d", dir)
+	}
+	mkfs := exe.Heavy(MkfsProgram(p.Fs), append(args, device)...)
+	var features []string
+	if strings.HasPrefix(p.Fs, "ext") {
+		PinMke2fsConfig(mkfs)
+		features = ExtFeatures(p)
+	}
+	err := mkfs.Run()
+	Audit("mkfs", device, p.Fs, err)
+	if err != nil {
+		Exit(err)
+	}
+	ReportFilesystem(p, features)
+	if p.Fs != "vfat" {
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		Exit(err)
+	}
+	if len(entries) == 0 {
+		return
+	}
+	mcopy := []string{"-s", "-p", "-m", "-Q", "-i", device}
+	for _, e := range entries {
+		mcopy = append(mcopy, filepath.Join(dir, e.Name()))
+	}
+	err = exe.Heavy("mcopy", append(mcopy, "::/")...).Run()
+	Audit("populate", device, dir, err)
+	if err != nil {
+		Exit(err)
+	}
+}
+
+// AssembleImage writes the partition table to image, then copies in
+// the partitions StagePartitions gave files of their own, leaving holes
+// where they're empty.
+func AssembleImage(image string, parts []*Partition) {
+	Log("Assembling the disk image")
+	f, err := os.OpenFile(image, os.O_WRONLY, 0)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	var tables map[int64][]byte
+	if *dps {
+		tables = gptTables(parts)
+	} else {
+		tables = map[int64][]byte{0: mbrTable(parts)}
+	}
+	for at, data := range tables {
+		_, err = f.WriteAt(data, at)
+		Audit("raw-write", image, fmt.Sprintf("partition table at offset %d, %d bytes", at, len(data)), err)
+		if err != nil {
+			Exit(err)
+		}
+	}
+	if *hybridMbr {
+		WriteHybridMbr(image, parts)
+	}
+	table := TablePartitions(parts)
+	starts := PartitionStarts(table)
+	for i, p := range table {
+		in, err := os.Open(p.Device)
+		if err != nil {
+			Exit(err)
+		}
+		if _, err = f.Seek(int64(starts[i])*512, 0); err == nil {
+			err = writeSparse(f, in)
+		}
+		in.Close()
+		Audit("raw-write", image, fmt.Sprintf("%s at sector %d", p.Device, starts[i]), err)
+		if err != nil {
+			Exit(err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		Exit(err)
+	}
+}
+
+// mbrTable returns the MBR sfdisk would write for parts.
+func mbrTable(parts []*Partition) []byte {
+	mbr := make([]byte, 512)
+	signature, _ := strconv.ParseUint(strings.TrimPrefix(DiskID(), "0x"), 16, 32)
+	binary.LittleEndian.PutUint32(mbr[440:], uint32(signature))
+	boot := BootPartition(parts)
+	table := TablePartitions(parts)
+	starts := PartitionStarts(table)
+	for i, p := range table {
+		kind, _ := strconv.ParseUint(TableType(p), 16, 8)
+		mbrEntry(mbr[446+i*16:], p == boot, byte(kind), starts[i], p.Size*sectorsPerMiB)
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
+
+// mbrEntry fills in the MBR partition entry e.
+func mbrEntry(e []byte, active bool, kind byte, start, sectors uint64) {
+	if start+sectors > 1<<32 {
+		Exit("MBR partitions must end within the first 2 TiB")
+	}
+	if active {
+		e[0] = 0x80
+	}
+	copy(e[1:4], chs(start))
+	e[4] = kind
+	copy(e[5:8], chs(start+sectors-1))
+	binary.LittleEndian.PutUint32(e[8:], uint32(start))
+	binary.LittleEndian.PutUint32(e[12:], uint32(sectors))
+}
+
+// chs returns the cylinder, head and sector of lba in the 255 head, 63
+// sector geometry partitioning tools assume, or the largest there is if
+// it's past what that can address.
+func chs(lba uint64) []byte {
+	if lba >= 1024*255*63 {
+		return []byte{0xfe, 0xff, 0xff}
+	}
+	c, h, s := lba/(255*63), lba/63%255, lba%63+1
+	return []byte{byte(h), byte(s | c>>8<<6), byte(c)}
+}
+
+// The GPT's entries, as sfdisk writes them: 128 of 128 bytes, filling
+// the 32 sectors after the header.
+const (
+	gptEntries    = 128
+	gptEntrySize  = 128
+	gptEntrySects = gptEntries * gptEntrySize / 512
+)
+
+// gptTables returns the protective MBR, GPT and backup GPT for parts,
+// by where they go in the image.
+func gptTables(parts []*Partition) map[int64][]byte {
+	sectors := *diskSize * sectorsPerMiB
+	mbr := make([]byte, 512)
+	size := sectors - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	copy(mbr[446:], []byte{0, 0, 2, 0, 0xee})
+	copy(mbr[451:], chs(size))
+	binary.LittleEndian.PutUint32(mbr[454:], 1)
+	binary.LittleEndian.PutUint32(mbr[458:], uint32(size))
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	entries := make([]byte, gptEntries*gptEntrySize)
+	boot := BootPartition(parts)
+	table := TablePartitions(parts)
+	starts := PartitionStarts(table)
+	for i, p := range table {
+		e := entries[i*gptEntrySize:]
+		copy(e[0:], guidBytes(TableType(p)))
+		copy(e[16:], guidBytes(PartitionUUID(i+1)))
+		binary.LittleEndian.PutUint64(e[32:], starts[i])
+		binary.LittleEndian.PutUint64(e[40:], starts[i]+p.Size*sectorsPerMiB-1)
+		if p == boot {
+			// LegacyBIOSBootable
+			binary.LittleEndian.PutUint64(e[48:], 1<<2)
+		}
+	}
+	header := func(current, backup, entriesAt uint64) []byte {
+		h := make([]byte, 512)
+		copy(h, "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], current)
+		binary.LittleEndian.PutUint64(h[32:], backup)
+		binary.LittleEndian.PutUint64(h[40:], 2+gptEntrySects)
+		binary.LittleEndian.PutUint64(h[48:], sectors-2-gptEntrySects)
+		copy(h[56:], guidBytes(DiskID()))
+		binary.LittleEndian.PutUint64(h[72:], entriesAt)
+		binary.LittleEndian.PutUint32(h[80:], gptEntries)
+		binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+	last := sectors - 1
+	return map[int64][]byte{
+		0:                               mbr,
+		512:                             header(1, last, 2),
+		1024:                            entries,
+		int64(last-gptEntrySects) * 512: entries,
+		int64(last) * 512:               header(last, 1, last-gptEntrySects),
+	}
+}
+
+// guidBytes encodes a GUID as GPT stores it, its first three fields
+// little endian.
+func guidBytes(guid string) []byte {
+	b, err := hex.DecodeString(strings.Replace(guid, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		Exit(fmt.Sprintf("Bad GUID %s", guid))
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// CreateImage creates image as a sparse file of size MB, so creating it
+// takes no time, and only what mkfs and the sources write takes up room
+// on the host. That can run out later instead, so running short of it
+// is warned about up front.
+func CreateImage(image string, size uint64) error {
+	f, err := os.OpenFile(image, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(int64(size) << 20); err != nil {
+		f.Close()
+		return err
+	}
+	var st syscall.Statfs_t
+	if syscall.Fstatfs(int(f.Fd()), &st) == nil {
+		if free := st.Bavail * uint64(st.Bsize); free < size<<20 {
+			Log(fmt.Sprintf("Warning: only %s free for a %d MB image", FormatSize(free), size))
+		}
+	}
+	return f.Close()
+}
+
+// The loop device of the whole image, once AttachPartitions has set
+// it up.
+var imageDevice string
+
+// AttachPartitions writes the partition table and MBR to image, and
+// sets up a device for each of parts. The returned function tears the
+// devices down again.
+func AttachPartitions(image string, parts []*Partition) (detach func()) {
+	var undo []func()
+	detach = func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			detach()
+			panic(err)
+		}
+	}()
+
+	Log("Creating partition table")
+	cmd := exe.Cmd("sfdisk", image)
+	cmd.Stdin = bytes.NewBufferString(PartitionTable(parts))
+	if err := cmd.Run(); err != nil {
+		Exit(err)
+	}
+	if *hybridMbr {
+		WriteHybridMbr(image, parts)
+	}
+
+	Log("Setting up loop device")
+	cmd = exe.Priv("losetup", "--show", "-f", image)
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	err := cmd.Run()
+	device := strings.Trim(buf.String(), "\n")
+	Audit("losetup", device, image, err)
+	if err != nil {
+		Exit(err)
+	}
+	TrackLoop(device, image)
+	undo = append(undo, func() {
+		Log("Tearing down loop device")
+		err := exe.Priv("losetup", "-d", device).Run()
+		Audit("losetup-detach", device, "", err)
+		if err == nil {
+			Untrack(&runState.Loops, device)
+		}
+	})
+
+	if b := ArchBootloader(); b.WriteBootCode != nil {
+		b.WriteBootCode(device)
+	}
+	imageDevice = device
+	undo = append(undo, ThrottleDevice(device))
+
+	Log("Setting up partition loop device")
+	err = exe.Priv("kpartx", "-a", "-v", device).Run()
+	Audit("kpartx-add", device, "", err)
+	if err != nil {
+		Exit(err)
+	}
+	Track(&runState.Maps, device)
+	undo = append(undo, func() {
+		Log("Tearing down partition loop device")
+		err := exe.Priv("kpartx", "-d", device).Run()
+		Audit("kpartx-delete", device, "", err)
+		if err == nil {
+			Untrack(&runState.Maps, device)
+		}
+	})
+
+	for i, p := range TablePartitions(parts) {
+		p.Device = fmt.Sprintf("/dev/mapper/%sp%d", path.Base(device), i+1)
+	}
+	if *lvmGroup != "" {
+		undo = append(undo, CreateVolumes(parts))
+	}
+	if *raidName != "" {
+		undo = append(undo, CreateArray(parts))
+	}
+	return detach
+}
+
+// An ImageTable is the partition table of an image, as sfdisk -J
+// reports it.
+type ImageTable struct {
+	Label      string `json:"label"`
+	Partitions []struct {
+		Node     string `json:"node"`
+		Start    uint64 `json:"start"`
+		Size     uint64 `json:"size"`
+		Type     string `json:"type"`
+		Bootable bool   `json:"bootable"`
+	} `json:"partitions"`
+}
+
+// ReadImageTable reads the partition table of image.
+func ReadImageTable(image string) *ImageTable {
+	cmd := exe.Cmd("sfdisk", "-J", image)
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	if err := cmd.Run(); err != nil {
+		Exit(err)
+	}
+	var doc struct {
+		PartitionTable ImageTable `json:"partitiontable"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		Exit(fmt.Sprintf("Reading the partition table of %s: %s", image, err))
+	}
+	return &doc.PartitionTable
+}
+
+// imageMounts works out where each partition of a built image mounts,
+// by partition number. The root partition always comes first; with a
+// DPS layout, the partition types say where the others go. With an
+// MBR, only /boot can be told apart, by being the bootable one, and
+// the -uefi ESP, by its type.
+func imageMounts(table *ImageTable) map[int]string {
+	mounts := map[int]string{1: "/"}
+	if table.Label != "gpt" {
+		for i, p := range table.Partitions[1:] {
+			if p.Bootable {
+				mounts[i+2] = "/boot"
+			} else if strings.ToLower(p.Type) == "ef" {
+				mounts[i+2] = espMount
+			}
+		}
+		return mounts
+	}
+	// /efi and /boot/efi share the ESP's type, which mounts where -uefi
+	// puts it, whichever order the map comes in.
+	types := map[string]string{
+		strings.ToUpper(dpsUsrTypes[*arch]):      "/usr",
+		strings.ToUpper(dpsMountTypes[espMount]): espMount,
+	}
+	for mount, t := range dpsMountTypes {
+		if _, ok := types[strings.ToUpper(t)]; !ok && strings.HasPrefix(mount, "/") {
+			types[strings.ToUpper(t)] = mount
+		}
+	}
+	for i, p := range table.Partitions[1:] {
+		if mount, ok := types[strings.ToUpper(p.Type)]; ok {
+			mounts[i+2] = mount
+		}
+	}
+	return mounts
+}
+
+// readOnlyRootFs returns the read-only filesystem, squashfs or erofs,
+// of the root partition starting at sector start of image, if it has
+// one, as their magic numbers give away. A -verity root is one of them.
+func readOnlyRootFs(image string, start uint64) string {
+	f, err := os.Open(image)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	sb := make([]byte, 1028)
+	if _, err = f.ReadAt(sb, int64(start)*512); err != nil {
+		Exit(err)
+	}
+	switch {
+	case string(sb[:4]) == "hsqs":
+		return "squashfs"
+	case binary.LittleEndian.Uint32(sb[1024:]) == 0xe0f5e1e2:
+		return "erofs"
+	}
+	return ""
+}
+
+// MountImage attaches a built image, read-only unless writable, and
+// mounts its filesystems together under a temporary directory. The
+// returned function undoes it all.
+func MountImage(image string, writable bool) (mountpoint string, detach func()) {
+	var undo []func()
+	detach = func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	// Clean up after a failure part way through, since the caller
+	// doesn't have detach yet.
+	defer func() {
+		if err := recover(); err != nil {
+			detach()
+			panic(err)
+		}
+	}()
+
+	table := ReadImageTable(image)
+	if len(table.Partitions) == 0 {
+		Exit(fmt.Sprintf("%s has no partitions", image))
+	}
+	if t := strings.ToUpper(table.Partitions[0].Type); t == strings.ToUpper(lvmType) || t == lvmGptType {
+		Exit(fmt.Sprintf("%s keeps its root filesystem in LVM, which can't be mounted here", image))
+	}
+	if t := strings.ToUpper(table.Partitions[0].Type); t == strings.ToUpper(raidType) || t == raidGptType {
+		Exit(fmt.Sprintf("%s keeps its root filesystem in an mdadm array, which can't be mounted here", image))
+	}
+	if fs := readOnlyRootFs(image, table.Partitions[0].Start); writable && fs != "" {
+		Exit(fmt.Sprintf("%s has a read-only %s root, which can't be changed in place", image, fs))
+	}
+
+	ro := []string{"-r"}
+	options := "ro"
+	if writable {
+		ro, options = nil, "rw"
+	}
+
+	Log("Setting up loop device")
+	cmd := exe.Priv("losetup", append(ro, "--show", "-f", image)...)
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	err := cmd.Run()
+	device := strings.Trim(buf.String(), "\n")
+	Audit("losetup", device, image, err)
+	if err != nil {
+		Exit(err)
+	}
+	TrackLoop(device, image)
+	undo = append(undo, func() {
+		Log("Tearing down loop device")
+		err := exe.Priv("losetup", "-d", device).Run()
+		Audit("losetup-detach", device, "", err)
+		if err == nil {
+			Untrack(&runState.Loops, device)
+		}
+	})
+
+	Log("Setting up partition loop device")
+	err = exe.Priv("kpartx", append([]string{"-a", "-v"}, append(ro, device)...)...).Run()
+	Audit("kpartx-add", device, "", err)
+	if err != nil {
+		Exit(err)
+	}
+	Track(&runState.Maps, device)
+	undo = append(undo, func() {
+		Log("Tearing down partition loop device")
+		err := exe.Priv("kpartx", "-d", device).Run()
+		Audit("kpartx-delete", device, "", err)
+		if err == nil {
+			Untrack(&runState.Maps, device)
+		}
+	})
+
+	mountpoint = TempDir("mnt")
+
+	mounts := imageMounts(table)
+	var order []int
+	for n := range mounts {
+		order = append(order, n)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return mounts[order[i]] < mounts[order[j]]
+	})
+	for _, n := range order {
+		target := filepath.Join(mountpoint, mounts[n])
+		dev := fmt.Sprintf("/dev/mapper/%sp%d", path.Base(device), n)
+		Log(fmt.Sprintf("Mounting the %s partition", mounts[n]))
+		err = exe.Priv("mount", "-o", options, dev, target).Run()
+		Audit("mount", target, dev, err)
+		if err != nil {
+			Exit(err)
+		}
+		Track(&runState.Mounts, target)
+		undo = append(undo, func() {
+			err := exe.Priv("umount", target).Run()
+			Audit("umount", target, dev, err)
+			if err == nil {
+				Untrack(&runState.Mounts, target)
+			}
+		})
+	}
+	return mountpoint, detach
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// sfdiskTable reads a partition table as sfdisk -J prints it.
+func sfdiskTable(t *testing.T, doc string) *ImageTable {
+	var table ImageTable
+	if err := json.Unmarshal([]byte(doc), &table); err != nil {
+		t.Fatal(err)
+	}
+	return &table
+}
+
+func TestImageMounts(t *testing.T) {
+	defer func(a string) { *arch = a }(*arch)
+	*arch = "amd64"
+	for _, c := range []struct {
+		name, table string
+		want        map[int]string
+	}{
+		{"mbr", `{"label": "dos", "partitions": [
+			{"type": "83"}, {"type": "83", "bootable": true}, {"type": "EF"}, {"type": "82"}]}`,
+			map[int]string{1: "/", 2: "/boot", 3: espMount}},
+		{"mbr root only", `{"label": "dos", "partitions": [{"type": "83", "bootable": true}]}`,
+			map[int]string{1: "/"}},
+		{"gpt", `{"label": "gpt", "partitions": [
+			{"type": "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"},
+			{"type": "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"},
+			{"type": "8484680C-9521-48C6-9C11-B0720656F69E"},
+			{"type": "BC13C2FF-59E6-4262-A352-B275FD6F7172"},
+			{"type": "933AC7E1-2EB4-4F13-B844-0E14E2AEF915"},
+			{"type": "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"},
+			{"type": "0FC63DAF-8483-4772-8E79-3D69D8477DE4"}]}`,
+			map[int]string{1: "/", 2: espMount, 3: "/usr", 4: "/boot", 5: "/home"}},
+	} {
+		table := sfdiskTable(t, c.table)
+		// The ESP's mount mustn't depend on the order maps come in.
+		for i := 0; i < 20; i++ {
+			if got := imageMounts(table); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+)
+
+var auditLog = flag.String("audit-log", "",
+	"Append a JSON line for every privileged operation (device setup, mounts, raw writes) to this file")
+
+// An AuditRecord is one privileged operation in the audit log.
+type AuditRecord struct {
+	Time   string `json:"time"`
+	Host   string `json:"host"`
+	Pid    int    `json:"pid"`
+	Uid    int    `json:"uid"`
+	Op     string `json:"op"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+	Result string `json:"result"`
+}
+
+// Audit records the outcome of a privileged operation on target. The
+// log is opened for appending on every write so that nothing earlier
+// in it can be lost, even if the build crashes, and a log that can't
+// be written fails the build.
+func Audit(op, target, detail string, err error) {
+	if *auditLog == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	record := AuditRecord{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Host:   host,
+		Pid:    os.Getpid(),
+		Uid:    os.Getuid(),
+		Op:     op,
+		Target: target,
+		Detail: detail,
+		Result: "ok",
+	}
+	if err != nil {
+		record.Result = err.Error()
+	}
+	line, _ := json.Marshal(record)
+	f, ferr := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if ferr != nil {
+		Exit(ferr)
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
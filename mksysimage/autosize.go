@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+var autoSize = flag.Bool("auto-size", false,
+	"Size the disk image to fit the sources, with -headroom to spare, rather than taking -disk-size")
+
+var headroom = flag.Uint64("headroom", 20,
+	"Percentage of the root filesystem's contents -auto-size leaves free on top of them")
+
+// How much bigger than their contents -auto-size makes filesystems, in
+// percent of the contents and in MB. ext and xfs keep inode tables and
+// a journal, and btrfs and f2fs need more room to allocate in. squashfs
+// and erofs compress, so the contents overestimate them already.
+var autoSizeOverheads = map[string]struct{ Percent, Fixed uint64 }{
+	"ext3":     {5, 64},
+	"ext4":     {5, 64},
+	"xfs":      {5, 64},
+	"btrfs":    {10, 64},
+	"f2fs":     {10, 64},
+	"squashfs": {0, 1},
+	"erofs":    {0, 1},
+}
+
+// What MeasureSources found the sources would put in the image.
+var measuredEntries []SourceEntry
+
+// MeasureSources records what sources, and the files copied to /boot,
+// would put in the image, for -auto-size to size it by.
+func MeasureSources(sources []Source, boot ...string) {
+	if FlagSet("disk-size") {
+		Exit("-auto-size and -disk-size can't both be given")
+	}
+	Log("Measuring the sources")
+	for _, s := range sources {
+		measuredEntries = append(measuredEntries, s.Contents()...)
+	}
+	for _, file := range boot {
+		st, err := os.Stat(file)
+		if err != nil {
+			Exit(err)
+		}
+		measuredEntries = append(measuredEntries, SourceEntry{path.Join("/boot", path.Base(file)), st.Size(), false})
+	}
+}
+
+// AutoRootSize returns the size in MB of a root filesystem holding what
+// the sources put outside the mount points of others, with -headroom to
+// spare.
+func AutoRootSize(others []*Partition) uint64 {
+	var mounts []string
+	for _, p := range others {
+		if p.Mount != "" {
+			mounts = append(mounts, p.Mount)
+		}
+	}
+	for _, v := range logicalVolumes {
+		mounts = append(mounts, v.Mount)
+	}
+	under := func(file, mount string) bool {
+		return file == mount || strings.HasPrefix(file, mount+"/")
+	}
+	// Files take whole blocks, and an inode each.
+	var content uint64
+	for _, e := range measuredEntries {
+		elsewhere := false
+		for _, m := range mounts {
+			elsewhere = elsewhere || under(e.Path, m)
+		}
+		if elsewhere {
+			continue
+		}
+		content += 256
+		if e.Dir {
+			content += 4096
+		} else {
+			content += (uint64(e.Size) + 4095) / 4096 * 4096
+		}
+	}
+	overhead := autoSizeOverheads[*fsType]
+	size := (content + content*overhead.Percent/100 + 1<<20 - 1) >> 20
+	size = size*(100+*headroom)/100 + overhead.Fixed
+	if size < fsMinSizes[*fsType] {
+		size = fsMinSizes[*fsType]
+	}
+	Log(fmt.Sprintf("The root filesystem needs %s, taking %d MB", FormatSize(content), size))
+	return size
+}
+
+// AutoDiskSize sets -disk-size to the smallest that fits extras after
+// a root partition of AutoRootSize. The partition in root's place
+// holds both slots with -ab, and the logical volumes too with -lvm.
+func AutoDiskSize(extras []*Partition) {
+	root := AutoRootSize(extras)
+	need := root
+	switch {
+	case *abRoot:
+		need = 2*root + *alignment
+	case *lvmGroup != "":
+		need = root + 1 + lvmExtent
+		for _, v := range logicalVolumes {
+			need += (v.Size + lvmExtent - 1) / lvmExtent * lvmExtent
+		}
+	}
+	if *verity {
+		// The hash partition, first of extras, was sized for the
+		// disk.
+		extras[0].Size = verityHashSize(root)
+	}
+	*diskSize = need
+	for _, p := range extras {
+		*diskSize += p.Size
+	}
+	for RootSize(extras) < need {
+		*diskSize++
+	}
+	Log(fmt.Sprintf("Sizing the disk image at %d MB", *diskSize))
+}
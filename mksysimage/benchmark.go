@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+var benchmark = flag.Bool("benchmark", false,
+	"Build from a synthetic source instead of the sources given, print how fast each stage went, and remove the outputs")
+
+var benchmarkSize = flag.Uint64("benchmark-size", 512,
+	"Size in MB of the -benchmark synthetic source")
+
+// A benchStage is a stage of the build timed for -benchmark.
+type benchStage struct {
+	Name string
+	Size uint64 // MB processed
+	Took time.Duration
+}
+
+var benchStages []benchStage
+
+// TimeStage starts timing a stage of the build processing size MB,
+// for -benchmark. Calling the returned function ends it.
+func TimeStage(name string, size uint64) func() {
+	if !*benchmark {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		benchStages = append(benchStages, benchStage{name, size, time.Since(start)})
+	}
+}
+
+// BenchmarkSource writes the synthetic -benchmark source: 1 MB files,
+// a hundred to a directory, alternately random and repetitive, so
+// compressors see a realistic mix.
+func BenchmarkSource() Source {
+	dir := TempDir("benchmark")
+	Log(fmt.Sprintf("Writing a %d MB synthetic source", *benchmarkSize))
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 1<<20)
+	text := bytes.Repeat([]byte("mksysimage benchmark data\n"), len(data)/26+1)[:len(data)]
+	for i := uint64(0); i < *benchmarkSize; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%03d", i/100))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			Exit(err)
+		}
+		content := text
+		if i%2 == 0 {
+			random.Read(data)
+			content = data
+		}
+		if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("f%03d", i%100)), content, 0644); err != nil {
+			Exit(err)
+		}
+	}
+	return &dirSource{"/", dir}
+}
+
+// PrintBenchmark prints the throughput of each timed stage, then
+// removes the outputs, which are only a byproduct.
+func PrintBenchmark(outfinal string, formats []string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Stage\tMB\tSeconds\tMB/s\t")
+	for _, s := range benchStages {
+		rate := "-"
+		if secs := s.Took.Seconds(); secs > 0 {
+			rate = fmt.Sprintf("%.1f", float64(s.Size)/secs)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.2f\t%s\t\n", s.Name, s.Size, s.Took.Seconds(), rate)
+	}
+	w.Flush()
+	for _, f := range formats {
+		out := OutputFile(outfinal, f, formats)
+		os.Remove(FinalName(out))
+		if f == "nspawn" {
+			os.Remove(NspawnSettingsFile(out))
+		}
+	}
+}
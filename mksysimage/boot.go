@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var extlinuxBin = flag.String("extlinux", "extlinux",
+	"The extlinux program to install the bootloader with; pin one build for identical images on any host")
+
+var syslinuxDir = flag.String("syslinux-dir", "",
+	"Directory to take syslinux files such as mbr.bin from, instead of searching the usual places")
+
+// Where distributions put syslinux's files: Debian and Ubuntu, older
+// Debian, Arch, then Fedora and openSUSE.
+var syslinuxDirs = []string{
+	"/usr/lib/syslinux/mbr",
+	"/usr/lib/syslinux/modules/bios",
+	"/usr/lib/extlinux",
+	"/usr/lib/syslinux/bios",
+	"/usr/share/syslinux",
+	"/usr/lib/syslinux",
+}
+
+var allKernels = flag.Bool("all-kernels", false,
+	"Add every /boot/vmlinuz-VERSION in the image to the boot menu, newest first")
+
+// Given as the kernel, autoKernel picks the newest one the sources put
+// in /boot.
+const autoKernel = "auto"
+
+// Initrd names distributions pair with a vmlinuz-VERSION kernel.
+var initrdPatterns = []string{
+	"initrd.img-%s",
+	"initramfs-%s.img",
+	"initrd-%s.img",
+	"initrd-%s",
+}
+
+// A BootKernel is a kernel and its initrd, as file names within /boot.
+type BootKernel struct {
+	Kernel, Initrd string
+}
+
+// A BootEntry is one label in the boot menu.
+type BootEntry struct {
+	Label  string
+	Kernel string // File name within /boot
+	Initrd string // File name within /boot, if any
+	Args   string
+}
+
+const syslinuxEntry = `LABEL %s
+    LINUX %s
+    APPEND %s
+    %s
+`
+
+// The filesystems extlinux can boot from, of those the image can have.
+var extlinuxFs = map[string]bool{
+	"ext3":  true,
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+	"vfat":  true,
+}
+
+// CheckBootFs fails unless the bootloader can read the filesystem it
+// goes on.
+func CheckBootFs(parts []*Partition) {
+	b := ArchBootloader()
+	if fs := BootPartition(parts).Fs; !*noPartition && !b.Fs[fs] {
+		Exit(fmt.Sprintf("%s can't read %s, so the image needs a -partition /boot:SIZE:FS", b.Name, fs))
+	}
+}
+
+// SyslinuxConfig renders a syslinux.cfg booting the first entry. With
+// more than one entry, the boot prompt lists them and waits five
+// seconds for a choice; a branded menu always does.
+func SyslinuxConfig(entries []BootEntry) string {
+	var buf bytes.Buffer
+	if SerialBoot() {
+		buf.WriteString("SERIAL 0 115200\n")
+	}
+	if Branded() {
+		syslinuxBranding(&buf)
+	} else if len(entries) == 1 {
+		buf.WriteString("\nPROMPT 0\n")
+	} else {
+		buf.WriteString("\nPROMPT 1\nTIMEOUT 50\n")
+		var labels []string
+		for _, e := range entries {
+			labels = append(labels, e.Label)
+		}
+		fmt.Fprintf(&buf, "SAY Boot entries: %s\n", strings.Join(labels, " "))
+	}
+	fmt.Fprintf(&buf, "DEFAULT %s\n", entries[0].Label)
+	for _, e := range entries {
+		var initrd string
+		if e.Initrd != "" {
+			initrd = fmt.Sprintf("INITRD %s", e.Initrd)
+		}
+		fmt.Fprintf(&buf, syslinuxEntry, e.Label, e.Kernel, e.Args, initrd)
+	}
+	return buf.String()
+}
+
+func installExtlinuxEntries(boot string, entries []BootEntry) {
+	cfg := SyslinuxConfig(entries)
+	if err := ImageWriteFile(path.Join(boot, "syslinux.cfg"), []byte(cfg), 0644); err != nil {
+		Exit(err)
+	}
+	installSyslinuxBranding(boot, SyslinuxFile)
+	err := exe.Priv(*extlinuxBin, "--install", boot).Run()
+	Audit("bootloader-install", boot, ExtlinuxVersion(), err)
+	if err != nil {
+		Exit(err)
+	}
+}
+
+// SyslinuxFile finds one of syslinux's files, such as mbr.bin or
+// ldlinux.c32, in -syslinux-dir or wherever the host keeps them.
+func SyslinuxFile(name string) string {
+	dirs := syslinuxDirs
+	if *syslinuxDir != "" {
+		dirs = []string{*syslinuxDir}
+	}
+	for _, dir := range dirs {
+		file := path.Join(dir, name)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	Exit(fmt.Sprintf("Couldn't find syslinux's %s in %s", name, strings.Join(dirs, ", ")))
+	return ""
+}
+
+// MbrFile finds the boot code syslinux puts in the MBR.
+func MbrFile() string {
+	if *dps {
+		return SyslinuxFile("gptmbr.bin")
+	}
+	return SyslinuxFile("mbr.bin")
+}
+
+// writeSyslinuxMbr writes syslinux's boot code to the MBR of device.
+func writeSyslinuxMbr(device string) {
+	Log("Writing syslinux MBR")
+	mbr := MbrFile()
+	err := exe.Priv("dd",
+		fmt.Sprintf("if=%s", mbr),
+		fmt.Sprintf("of=%s", device),
+		"bs=440",
+		"count=1").Run()
+	Audit("raw-write", device, fmt.Sprintf("%s at offset 0, 440 bytes", mbr), err)
+	if err != nil {
+		Exit(err)
+	}
+}
+
+// ExtlinuxVersion returns the version line of -extlinux, so that the
+// audit log records which build went into the image.
+func ExtlinuxVersion() string {
+	out, _ := exec.Command(*extlinuxBin, "--version").CombinedOutput()
+	if version := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]; version != "" {
+		return version
+	}
+	return *extlinuxBin
+}
+
+// FindKernels lists the vmlinuz-VERSION kernels in boot, newest first,
+// along with the initrd that goes with each, if there is one.
+func FindKernels(boot string) []BootKernel {
+	names, err := ImageReadDir(boot)
+	if err != nil {
+		Exit(err)
+	}
+	present := map[string]bool{}
+	var files []string
+	for _, name := range names {
+		present[name] = true
+		if strings.HasPrefix(name, "vmlinuz-") {
+			files = append(files, name)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return compareVersions(kernelVersion(files[i]), kernelVersion(files[j])) > 0
+	})
+	var kernels []BootKernel
+	for _, file := range files {
+		kernels = append(kernels,
+			BootKernel{file, findInitrd(present, kernelVersion(file))})
+	}
+	return kernels
+}
+
+func kernelVersion(kernel string) string {
+	return strings.TrimPrefix(path.Base(kernel), "vmlinuz-")
+}
+
+// findInitrd returns the initrd for the kernel of version among the
+// names present in /boot, or "" if there's none.
+func findInitrd(present map[string]bool, version string) string {
+	for _, pattern := range initrdPatterns {
+		name := fmt.Sprintf(pattern, version)
+		if present[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// compareVersions orders version strings the way people read them:
+// runs of digits compare as numbers, everything else byte by byte.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		var x, y string
+		x, a = versionPart(a)
+		y, b = versionPart(b)
+		nx, errx := strconv.ParseUint(x, 10, 64)
+		ny, erry := strconv.ParseUint(y, 10, 64)
+		switch {
+		case errx == nil && erry == nil && nx != ny:
+			if nx < ny {
+				return -1
+			}
+			return 1
+		case (errx != nil || erry != nil) && x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// versionPart splits off the leading run of digits or non-digits.
+func versionPart(v string) (part, rest string) {
+	digit := unicode.IsDigit(rune(v[0]))
+	i := 1
+	for i < len(v) && unicode.IsDigit(rune(v[i])) == digit {
+		i++
+	}
+	return v[:i], v[i:]
+}
+
+// BootEntries builds the boot menu for kernels. Each entry line of the
+// manifest adds its arguments to the kernel args under its own label;
+// without any, there is just the one "linux" entry. With more than one
+// kernel, each gets all the entries, labelled with its version, or
+// its position among them if it isn't named vmlinuz-VERSION. A
+// recovery partition adds a last entry for a factory reset. Labels
+// must be unique, as the menus pick entries by them.
+func BootEntries(kernels []BootKernel, manifest *Manifest) []BootEntry {
+	profiles := [][]string{{"linux"}}
+	if len(manifest.Entries) > 0 {
+		profiles = nil
+		for _, d := range manifest.Entries {
+			profiles = append(profiles, d.Args)
+		}
+	}
+	var entries []BootEntry
+	for i, k := range kernels {
+		suffix := fmt.Sprint(i + 1)
+		if strings.HasPrefix(path.Base(k.Kernel), "vmlinuz-") {
+			suffix = kernelVersion(k.Kernel)
+		}
+		for _, p := range profiles {
+			label := p[0]
+			if len(kernels) > 1 {
+				label += "-" + suffix
+			}
+			args := strings.TrimSpace(*kernelArgs + " " + strings.Join(p[1:], " "))
+			entries = append(entries, BootEntry{label, k.Kernel, k.Initrd, args})
+		}
+	}
+	if *abRoot {
+		entries = append(entries, SlotBEntries(entries)...)
+	}
+	if *recoverySize > 0 {
+		entries = append(entries, RecoveryEntry(kernels[0]))
+	}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if seen[e.Label] {
+			Exit(fmt.Sprintf("Two boot entries are labelled %s", e.Label))
+		}
+		seen[e.Label] = true
+	}
+	return entries
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+var bootloaderName = flag.String("bootloader", "",
+	"Bootloader to install rather than the one -arch uses, such as grub on amd64 or 386")
+
+// A Bootloader boots images for the architectures it's registered for.
+type Bootloader struct {
+	Name string
+	// Fs lists the filesystems /boot can be on.
+	Fs map[string]bool
+	// Programs lists the host programs installing it runs.
+	Programs func() []string
+	// Check, if set, fails early if the bootloader can't be installed.
+	Check func()
+	// Partition returns a partition it needs added to the layout, if
+	// any.
+	Partition func() *Partition
+	// WriteBootCode writes anything that goes outside the partitions
+	// to device, the whole disk, once it's partitioned.
+	WriteBootCode func(device string)
+	// Install writes the boot menu for entries into the image mounted
+	// at mountpoint, and installs the bootloader to boot it.
+	Install func(mountpoint string, parts []*Partition, entries []BootEntry)
+	// AfterSources is set for bootloaders recording where the kernels'
+	// blocks are, which must be installed after the sources so that
+	// nothing moves them.
+	AfterSources bool
+	// Arches lists the architectures -bootloader can pick it for,
+	// besides those it's registered for.
+	Arches []string
+}
+
+var bootloaders = map[string]*Bootloader{}
+
+// The bootloader of each architecture that doesn't use extlinux.
+var archBootloaders = map[string]string{}
+
+// RegisterBootloader makes b the bootloader of arches.
+func RegisterBootloader(b *Bootloader, arches ...string) {
+	bootloaders[b.Name] = b
+	for _, a := range arches {
+		archBootloaders[a] = b.Name
+	}
+}
+
+func init() {
+	RegisterBootloader(&Bootloader{
+		Name:     "extlinux",
+		Fs:       extlinuxFs,
+		Programs: func() []string { return []string{*extlinuxBin} },
+		Check: func() {
+			Log(fmt.Sprintf("Using MBR boot code %s", MbrFile()))
+		},
+		WriteBootCode: writeSyslinuxMbr,
+		Install: func(mountpoint string, parts []*Partition, entries []BootEntry) {
+			installExtlinuxEntries(path.Join(mountpoint, "boot"), entries)
+		},
+	})
+}
+
+// ArchBootloader returns the bootloader -bootloader picks, or the one
+// -arch uses.
+func ArchBootloader() *Bootloader {
+	if *bootloaderName == "" {
+		return usualBootloader()
+	}
+	b := bootloaders[*bootloaderName]
+	if b == nil {
+		Exit(fmt.Sprintf("Unknown -bootloader %s", *bootloaderName))
+	}
+	return b
+}
+
+// usualBootloader returns the bootloader for -arch, or for Xen guests
+// with -xen.
+func usualBootloader() *Bootloader {
+	if *xen {
+		return bootloaders["pvgrub"]
+	}
+	if name, ok := archBootloaders[*arch]; ok {
+		return bootloaders[name]
+	}
+	return bootloaders["extlinux"]
+}
+
+// CheckBootloader picks the bootloader a manifest asks for, if any,
+// unless -bootloader is given, and fails unless it can boot -arch.
+func CheckBootloader(manifest *Manifest) {
+	if *bootloaderName == "" {
+		*bootloaderName = manifest.Bootloader
+	}
+	b, usual := ArchBootloader(), usualBootloader()
+	names := []string{usual.Name}
+	for _, other := range bootloaders {
+		for _, a := range other.Arches {
+			if a == *arch && !*xen && other != usual {
+				names = append(names, other.Name)
+			}
+		}
+	}
+	for _, name := range names {
+		if name == b.Name {
+			return
+		}
+	}
+	sort.Strings(names[1:])
+	Exit(fmt.Sprintf("%s images boot with %s, not %s", *arch, strings.Join(names, " or "), b.Name))
+}
+
+// InstallBootloader installs the bootloader for -arch in the image
+// mounted at mountpoint, booting kernels, the first by default.
+func InstallBootloader(mountpoint string, parts []*Partition, kernels []BootKernel, manifest *Manifest) {
+	b := ArchBootloader()
+	Log(fmt.Sprintf("Installing %s for %s", b.Name, kernels[0].Kernel))
+	b.Install(mountpoint, parts, BootEntries(kernels, manifest))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+var bootTitle = flag.String("boot-title", "",
+	"Title of the boot menu, such as the product's name and version")
+
+var bootSplash = flag.String("boot-splash", "",
+	"PNG image to show behind the boot menu; syslinux shows it at 640x480")
+
+var bootColors = flag.String("boot-colors", "",
+	"Colors of the boot menu as NORMAL,SELECTED, each FOREGROUND/BACKGROUND in GRUB's color names, such as light-gray/blue,white/black")
+
+// GRUB's color names, with the VGA colors syslinux is given for them.
+var menuColors = map[string]string{
+	"black":         "000000",
+	"blue":          "0000aa",
+	"green":         "00aa00",
+	"cyan":          "00aaaa",
+	"red":           "aa0000",
+	"magenta":       "aa00aa",
+	"brown":         "aa5500",
+	"light-gray":    "aaaaaa",
+	"dark-gray":     "555555",
+	"light-blue":    "5555ff",
+	"light-green":   "55ff55",
+	"light-cyan":    "55ffff",
+	"light-red":     "ff5555",
+	"light-magenta": "ff55ff",
+	"yellow":        "ffff55",
+	"white":         "ffffff",
+}
+
+// The syslinux modules a branded menu runs, vesamenu.c32 and the
+// libraries it loads.
+var vesamenuModules = []string{"vesamenu.c32", "libcom32.c32", "libutil.c32"}
+
+// The name the splash is copied to beside the boot menu.
+const splashName = "splash.png"
+
+// Branded reports whether the boot menu gets any of -boot-title,
+// -boot-splash or -boot-colors. A branded menu shows for five seconds
+// even with a single entry, or there'd be nothing to see.
+func Branded() bool {
+	return *bootTitle != "" || *bootSplash != "" || *bootColors != ""
+}
+
+// CheckBranding fails if the boot menu can't be branded as asked.
+func CheckBranding() {
+	if !Branded() {
+		return
+	}
+	name := ArchBootloader().Name
+	if name == "zipl" {
+		Exit("zipl's boot menu can't be branded")
+	}
+	if strings.ContainsAny(*bootTitle, "'\n\r\t") {
+		Exit("-boot-title can't have single quotes or control characters")
+	}
+	if *bootSplash != "" {
+		if name == "pvgrub" {
+			Exit("-boot-splash needs a graphical console, which Xen PV guests don't have")
+		}
+		f, err := os.Open(*bootSplash)
+		if err != nil {
+			Exit(err)
+		}
+		magic := make([]byte, 8)
+		_, err = io.ReadFull(f, magic)
+		f.Close()
+		if err != nil || string(magic) != "\x89PNG\r\n\x1a\n" {
+			Exit(fmt.Sprintf("-boot-splash %s isn't a PNG image", *bootSplash))
+		}
+	}
+	if *bootColors != "" {
+		brandColors()
+	}
+}
+
+// brandColors returns the normal and selected colors of -boot-colors,
+// each a foreground and a background.
+func brandColors() [2][2]string {
+	var colors [2][2]string
+	pairs := strings.Split(*bootColors, ",")
+	if len(pairs) != 2 {
+		Exit(fmt.Sprintf("Bad -boot-colors %s, expected NORMAL,SELECTED", *bootColors))
+	}
+	for i, pair := range pairs {
+		fgbg := strings.Split(pair, "/")
+		if len(fgbg) != 2 || menuColors[fgbg[0]] == "" || menuColors[fgbg[1]] == "" {
+			Exit(fmt.Sprintf("Bad -boot-colors %s, expected FOREGROUND/BACKGROUND in GRUB's color names", pair))
+		}
+		colors[i] = [2]string{fgbg[0], fgbg[1]}
+	}
+	return colors
+}
+
+// syslinuxBranding writes the lines of a syslinux.cfg running the
+// branded menu. As with GRUB, a black background is transparent, so
+// the splash shows through.
+func syslinuxBranding(buf *bytes.Buffer) {
+	buf.WriteString("\nUI vesamenu.c32\nTIMEOUT 50\n")
+	if *bootTitle != "" {
+		fmt.Fprintf(buf, "MENU TITLE %s\n", *bootTitle)
+	}
+	if *bootSplash != "" {
+		fmt.Fprintf(buf, "MENU BACKGROUND %s\n", splashName)
+	}
+	if *bootColors == "" {
+		return
+	}
+	argb := func(name string, background bool) string {
+		if background && name == "black" {
+			return "#00000000"
+		}
+		return "#ff" + menuColors[name]
+	}
+	colors := brandColors()
+	for i, element := range []string{"unsel", "sel"} {
+		fmt.Fprintf(buf, "MENU COLOR %s 0 %s %s none\n", element,
+			argb(colors[i][0], false), argb(colors[i][1], true))
+	}
+	fmt.Fprintf(buf, "MENU COLOR title 0 %s %s none\n", argb(colors[0][0], false), argb(colors[0][1], true))
+}
+
+// installSyslinuxBranding copies the menu modules, found by find, and
+// the splash into dir, beside the syslinux.cfg using them.
+func installSyslinuxBranding(dir string, find func(name string) string) {
+	if !Branded() {
+		return
+	}
+	var copies [][2]string
+	for _, module := range vesamenuModules {
+		copies = append(copies, [2]string{find(module), module})
+	}
+	if *bootSplash != "" {
+		copies = append(copies, [2]string{*bootSplash, splashName})
+	}
+	for _, c := range copies {
+		if err := exe.Priv("cp", c[0], path.Join(dir, c[1])).Run(); err != nil {
+			Exit(err)
+		}
+	}
+}
+
+// grubBranding writes the lines of a grub.cfg, after those choosing
+// its terminals, branding its menu. The splash needs the graphical
+// terminal, with the font grub-install puts in /grub/fonts.
+func grubBranding(buf *bytes.Buffer, dir string) {
+	if *bootSplash != "" {
+		buf.WriteString("insmod all_video\ninsmod gfxterm\ninsmod png\nloadfont unicode\n")
+		if SerialBoot() {
+			buf.WriteString("terminal_output serial gfxterm\n")
+		} else {
+			buf.WriteString("terminal_output gfxterm\n")
+		}
+		fmt.Fprintf(buf, "background_image %s\n", path.Join(dir, "grub", splashName))
+	}
+	if *bootColors != "" {
+		colors := brandColors()
+		fmt.Fprintf(buf, "set menu_color_normal=%s/%s\n", colors[0][0], colors[0][1])
+		fmt.Fprintf(buf, "set menu_color_highlight=%s/%s\n", colors[1][0], colors[1][1])
+	}
+}
+
+// grubEntryTitle returns the title of the menu entry for label. GRUB's
+// menu has no title of its own, so -boot-title heads each entry's.
+func grubEntryTitle(label string) string {
+	if *bootTitle == "" {
+		return label
+	}
+	return fmt.Sprintf("%s (%s)", *bootTitle, label)
+}
+
+// installGrubSplash copies the splash to the grub directory in boot.
+func installGrubSplash(boot string) {
+	if *bootSplash == "" {
+		return
+	}
+	if err := ImageMkdirAll(path.Join(boot, "grub"), 0755); err != nil {
+		Exit(err)
+	}
+	if err := exe.Priv("cp", *bootSplash, path.Join(boot, "grub", splashName)).Run(); err != nil {
+		Exit(err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// A Subvolume is a btrfs subvolume of the root partition, mounted at
+// Mount in the image.
+type Subvolume struct {
+	Mount string
+	Name  string
+}
+
+type subvolumeList []Subvolume
+
+func (l *subvolumeList) String() string {
+	specs := make([]string, len(*l))
+	for i, s := range *l {
+		specs[i] = s.Mount + ":" + s.Name
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *subvolumeList) Set(value string) error {
+	fields := strings.Split(value, ":")
+	if len(fields) != 2 {
+		return errors.New(fmt.Sprintf("Malformed subvolume %s", value))
+	}
+	return l.Add(fields[0], fields[1])
+}
+
+// Add adds the subvolume name mounted at mount.
+func (l *subvolumeList) Add(mount, name string) error {
+	mount = filepath.Clean(mount)
+	if !filepath.IsAbs(mount) {
+		return errors.New(fmt.Sprintf("Subvolume mount point %s isn't absolute", mount))
+	}
+	if name == "" || strings.ContainsAny(name, "/ ") {
+		return errors.New(fmt.Sprintf("Bad subvolume name %q", name))
+	}
+	for _, s := range *l {
+		if s.Mount == mount || s.Name == name {
+			return errors.New(fmt.Sprintf("Duplicate subvolume %s:%s", mount, name))
+		}
+	}
+	*l = append(*l, Subvolume{mount, name})
+	return nil
+}
+
+var subvolumes subvolumeList
+
+func init() {
+	flag.Var(&subvolumes, "subvolume",
+		"With -fs btrfs, a root subvolume given as MOUNT:NAME, such as /:@ or /home:@home, may be repeated")
+	RegisterPrivilegedCapability("-subvolume", func(plan *BuildPlan) []string {
+		return SubvolumePrograms()
+	})
+}
+
+// SubvolumePrograms returns the programs subvolumes need, if any.
+func SubvolumePrograms() []string {
+	if len(subvolumes) == 0 {
+		return nil
+	}
+	return []string{"btrfs", "blkid"}
+}
+
+// CheckSubvolumes fails unless the subvolumes can go on the root
+// partition among parts.
+func CheckSubvolumes(parts []*Partition) {
+	if len(subvolumes) == 0 {
+		return
+	}
+	if parts[0].Fs != "btrfs" {
+		Exit("Subvolumes need -fs btrfs")
+	}
+	for _, s := range subvolumes {
+		for _, p := range parts[1:] {
+			if p.Mount == s.Mount {
+				Exit(fmt.Sprintf("%s is both a partition and a subvolume", s.Mount))
+			}
+		}
+	}
+}
+
+// CreateSubvolumes creates the subvolumes on the root partition p. The
+// one mounted at / becomes the default, so booting mounts it as root
+// without any rootflags.
+func CreateSubvolumes(p *Partition) {
+	if len(subvolumes) == 0 {
+		return
+	}
+	top := TempDir("btrfs")
+	err := exe.Priv("mount", "-o", "loop", "-t", "btrfs", p.Device, top).Run()
+	Audit("mount", top, p.Device, err)
+	if err != nil {
+		Exit(err)
+	}
+	Track(&runState.Mounts, top)
+	defer func() {
+		err := exe.Priv("umount", top).Run()
+		Audit("umount", top, p.Device, err)
+		if err == nil {
+			Untrack(&runState.Mounts, top)
+		}
+	}()
+	for _, s := range subvolumes {
+		Log(fmt.Sprintf("Creating subvolume %s for %s", s.Name, s.Mount))
+		err := exe.Priv("btrfs", "subvolume", "create", filepath.Join(top, s.Name)).Run()
+		Audit("subvolume-create", s.Name, s.Mount, err)
+		if err != nil {
+			Exit(err)
+		}
+		if s.Mount == "/" {
+			err = exe.Priv("btrfs", "subvolume", "set-default", filepath.Join(top, s.Name)).Run()
+			Audit("subvolume-default", s.Name, s.Mount, err)
+			if err != nil {
+				Exit(err)
+			}
+		}
+	}
+}
+
+// MountSubvolumes mounts the subvolumes other than root's from the root
+// partition p, which is mounted at mountpoint, returning the function
+// that unmounts them again.
+func MountSubvolumes(p *Partition, mountpoint string) func() {
+	var mounted []string
+	unmount := func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			err := exe.Priv("umount", "-l", mounted[i]).Run()
+			Audit("umount", mounted[i], p.Device, err)
+			if err == nil {
+				Untrack(&runState.Mounts, mounted[i])
+			}
+		}
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			unmount()
+			panic(err)
+		}
+	}()
+	for _, s := range subvolumes {
+		if s.Mount == "/" {
+			continue
+		}
+		target := filepath.Join(mountpoint, s.Mount)
+		if err := ImageMkdirAll(target, 0755); err != nil {
+			Exit(err)
+		}
+		Log(fmt.Sprintf("Mounting subvolume %s at %s", s.Name, s.Mount))
+		err := exe.Priv("mount", "-o", "loop,subvol="+s.Name, "-t", "btrfs", p.Device, target).Run()
+		Audit("mount", target, p.Device, err)
+		if err != nil {
+			Exit(err)
+		}
+		Track(&runState.Mounts, target)
+		mounted = append(mounted, target)
+	}
+	return unmount
+}
+
+// WriteSubvolumeFstab adds the subvolumes other than root's to the
+// image's /etc/fstab, since nothing else would mount them at boot.
+func WriteSubvolumeFstab(p *Partition, mountpoint string) {
+	if len(subvolumes) == 0 || len(subvolumes) == 1 && subvolumes[0].Mount == "/" {
+		return
+	}
+	uuid := FilesystemUUID(p)
+	var entries []string
+	for _, s := range subvolumes {
+		if s.Mount != "/" {
+			entries = append(entries, fmt.Sprintf("UUID=%s\t%s\tbtrfs\tsubvol=%s\t0 0",
+				uuid, s.Mount, s.Name))
+		}
+	}
+	Log("Adding the subvolumes to /etc/fstab")
+	AppendFstab(mountpoint, entries...)
+}
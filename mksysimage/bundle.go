@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var bundleFile = flag.String("bundle", "",
+	"Take remote sources, and the manifest unless -manifest is given, from this file made by bundle create, rather than downloading them")
+
+// A bundle is an uncompressed tar archive of a manifest and the remote
+// sources it resolved to, for builds without network access:
+//
+//	manifest        The manifest the bundle was made from
+//	index.json      The URL and digest of each remote source
+//	sources/DIGEST  Each remote source, named after its sha256 digest
+//
+// Local sources and template files aren't bundled. The bundled
+// manifest finds them relative to the bundle, so they go beside it as
+// they were beside the manifest.
+type bundleIndex struct {
+	Created string        `json:"created"`
+	Sources []bundleEntry `json:"sources"`
+}
+
+type bundleEntry struct {
+	Url    string `json:"url"`
+	Sha256 string `json:"sha256"`
+}
+
+const bundleManifest = "manifest"
+
+// The remote sources of the -bundle, by URL, once loaded.
+var bundleSources map[string]string
+
+func init() {
+	subcommands["bundle"] = BundleCommand
+}
+
+// BundleCommand fetches the sources of -manifest and writes them with
+// it into a bundle.
+func BundleCommand(args []string) {
+	if len(args) != 2 || args[0] != "create" || *manifestFile == "" {
+		Exit("Usage: bundle create file -manifest file")
+	}
+	out := args[1]
+	manifest := ReadManifest(*manifestFile)
+	downloadDir = TempDir("sources")
+	FetchAll(manifest.Sources)
+
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		Exit(err)
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	w := tar.NewWriter(f)
+	index := bundleIndex{Created: BuildTime().Format(time.RFC3339)}
+	bundled := map[string]bool{}
+	for _, source := range manifest.Sources {
+		s, ok := source.(*httpSource)
+		if !ok {
+			Log(fmt.Sprintf("Warning: local source %s isn't bundled", source))
+			continue
+		}
+		digest := s.digest
+		if digest == "" {
+			digest = Checksum(s.path, "tar").Sha256
+		}
+		index.Sources = append(index.Sources, bundleEntry{s.url, digest})
+		if !bundled[digest] {
+			Log(fmt.Sprintf("Bundling %s", s.url))
+			addBundleFile(w, path.Join("sources", digest), s.path)
+			bundled[digest] = true
+		}
+	}
+	addBundleFile(w, bundleManifest, *manifestFile)
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		Exit(err)
+	}
+	data = append(data, '\n')
+	if err = w.WriteHeader(&tar.Header{Name: "index.json", Mode: 0644, Size: int64(len(data))}); err != nil {
+		Exit(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		Exit(err)
+	}
+	if err = w.Close(); err != nil {
+		Exit(err)
+	}
+	if err = f.Close(); err != nil {
+		Exit(err)
+	}
+	if err = os.Rename(tmp, out); err != nil {
+		Exit(err)
+	}
+	Log(fmt.Sprintf("Bundled %d remote sources into %s", len(bundled), out))
+}
+
+func addBundleFile(w *tar.Writer, name, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		Exit(err)
+	}
+	if err = w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: st.Size()}); err != nil {
+		Exit(err)
+	}
+	if _, err = io.Copy(w, f); err != nil {
+		Exit(err)
+	}
+}
+
+// LoadBundle unpacks the -bundle, checking each source against its
+// digest, and returns the bundled manifest.
+func LoadBundle() string {
+	f, err := os.Open(*bundleFile)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	dir := TempDir("bundle")
+	r := tar.NewReader(f)
+	var index bundleIndex
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			Exit(errors.New(fmt.Sprintf("Reading %s: %s", *bundleFile, err)))
+		}
+		switch {
+		case hdr.Name == "index.json":
+			data, err := ioutil.ReadAll(r)
+			if err == nil {
+				err = json.Unmarshal(data, &index)
+			}
+			if err != nil {
+				Exit(errors.New(fmt.Sprintf("Reading %s: %s", *bundleFile, err)))
+			}
+		case hdr.Name == bundleManifest:
+			writeBundleFile(filepath.Join(dir, bundleManifest), r, "")
+		case path.Dir(hdr.Name) == "sources" && hdr.Typeflag == tar.TypeReg:
+			if err := os.MkdirAll(filepath.Join(dir, "sources"), 0755); err != nil {
+				Exit(err)
+			}
+			digest := path.Base(hdr.Name)
+			writeBundleFile(filepath.Join(dir, "sources", digest), r, digest)
+		}
+	}
+	bundleSources = map[string]string{}
+	for _, e := range index.Sources {
+		file := filepath.Join(dir, "sources", e.Sha256)
+		if _, err := os.Stat(file); err != nil {
+			Exit(fmt.Sprintf("%s lists %s, but doesn't hold it", *bundleFile, e.Url))
+		}
+		bundleSources[e.Url] = file
+	}
+	return filepath.Join(dir, bundleManifest)
+}
+
+// writeBundleFile writes what r holds to file, checking it has the
+// sha256 digest, if given.
+func writeBundleFile(file string, r io.Reader, digest string) {
+	out, err := os.Create(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer out.Close()
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(out, h), r); err != nil {
+		Exit(err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); digest != "" && got != digest {
+		Exit(fmt.Sprintf("%s holds %s with digest %s", *bundleFile, digest, got))
+	}
+	if err = out.Close(); err != nil {
+		Exit(err)
+	}
+}
+
+// BundledSource returns the bundled file for the remote source at url,
+// if a -bundle is loaded, checking it's the one digest pins.
+func BundledSource(url, digest string) (string, bool) {
+	if bundleSources == nil {
+		return "", false
+	}
+	file, ok := bundleSources[url]
+	if !ok {
+		Exit(fmt.Sprintf("Source %s isn't in %s", url, *bundleFile))
+	}
+	if digest != "" && filepath.Base(file) != digest {
+		Exit(fmt.Sprintf("%s holds %s with digest %s, expected %s", *bundleFile, url, filepath.Base(file), digest))
+	}
+	return file, true
+}
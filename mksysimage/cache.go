@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var cacheDir = flag.String("cache-dir", "",
+	"Keep downloaded sources pinned with #sha256= in this directory, which builds may share")
+
+var cacheMaxSize = flag.Uint64("cache-max-size", 0,
+	"Evict the least recently used sources from -cache-dir beyond this many MB, 0 for no limit")
+
+const cacheLock = ".lock"
+
+// Temporary files left by runs that died while inserting are removed
+// after this long.
+const cacheTmpAge = 24 * time.Hour
+
+// lockCache takes the cache's lock, which every build sharing it takes
+// to look in or change it, returning the function releasing it.
+func lockCache() func() {
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		Exit(err)
+	}
+	f, err := os.OpenFile(filepath.Join(*cacheDir, cacheLock), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		Exit(err)
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		Exit(err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+}
+
+func cacheEntry(digest string) string {
+	return filepath.Join(*cacheDir, "sha256-"+digest)
+}
+
+// CacheLookup links the cached source with digest to file, marking it
+// recently used. The link keeps it usable even if another build evicts
+// it meanwhile. The cache may be shared, so what's linked is hashed
+// again, and an entry that doesn't have its digest is evicted.
+func CacheLookup(digest, file string) bool {
+	if *cacheDir == "" || digest == "" {
+		return false
+	}
+	unlock := lockCache()
+	defer unlock()
+	entry := cacheEntry(digest)
+	if _, err := os.Stat(entry); err != nil {
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(entry, now, now)
+	if err := linkOrCopy(entry, file); err != nil {
+		Log(fmt.Sprintf("Warning: couldn't use cached %s: %s", entry, err))
+		return false
+	}
+	if got, err := fileDigest(file); err != nil || got != digest {
+		Log(fmt.Sprintf("Warning: evicting %s from the cache, which doesn't have its digest", entry))
+		os.Remove(file)
+		os.Remove(entry)
+		return false
+	}
+	return true
+}
+
+// fileDigest returns the sha256 digest of file, in hex.
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CacheInsert adds file, a source with the given digest, to the cache,
+// then evicts what -cache-max-size doesn't leave room for. The entry is
+// written under a temporary name and renamed into place, so other
+// builds never see half of it.
+func CacheInsert(digest, file string) {
+	if *cacheDir == "" || digest == "" {
+		return
+	}
+	unlock := lockCache()
+	defer unlock()
+	tmp, err := ioutil.TempFile(*cacheDir, "tmp-")
+	if err != nil {
+		Exit(err)
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	if err = linkOrCopy(file, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		Exit(err)
+	}
+	if err = os.Rename(tmp.Name(), cacheEntry(digest)); err != nil {
+		os.Remove(tmp.Name())
+		Exit(err)
+	}
+	evictCache()
+}
+
+// evictCache removes the least recently used entries until the cache
+// fits in -cache-max-size. The caller holds the lock.
+func evictCache() {
+	entries, err := ioutil.ReadDir(*cacheDir)
+	if err != nil {
+		Exit(err)
+	}
+	var total uint64
+	var kept []os.FileInfo
+	for _, e := range entries {
+		switch {
+		case e.Name() == cacheLock || e.IsDir():
+		case strings.HasPrefix(e.Name(), "tmp-"):
+			if time.Since(e.ModTime()) > cacheTmpAge {
+				os.Remove(filepath.Join(*cacheDir, e.Name()))
+			}
+		default:
+			total += uint64(e.Size())
+			kept = append(kept, e)
+		}
+	}
+	if *cacheMaxSize == 0 {
+		return
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].ModTime().Before(kept[j].ModTime()) })
+	for _, e := range kept {
+		if total <= *cacheMaxSize<<20 {
+			break
+		}
+		Log(fmt.Sprintf("Evicting %s from the cache", e.Name()))
+		if err := os.Remove(filepath.Join(*cacheDir, e.Name())); err != nil {
+			Exit(err)
+		}
+		total -= uint64(e.Size())
+	}
+}
+
+// linkOrCopy hard links src to dst, or copies it when they're on
+// different filesystems.
+func linkOrCopy(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
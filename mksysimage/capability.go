@@ -0,0 +1,113 @@
+package main
+
+// A BuildPlan is what a build is going to do, once its flags, sources
+// and layout are known: enough to tell which features it uses.
+type BuildPlan struct {
+	Sources []Source
+	Parts   []*Partition // The image's partitions, nil for an initramfs
+	Formats []string
+}
+
+// A Capability returns the programs a feature needs to carry out plan,
+// or nil if plan doesn't use the feature.
+type Capability func(plan *BuildPlan) []string
+
+type registeredCapability struct {
+	Feature    string
+	Needs      Capability
+	Privileged bool
+}
+
+var capabilities []registeredCapability
+
+// RegisterCapability makes the programs feature needs required by the
+// builds using it.
+func RegisterCapability(feature string, needs Capability) {
+	capabilities = append(capabilities, registeredCapability{feature, needs, false})
+}
+
+// RegisterPrivilegedCapability is RegisterCapability for a feature
+// running its programs as root, which -print-sudoers grants them.
+func RegisterPrivilegedCapability(feature string, needs Capability) {
+	capabilities = append(capabilities, registeredCapability{feature, needs, true})
+}
+
+// Requirements returns the programs plan needs, by feature, so a
+// minimal build only needs the programs it runs.
+func (plan *BuildPlan) Requirements() Requirements {
+	var reqs Requirements
+	for _, c := range capabilities {
+		reqs = reqs.Need(c.Feature, c.Needs(plan)...)
+	}
+	return reqs
+}
+
+// PrivilegedPrograms returns the programs plan runs as root, besides
+// those every build does.
+func (plan *BuildPlan) PrivilegedPrograms() []string {
+	var programs []string
+	for _, c := range capabilities {
+		if c.Privileged {
+			programs = append(programs, c.Needs(plan)...)
+		}
+	}
+	return programs
+}
+
+func init() {
+	RegisterCapability("sources", func(plan *BuildPlan) []string {
+		var programs []string
+		for _, s := range plan.Sources {
+			programs = append(programs, s.Programs()...)
+		}
+		return programs
+	})
+	RegisterPrivilegedCapability("disk images", func(plan *BuildPlan) []string {
+		if plan.Parts == nil {
+			return nil
+		}
+		if *assemble {
+			return []string{"dd"}
+		}
+		return []string{"dd", "mount", "umount"}
+	})
+	RegisterCapability("partitioning", func(plan *BuildPlan) []string {
+		if plan.Parts == nil || *noPartition || *assemble {
+			return nil
+		}
+		return []string{"sfdisk"}
+	})
+	RegisterPrivilegedCapability("partitioning and booting", func(plan *BuildPlan) []string {
+		if plan.Parts == nil || *noPartition || *assemble {
+			return nil
+		}
+		return append([]string{"kpartx", "losetup"}, ArchBootloader().Programs()...)
+	})
+	RegisterPrivilegedCapability("filesystems", func(plan *BuildPlan) []string {
+		var programs []string
+		for _, p := range plan.Parts {
+			if p.Fs != "" {
+				programs = append(programs, MkfsProgram(p.Fs))
+			}
+			if p.Fs == "ntfs" {
+				programs = append(programs, MountFs(p.Fs))
+			}
+		}
+		return programs
+	})
+	RegisterCapability("output formats", func(plan *BuildPlan) []string {
+		var programs []string
+		for _, f := range plan.Formats {
+			if converters[f] != "" {
+				programs = append(programs, converters[f])
+			}
+		}
+		return programs
+	})
+	RegisterPrivilegedCapability("initramfs", func(plan *BuildPlan) []string {
+		if plan.Parts != nil {
+			return nil
+		}
+		return []string{"find", "cpio"}
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var buildTime = flag.String("build-time", "",
+	"Date the image as built at this time, in seconds since 1970 or RFC 3339, rather than SOURCE_DATE_EPOCH or the time it was built")
+
+func init() {
+	RegisterCapability("-build-time", func(plan *BuildPlan) []string {
+		if _, ok := FixedBuildTime(); !ok || plan.Parts == nil {
+			return nil
+		}
+		programs := []string{"find", "touch"}
+		for _, p := range plan.Parts {
+			if p.Fs == "ext3" || p.Fs == "ext4" {
+				return append(programs, "debugfs")
+			}
+		}
+		return programs
+	})
+}
+
+// When the build started, which it's dated by when nothing fixes its
+// clock. Every output is dated the same, even past midnight.
+var startTime = time.Now().UTC()
+
+// FixedBuildTime returns the time -build-time or SOURCE_DATE_EPOCH
+// fixes the build's clock at, and false if neither is given.
+func FixedBuildTime() (time.Time, bool) {
+	if *buildTime == "" {
+		return SourceDateEpoch()
+	}
+	if secs, err := strconv.ParseInt(*buildTime, 10, 64); err == nil && secs >= 0 {
+		return time.Unix(secs, 0).UTC(), true
+	}
+	t, err := time.Parse(time.RFC3339, *buildTime)
+	if err != nil {
+		Exit(fmt.Sprintf("Bad -build-time %s, expected seconds since 1970 or RFC 3339", *buildTime))
+	}
+	return t.UTC(), true
+}
+
+// BuildTime returns the time everything that ends up in the outputs is
+// dated by: build info and metadata, output names, and the timestamps
+// the filesystems keep. Logs, audits and reports of how the build went
+// keep the real time.
+func BuildTime() time.Time {
+	if t, ok := FixedBuildTime(); ok {
+		return t
+	}
+	return startTime
+}
+
+// ClockEnv returns the environment the commands the build runs get on
+// top of its own. They run in UTC, so nothing they write depends on the
+// host's time zone, and with a fixed clock, they're told its time:
+// mksquashfs, mkfs.erofs and mkfs.vfat read SOURCE_DATE_EPOCH, and the
+// e2fsprogs E2FSPROGS_FAKE_TIME.
+func ClockEnv() []string {
+	env := []string{"TZ=UTC"}
+	if t, ok := FixedBuildTime(); ok {
+		env = append(env, fmt.Sprintf("SOURCE_DATE_EPOCH=%d", t.Unix()),
+			fmt.Sprintf("E2FSPROGS_FAKE_TIME=%d", t.Unix()))
+	}
+	return env
+}
+
+// ClampMtimes dates everything under root modified after the fixed
+// clock at its time, files from the sources and those the build wrote
+// alike. Without a fixed clock, there's nothing to clamp to.
+func ClampMtimes(root string) {
+	t, ok := FixedBuildTime()
+	if !ok {
+		return
+	}
+	Log("Clamping modification times")
+	at := fmt.Sprintf("@%d", t.Unix())
+	err := exe.Priv("find", root, "-newermt", at, "-exec", "touch", "-h", "-d", at, "{}", "+").Run()
+	Audit("clamp-mtimes", root, at, err)
+	if err != nil {
+		Exit(err)
+	}
+}
+
+// ClampExtTimes sets the times in the superblocks of the ext
+// filesystems of image, partitioned as parts, to the fixed clock's. The
+// kernel dates them as it mounts and writes them, so they're set once
+// everything is unmounted, with debugfs, which itself dates its writes
+// by E2FSPROGS_FAKE_TIME. Logical volumes and the -raid root are found
+// where they start within their partitions.
+func ClampExtTimes(image string, parts []*Partition) {
+	t, ok := FixedBuildTime()
+	if !ok {
+		return
+	}
+	starts := map[*Partition]uint64{parts[0]: 0}
+	if !*noPartition {
+		table := TablePartitions(parts)
+		for i, start := range PartitionStarts(table) {
+			starts[table[i]] = start
+		}
+		for _, p := range parts {
+			if p.Volume != "" {
+				starts[p] = VolumeStart(parts, p)
+			}
+		}
+		if *raidName != "" {
+			starts[parts[0]] += RaidDataOffset(image, starts[parts[0]])
+		}
+	}
+	for _, p := range parts {
+		start, ok := starts[p]
+		if !ok || (p.Fs != "ext3" && p.Fs != "ext4") {
+			continue
+		}
+		Log(fmt.Sprintf("Clamping superblock times of the %s partition", describePartition(p)))
+		var commands bytes.Buffer
+		for _, field := range []string{"mkfs_time", "mtime", "wtime", "lastcheck"} {
+			fmt.Fprintf(&commands, "ssv %s @%d\n", field, t.Unix())
+		}
+		cmd := exe.Cmd("debugfs", "-w", "-f", "-", fmt.Sprintf("%s?offset=%d", image, start*512))
+		cmd.Stdin = &commands
+		err := cmd.Run()
+		Audit("raw-write", image, fmt.Sprintf("ext superblock times at sector %d", start), err)
+		if err != nil {
+			Exit(err)
+		}
+	}
+}
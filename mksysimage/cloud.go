@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+var profile = flag.String("profile", "",
+	"Set of settings for a kind of target: cloud-baseline for the serial console, DHCP, cloud-init, growing on boot and PARTUUID root every cloud image needs")
+
+// A Profile bundles the settings a kind of target needs.
+type Profile struct {
+	// Serial is set if the bootloader's menu goes to the serial
+	// console as well.
+	Serial bool
+	// Check adjusts and checks the flags, before the layout is
+	// worked out.
+	Check func()
+	// Install configures the image mounted at mountpoint, once
+	// populated and before the manifest's directives, which can
+	// override what it writes.
+	Install func(mountpoint string, parts []*Partition)
+}
+
+var profiles = map[string]Profile{
+	"cloud-baseline": {true, checkCloudBaseline, installCloudBaseline},
+}
+
+// The serial console of each architecture, as the kernel names it.
+var serialConsoles = map[string]string{
+	"amd64":   "ttyS0,115200n8",
+	"386":     "ttyS0,115200n8",
+	"arm64":   "ttyAMA0,115200n8",
+	"arm":     "ttyAMA0,115200n8",
+	"ppc64le": "hvc0",
+	"s390x":   "ttysclp0",
+	"riscv64": "ttyS0,115200n8",
+}
+
+// CheckProfile checks -profile and applies its settings to the flags.
+func CheckProfile() {
+	if *profile == "" {
+		return
+	}
+	p, ok := profiles[*profile]
+	if !ok {
+		var names []string
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		Exit(fmt.Sprintf("Unknown profile %s, expected %s", *profile, strings.Join(names, " or ")))
+	}
+	p.Check()
+}
+
+// SerialBoot reports whether the bootloader's menu goes to the serial
+// console too.
+func SerialBoot() bool {
+	return profiles[*profile].Serial
+}
+
+// InstallProfile configures the image mounted at mountpoint as -profile
+// asks, if it does.
+func InstallProfile(mountpoint string, parts []*Partition) {
+	if *profile != "" {
+		Log(fmt.Sprintf("Applying the %s profile", *profile))
+		profiles[*profile].Install(mountpoint, parts)
+	}
+}
+
+// checkCloudBaseline boots the root by PARTUUID, since cloud disks can
+// show up under any name, with the console on both the screen and the
+// serial port, which is all some clouds show. DPS layouts get repart
+// definitions too, for growing on boot without cloud-init.
+func checkCloudBaseline() {
+	if *noPartition {
+		Exit("The cloud-baseline profile needs a partition table to boot from")
+	}
+	if *dps && *lvmGroup == "" {
+		*repart = true
+	}
+	if !FlagSet("kernel-args") {
+		root := "PARTUUID=" + PartitionUUID(1)
+		if *lvmGroup != "" {
+			root = VolumeDevice("root")
+		}
+		console := serialConsoles[*arch]
+		if *xen {
+			console = "hvc0"
+		}
+		*kernelArgs = fmt.Sprintf("root=%s ro console=tty0 console=%s", root, console)
+	}
+}
+
+// Brings up every wired interface with DHCP, for images using
+// systemd-networkd.
+const cloudNetwork = `[Match]
+Name=en* eth*
+
+[Network]
+DHCP=yes
+`
+
+// Points cloud-init at the usual datasources, and has it grow the root
+// partition and filesystem to fill the disk.
+const cloudInitConfig = `datasource_list: [NoCloud, ConfigDrive, OpenStack, Ec2, GCE, Azure, Oracle, None]
+growpart:
+  mode: auto
+  devices: ["/"]
+resize_rootfs: true
+`
+
+// installCloudBaseline sets up DHCP and cloud-init in the image mounted
+// at mountpoint. Files the sources provided are left alone.
+func installCloudBaseline(mountpoint string, parts []*Partition) {
+	writeIfMissing := func(file, data string) {
+		target := path.Join(mountpoint, file)
+		if _, ok := resolveInImage(mountpoint, file); ok {
+			Log(fmt.Sprintf("Keeping the /%s the sources provide", file))
+			return
+		}
+		if err := ImageMkdirAll(path.Dir(target), 0755); err != nil {
+			Exit(err)
+		}
+		if err := ImageWriteFile(target, []byte(data), 0644); err != nil {
+			Exit(err)
+		}
+	}
+	writeIfMissing("etc/systemd/network/80-dhcp.network", cloudNetwork)
+	for _, unit := range []string{"usr/lib/systemd/system/systemd-networkd.service",
+		"lib/systemd/system/systemd-networkd.service"} {
+		if _, ok := resolveInImage(mountpoint, unit); ok {
+			link := path.Join(mountpoint, "etc/systemd/system/multi-user.target.wants/systemd-networkd.service")
+			if err := ImageMkdirAll(path.Dir(link), 0755); err != nil {
+				Exit(err)
+			}
+			ImageRemove(link)
+			if err := ImageSymlink("/"+unit, link); err != nil {
+				Exit(err)
+			}
+			break
+		}
+	}
+
+	if _, ok := resolveInImage(mountpoint, "usr/bin/cloud-init"); !ok {
+		Log("Warning: the image has no cloud-init, so nothing will apply instance metadata or grow the root")
+	}
+	writeIfMissing("etc/cloud/cloud.cfg.d/90-mksysimage.cfg", cloudInitConfig)
+	// Neither growpart nor repart can grow the root into space
+	// beyond the partitions after it.
+	if len(TablePartitions(parts)) > 1 {
+		Log("Warning: partitions follow the root partition, so it can't grow into a bigger disk")
+	}
+}
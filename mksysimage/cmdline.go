@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var strictKernelArgs = flag.Bool("strict-kernel-args", false,
+	"Fail, rather than warn, on suspicious kernel args such as duplicate root= or both ro and rw")
+
+// COMMAND_LINE_SIZE of each architecture's kernel, counting the
+// terminating NUL.
+var cmdlineLimits = map[string]int{
+	"amd64":   2048,
+	"386":     2048,
+	"arm64":   2048,
+	"arm":     1024,
+	"ppc64le": 2048,
+	"s390x":   4096,
+	"riscv64": 1024,
+}
+
+// Kernel parameters common enough that something one letter away from
+// one is probably a typo of it.
+var knownKernelParams = []string{
+	"console",
+	"debug",
+	"init",
+	"initrd",
+	"loglevel",
+	"nomodeset",
+	"panic",
+	"quiet",
+	"ro",
+	"root",
+	"rootdelay",
+	"rootflags",
+	"rootfstype",
+	"rootwait",
+	"rw",
+	"single",
+	"splash",
+}
+
+// CheckKernelArgs validates the kernel args of every boot entry.
+// Malformed ones always fail the build; merely suspicious ones only
+// with -strict-kernel-args.
+func CheckKernelArgs(manifest *Manifest) {
+	warned := false
+	for _, cmdline := range kernelCmdlines(manifest) {
+		errs, warnings := ValidateKernelArgs(cmdline)
+		if len(errs) > 0 {
+			Exit(fmt.Sprintf("Bad kernel args %q: %s", cmdline, strings.Join(errs, ", ")))
+		}
+		for _, w := range warnings {
+			Log(fmt.Sprintf("Warning: kernel args %q: %s", cmdline, w))
+			warned = true
+		}
+	}
+	if warned && *strictKernelArgs {
+		Exit("Suspicious kernel args")
+	}
+}
+
+// SetRootArg returns cmdline with its root= arguments pointing at
+// root, or with one added first if it has none.
+func SetRootArg(cmdline, root string) string {
+	fields := strings.Fields(cmdline)
+	found := false
+	for i, arg := range fields {
+		if strings.HasPrefix(arg, "root=") {
+			fields[i], found = "root="+root, true
+		}
+	}
+	if !found {
+		fields = append([]string{"root=" + root}, fields...)
+	}
+	return strings.Join(fields, " ")
+}
+
+// kernelCmdlines returns the kernel args of every boot entry.
+func kernelCmdlines(manifest *Manifest) []string {
+	cmdlines := []string{*kernelArgs}
+	for _, d := range manifest.Entries {
+		cmdlines = append(cmdlines, *kernelArgs+" "+strings.Join(d.Args[1:], " "))
+	}
+	return cmdlines
+}
+
+// ValidateKernelArgs returns what makes cmdline unbootable, and what
+// looks like a mistake in it.
+func ValidateKernelArgs(cmdline string) (errs, warnings []string) {
+	limit, ok := cmdlineLimits[*arch]
+	if !ok {
+		limit = 2048
+	}
+	if len(cmdline) >= limit {
+		errs = append(errs, fmt.Sprintf("%d bytes long, over the %s limit of %d",
+			len(cmdline), *arch, limit-1))
+	}
+	if strings.Count(cmdline, `"`)%2 != 0 {
+		errs = append(errs, "unbalanced quotes")
+	}
+
+	values := map[string][]string{}
+	for _, param := range splitQuoted(cmdline) {
+		name, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		values[name] = append(values[name], value)
+	}
+	if len(values["root"]) > 1 {
+		warnings = append(warnings, fmt.Sprintf("root= given %d times, the last one wins",
+			len(values["root"])))
+	}
+	consoles := map[string]bool{}
+	for _, c := range values["console"] {
+		if consoles[c] {
+			warnings = append(warnings, fmt.Sprintf("console=%s given more than once", c))
+		}
+		consoles[c] = true
+	}
+	if values["ro"] != nil && values["rw"] != nil {
+		warnings = append(warnings, "both ro and rw given")
+	}
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, known := range knownKernelParams {
+			if name != known && len(name) > 2 && editDistance(name, known) == 1 {
+				warnings = append(warnings, fmt.Sprintf("%s might be a typo of %s", name, known))
+			}
+		}
+	}
+	return errs, warnings
+}
+
+// editDistance counts the single letter insertions, deletions,
+// substitutions and swaps of adjacent letters turning a into b.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] &&
+				d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// Block device names, with the partition number if any.
+var (
+	diskDevice      = regexp.MustCompile(`^/dev/(?:[hsv]d[a-z]+|xvd[a-z]+)([0-9]*)$`)
+	numberedDevice  = regexp.MustCompile(`^/dev/(?:mmcblk[0-9]+|nvme[0-9]+n[0-9]+|loop[0-9]+)(?:p([0-9]+))?$`)
+	virtualConsoles = regexp.MustCompile(`^tty[0-9]*$`)
+)
+
+// CheckKernelArgsLayout warns about root= and console= args of the boot
+// entries that don't fit the image populated at mountpoint with parts,
+// failing with -strict-kernel-args.
+func CheckKernelArgsLayout(mountpoint string, parts []*Partition, manifest *Manifest) {
+	warned := false
+	for _, cmdline := range kernelCmdlines(manifest) {
+		for _, w := range LayoutArgWarnings(mountpoint, parts, cmdline) {
+			Log(fmt.Sprintf("Warning: kernel args %q: %s", cmdline, w))
+			warned = true
+		}
+	}
+	if warned && *strictKernelArgs {
+		Exit("Kernel args don't match the image")
+	}
+}
+
+// LayoutArgWarnings returns the ways cmdline doesn't match the image.
+// Like the kernel, it goes by the last root= given.
+func LayoutArgWarnings(mountpoint string, parts []*Partition, cmdline string) []string {
+	var warnings []string
+	var root string
+	for _, arg := range strings.Fields(cmdline) {
+		name, value := arg, ""
+		if i := strings.Index(arg, "="); i >= 0 {
+			name, value = arg[:i], arg[i+1:]
+		}
+		switch name {
+		case "root":
+			root = value
+		case "rootfstype":
+			if value != parts[0].Fs && !(value == "ext4" && parts[0].Fs == "ext3") {
+				warnings = append(warnings, fmt.Sprintf("rootfstype=%s, but the root filesystem is %s",
+					value, parts[0].Fs))
+			}
+		case "console":
+			if w := checkConsole(mountpoint, strings.SplitN(value, ",", 2)[0]); w != "" {
+				warnings = append(warnings, w)
+			}
+		}
+	}
+	if w := checkRootArg(parts, root); w != "" {
+		warnings = append(warnings, w)
+	}
+	return warnings
+}
+
+// checkRootArg says what's wrong with root= given parts, if anything.
+// The root partition is always the first.
+func checkRootArg(parts []*Partition, root string) string {
+	switch {
+	case root == "":
+		return ""
+	case strings.HasPrefix(root, "LABEL="):
+		label := strings.TrimPrefix(root, "LABEL=")
+		for i, p := range parts {
+			if p.Label == label && i > 0 {
+				return fmt.Sprintf("root=%s is the label of the %s partition, not the root filesystem",
+					root, describePartition(p))
+			} else if p.Label == label {
+				return ""
+			}
+		}
+		return fmt.Sprintf("root=%s, but no partition has that label", root)
+	case strings.HasPrefix(root, "PARTUUID="):
+		uuid := PartitionUUID(1)
+		if parts[0].Volume != "" {
+			return fmt.Sprintf("root=%s is a partition, but the root filesystem is on logical volume %s",
+				root, VolumeDevice(parts[0].Volume))
+		} else if !strings.EqualFold(strings.TrimPrefix(root, "PARTUUID="), uuid) {
+			return fmt.Sprintf("root=%s, but the root partition's PARTUUID is %s", root, uuid)
+		}
+		return ""
+	case strings.HasPrefix(root, "UUID="):
+		// Only -fs-uuid and -layout-seed make the UUID known in advance.
+		uuid := FsUUID(parts[0])
+		if uuid != "" && !strings.EqualFold(strings.TrimPrefix(root, "UUID="), uuid) {
+			return fmt.Sprintf("root=%s, but the root filesystem's UUID is %s", root, uuid)
+		}
+		return ""
+	}
+	m := diskDevice.FindStringSubmatch(root)
+	if m == nil {
+		m = numberedDevice.FindStringSubmatch(root)
+	}
+	if m == nil {
+		return ""
+	}
+	n, _ := strconv.Atoi(m[1])
+	table := TablePartitions(parts)
+	switch {
+	case parts[0].Volume != "":
+		return fmt.Sprintf("root=%s is a partition, but the root filesystem is on logical volume %s",
+			root, VolumeDevice(parts[0].Volume))
+	case n == 0:
+		return fmt.Sprintf("root=%s is the whole disk, but the root filesystem is partition 1", root)
+	case n > len(table):
+		return fmt.Sprintf("root=%s names partition %d, but the image only has %d", root, n, len(table))
+	case n != 1:
+		return fmt.Sprintf("root=%s is the %s partition, not the root filesystem",
+			root, describePartition(table[n-1]))
+	}
+	return ""
+}
+
+func describePartition(p *Partition) string {
+	if p.Mount != "" {
+		return p.Mount
+	}
+	if p.Label != "" {
+		return p.Label
+	}
+	return p.Type
+}
+
+// checkConsole says why no login prompt may appear on console, if
+// that seems likely. systemd starts a getty on the kernel's console by
+// itself, and virtual consoles usually have one anyway, but anything
+// else has to be in /etc/inittab.
+func checkConsole(mountpoint, console string) string {
+	if console == "" || virtualConsoles.MatchString(console) {
+		return ""
+	}
+	for _, systemd := range []string{"usr/lib/systemd/systemd", "lib/systemd/systemd"} {
+		if _, ok := resolveInImage(mountpoint, systemd); ok {
+			return ""
+		}
+	}
+	inittab, err := ioutil.ReadFile(filepath.Join(mountpoint, "etc/inittab"))
+	if err != nil || bytes.Contains(inittab, []byte(console)) {
+		return ""
+	}
+	return fmt.Sprintf("console=%s, but /etc/inittab starts no getty on it", console)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var compat = flag.String("compat", "",
+	"Oldest kernel that must mount the image, as linux-VERSION; disables newer filesystem features")
+
+// The kernel version each ext4 filesystem feature appeared in.
+var extFeatureKernels = map[string]string{
+	"64bit":              "2.6.28",
+	"inline_data":        "3.8",
+	"metadata_csum":      "3.18",
+	"encrypt":            "4.1",
+	"metadata_csum_seed": "4.4",
+	"ea_inode":           "4.13",
+	"large_dir":          "4.13",
+	"casefold":           "5.2",
+	"verity":             "5.4",
+	"stable_inodes":      "5.5",
+	"fast_commit":        "5.10",
+	"orphan_file":        "5.15",
+}
+
+// CompatKernel returns the kernel version -compat asks for, or "".
+func CompatKernel() string {
+	if *compat == "" {
+		return ""
+	}
+	version := strings.TrimPrefix(*compat, "linux-")
+	if version == *compat || version == "" || !strings.ContainsAny(version[:1], "0123456789") {
+		Exit(fmt.Sprintf("Bad -compat %s, expected linux-VERSION", *compat))
+	}
+	return version
+}
+
+// compatArgs returns the mkfs arguments turning off the features of p's
+// filesystem that the -compat kernel can't mount.
+func compatArgs(p *Partition) []string {
+	kernel := CompatKernel()
+	if kernel == "" || !strings.HasPrefix(p.Fs, "ext") {
+		return nil
+	}
+	// Only the pinned features need turning off, and asking an older
+	// mke2fs to turn off one it doesn't know fails.
+	pinned := map[string]bool{}
+	for _, feature := range append(extBaseFeatures, extFsFeatures[p.Fs]...) {
+		pinned[feature] = true
+	}
+	var off []string
+	for feature, since := range extFeatureKernels {
+		if pinned[feature] && compareVersions(kernel, since) < 0 {
+			off = append(off, "^"+feature)
+		}
+	}
+	if len(off) == 0 {
+		return nil
+	}
+	sort.Strings(off)
+	return []string{"-O", strings.Join(off, ",")}
+}
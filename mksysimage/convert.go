@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// The program each output format is converted with. Raw images need
+// no conversion.
+var converters = map[string]string{
+	"raw":       "",
+	"vdi":       "vboxmanage",
+	"vmdk":      "vboxmanage",
+	"vhd":       "vboxmanage",
+	"qcow2":     "qemu-img",
+	"nspawn":    "cp",
+	"initramfs": "cpio",
+}
+
+// File extensions of the formats not named after theirs.
+var formatExtensions = map[string]string{
+	"nspawn": "raw",
+}
+
+// The settings systemd-nspawn boots an nspawn image with.
+const nspawnSettings = `[Exec]
+Boot=yes
+
+[Network]
+VirtualEthernet=yes
+`
+
+// ParseFormats splits a comma separated list of output formats.
+func ParseFormats(spec string) []string {
+	var formats []string
+	seen := map[string]bool{}
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		if _, ok := converters[f]; !ok {
+			Exit(fmt.Sprintf("Unknown format %s", f))
+		}
+		if !seen[f] {
+			formats = append(formats, f)
+			seen[f] = true
+		}
+	}
+	if seen["initramfs"] && len(formats) > 1 {
+		Exit("initramfs archives can't be built along with disk images")
+	}
+	if seen["raw"] && seen["nspawn"] {
+		Exit("nspawn images are raw already, so can't be built along with raw ones")
+	}
+	return formats
+}
+
+// OutputFile names the output for one format. A build producing a
+// single format writes exactly the file asked for, otherwise each
+// format gets its own extension in place of the given one. With
+// -output-template, the template names each format's output.
+func OutputFile(outfinal, format string, formats []string) string {
+	if *outputTemplate != "" {
+		return TemplateOutput(filepath.Dir(outfinal), format)
+	}
+	if len(formats) == 1 {
+		return outfinal
+	}
+	ext := format
+	if e, ok := formatExtensions[format]; ok {
+		ext = e
+	}
+	return strings.TrimSuffix(outfinal, filepath.Ext(outfinal)) + "." + ext
+}
+
+// NspawnSettingsFile names the settings file that goes with an nspawn
+// image. machinectl import-raw names the machine after the image, and
+// systemd-nspawn looks for its settings under the same name.
+func NspawnSettingsFile(image string) string {
+	return strings.TrimSuffix(image, filepath.Ext(image)) + ".nspawn"
+}
+
+// Convert writes the raw image to out in the given format.
+func Convert(raw, out, format string) {
+	Log(fmt.Sprintf("Creating %s image", format))
+	var err error
+	switch program := converters[format]; {
+	case externalConverters[format]:
+		err = convertExternal(raw, out, format)
+	case program == "vboxmanage":
+		err = exe.Heavy("vboxmanage", "convertfromraw",
+			raw, out,
+			fmt.Sprintf("--format=%s", strings.ToUpper(format))).Run()
+	case program == "qemu-img":
+		err = exe.Heavy("qemu-img", "convert", "-f", "raw", "-O", format, raw, out).Run()
+	case program == "cp":
+		err = exe.Heavy("cp", "--sparse=always", raw, out).Run()
+		if err == nil && format == "nspawn" {
+			err = ioutil.WriteFile(NspawnSettingsFile(out), []byte(nspawnSettings), 0644)
+		}
+	}
+	if err != nil {
+		Exit(err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var dps = flag.Bool("dps", false,
+	"Lay out a GPT disk typed per the Discoverable Partitions Specification")
+
+var repart = flag.Bool("repart", false,
+	"Install systemd-repart definitions matching the layout (needs -dps)")
+
+var arch = flag.String("arch", "amd64",
+	"Architecture of the image (amd64, 386, arm64, arm, ppc64le, s390x, riscv64)")
+
+// Partition type GUIDs from the Discoverable Partitions Specification,
+// https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+var dpsRootTypes = map[string]string{
+	"amd64":   "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+	"386":     "44479540-F297-41B2-9AF7-D131D5F0458A",
+	"arm64":   "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+	"arm":     "69DAD710-2CE4-4E3C-B16C-21A1D49ABED3",
+	"ppc64le": "C31C45E6-3F39-412E-80FB-4809C4980599",
+	"s390x":   "5EEAD9A9-FE09-4A1E-A1D7-520D00531306",
+	"riscv64": "72EC70A6-CF74-40E6-BD49-4BDA08E8F224",
+}
+
+var dpsUsrTypes = map[string]string{
+	"amd64":   "8484680C-9521-48C6-9C11-B0720656F69E",
+	"386":     "75250D76-8CC6-458E-BD66-BD47CC81A812",
+	"arm64":   "B0E01050-EE5F-4390-949A-9101B17104E9",
+	"arm":     "7D0359A3-02B3-4F0A-865C-654403E70625",
+	"ppc64le": "15BB03AF-77E7-4D4A-B12B-C0D084F7491C",
+	"s390x":   "8A4F5770-50AA-4ED3-874A-99B710DB6FEA",
+	"riscv64": "BEAEC34B-8442-439B-A40B-984381ED097D",
+}
+
+var dpsRootVerityTypes = map[string]string{
+	"amd64":   "2C7357ED-EBD2-46D9-AEC1-23D437EC2BF5",
+	"386":     "D13C5D3B-B5D1-422A-B29F-9454FDC89D76",
+	"arm64":   "DF3300CE-D69F-4C92-978C-9BFB0F38D820",
+	"arm":     "7386CDF2-203C-47A9-A498-F2ECCE45A2D6",
+	"ppc64le": "906BD944-4589-4AAE-A4E4-DD983917446A",
+	"s390x":   "B325BFBE-C7BE-4AB8-8357-139E652D2F6B",
+	"riscv64": "AE0253BE-1167-4007-AC68-43926C14C5DE",
+}
+
+var dpsMountTypes = map[string]string{
+	"/efi":      "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+	"/boot/efi": "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+	"/boot":     "BC13C2FF-59E6-4262-A352-B275FD6F7172",
+	"/home":     "933AC7E1-2EB4-4F13-B844-0E14E2AEF915",
+	"/srv":      "3B8F8425-20E0-4F3B-907F-1A25A76F98E8",
+	"/var":      "4D21B016-B534-45C2-A9FB-5C16E091FD2D",
+	"/var/tmp":  "7EC6F557-3BC5-4ACA-B293-16EF5DF639D1",
+	"swap":      "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F",
+}
+
+const dpsGenericType = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+
+// The names systemd-repart uses for the types above.
+var dpsMountNames = map[string]string{
+	"/":         "root",
+	"/usr":      "usr",
+	"/efi":      "esp",
+	"/boot/efi": "esp",
+	"/boot":     "xbootldr",
+	"/home":     "home",
+	"/srv":      "srv",
+	"/var":      "var",
+	"/var/tmp":  "tmp",
+	"swap":      "swap",
+}
+
+func CheckArch() {
+	if _, ok := dpsRootTypes[*arch]; !ok {
+		Exit(fmt.Sprintf("Unknown architecture %s", *arch))
+	}
+}
+
+// DpsType returns the GPT partition type that lets systemd discover p
+// without an fstab entry.
+func DpsType(p *Partition) string {
+	switch p.Mount {
+	case "/":
+		return dpsRootTypes[*arch]
+	case "/usr":
+		return dpsUsrTypes[*arch]
+	}
+	if t, ok := dpsMountTypes[p.Mount]; ok {
+		return t
+	}
+	return dpsGenericType
+}
+
+// InstallRepartConfig writes a systemd-repart definition for each
+// partition into the image so that repart adopts the existing layout on
+// first boot. The root filesystem is allowed to grow into any space
+// the disk gained. Definitions already supplied by a source
+// are left alone.
+func InstallRepartConfig(mountpoint string, parts []*Partition) {
+	dir := filepath.Join(mountpoint, "usr/lib/repart.d")
+	if err := ImageMkdirAll(dir, 0755); err != nil {
+		Exit(err)
+	}
+	for _, p := range parts {
+		if p.Mount == "" {
+			continue
+		}
+		name, ok := dpsMountNames[p.Mount]
+		if !ok {
+			name = "linux-generic"
+		}
+		file := filepath.Join(dir, fmt.Sprintf("50-%s.conf",
+			strings.Trim(strings.Replace(p.Mount, "/", "-", -1), "-")))
+		if p.Mount == "/" {
+			file = filepath.Join(dir, "50-root.conf")
+		}
+		if _, err := os.Stat(file); err == nil {
+			Log(fmt.Sprintf("Keeping existing %s", file[len(mountpoint):]))
+			continue
+		}
+		cfg := fmt.Sprintf("[Partition]\nType=%s\n", name)
+		if p.Mount == "/" {
+			cfg += "GrowFileSystem=yes\n"
+		}
+		if err := ImageWriteFile(file, []byte(cfg), 0644); err != nil {
+			Exit(err)
+		}
+	}
+}
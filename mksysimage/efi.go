@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+var uefi = flag.Bool("uefi", false,
+	"Make the image boot with UEFI too, from a FAT32 EFI System Partition at /boot/efi holding syslinux.efi")
+
+var espSize = flag.Uint64("esp-size", 100,
+	"Size in MB of the -uefi EFI System Partition")
+
+const espMount = "/boot/efi"
+
+// Where distributions put syslinux's EFI files, with %s for efi32 or
+// efi64: syslinux.efi, then ldlinux.e32 or ldlinux.e64.
+var syslinuxEfiDirs = []string{
+	"/usr/lib/SYSLINUX.EFI/%s",
+	"/usr/lib/syslinux/modules/%s",
+	"/usr/lib/syslinux/%s",
+	"/usr/share/syslinux/%s",
+}
+
+// The UEFI names of what the firmware boots from a removable disk, and
+// the syslinux build for it, by -arch. syslinux only runs on x86.
+var efiTargets = map[string][2]string{
+	"amd64": {"BOOTX64.EFI", "efi64"},
+	"386":   {"BOOTIA32.EFI", "efi32"},
+}
+
+// EspPartition returns the partition -uefi adds to the layout. UEFI
+// firmware looks for FAT32, and finds it by type: "ef" on an MBR, and
+// the DPS ESP type on GPT.
+func EspPartition() *Partition {
+	if _, ok := efiTargets[*arch]; !ok {
+		Exit(fmt.Sprintf("-uefi installs syslinux, which doesn't run on %s", *arch))
+	}
+	if *espSize < fat32MinSize {
+		Exit(fmt.Sprintf("The EFI System Partition needs at least %d MB for FAT32", fat32MinSize))
+	}
+	p := &Partition{Mount: espMount, Size: *espSize, Fs: "vfat", Label: "ESP", Type: "ef"}
+	if *dps {
+		p.Type = ""
+	}
+	return p
+}
+
+// efiFile finds one of syslinux's EFI files for the build named bits.
+func efiFile(bits, name string) string {
+	dirs := syslinuxEfiDirs
+	if *syslinuxDir != "" {
+		dirs = []string{path.Join(*syslinuxDir, "%s")}
+	}
+	var tried []string
+	for _, dir := range dirs {
+		file := path.Join(fmt.Sprintf(dir, bits), name)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+		tried = append(tried, fmt.Sprintf(dir, bits))
+	}
+	Exit(fmt.Sprintf("Couldn't find syslinux's %s in %s", name, strings.Join(tried, ", ")))
+	return ""
+}
+
+// InstallEfiBoot installs syslinux.efi as the ESP's default boot
+// program, with the same boot menu as extlinux. syslinux.efi only reads
+// its own partition, so the kernels and initrds in boot are copied
+// beside it.
+func InstallEfiBoot(mountpoint, boot string, kernels []BootKernel, manifest *Manifest) {
+	target := efiTargets[*arch]
+	dir := path.Join(mountpoint, espMount, "EFI/BOOT")
+	if err := ImageMkdirAll(dir, 0755); err != nil {
+		Exit(err)
+	}
+	ldlinux := "ldlinux.e64"
+	if target[1] == "efi32" {
+		ldlinux = "ldlinux.e32"
+	}
+	copies := [][2]string{
+		{efiFile(target[1], "syslinux.efi"), target[0]},
+		{efiFile(target[1], ldlinux), ldlinux},
+	}
+	entries := BootEntries(kernels, manifest)
+	seen := map[string]bool{}
+	for _, e := range entries {
+		for _, file := range []string{e.Kernel, e.Initrd} {
+			if file != "" && !seen[file] {
+				copies = append(copies, [2]string{path.Join(boot, file), file})
+				seen[file] = true
+			}
+		}
+	}
+	for _, c := range copies {
+		if err := exe.Priv("cp", c[0], path.Join(dir, c[1])).Run(); err != nil {
+			Exit(err)
+		}
+	}
+	WriteEfiMenu(dir, entries)
+	Audit("bootloader-install", dir, target[0], nil)
+}
+
+// WriteEfiMenu writes syslinux.efi's boot menu for entries to dir, on
+// the ESP, with the modules branding it needs.
+func WriteEfiMenu(dir string, entries []BootEntry) {
+	bits := efiTargets[*arch][1]
+	cfg := SyslinuxConfig(entries)
+	if err := ImageWriteFile(path.Join(dir, "syslinux.cfg"), []byte(cfg), 0644); err != nil {
+		Exit(err)
+	}
+	installSyslinuxBranding(dir, func(name string) string { return efiFile(bits, name) })
+}
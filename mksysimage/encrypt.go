@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var encryptOutput = flag.String("encrypt-output", "",
+	"Encrypt the outputs with age or gpg for the -encrypt-to recipients, removing the unencrypted ones")
+
+var encryptTo = flag.String("encrypt-to", "",
+	"Comma separated age recipients or gpg key IDs to encrypt the outputs for")
+
+func init() {
+	RegisterCapability("-encrypt-output", func(plan *BuildPlan) []string {
+		if *encryptOutput == "" {
+			return nil
+		}
+		return []string{*encryptOutput}
+	})
+}
+
+// Recipients returns the -encrypt-to recipients, checking that they
+// go with -encrypt-output.
+func Recipients() []string {
+	if *encryptOutput == "" {
+		if *encryptTo != "" {
+			Exit("-encrypt-to needs -encrypt-output")
+		}
+		return nil
+	}
+	if *encryptOutput != "age" && *encryptOutput != "gpg" {
+		Exit(fmt.Sprintf("Unknown encryption %s, expected age or gpg", *encryptOutput))
+	}
+	var recipients []string
+	for _, r := range strings.Split(*encryptTo, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			recipients = append(recipients, r)
+		}
+	}
+	if len(recipients) == 0 {
+		Exit("-encrypt-output needs -encrypt-to recipients")
+	}
+	return recipients
+}
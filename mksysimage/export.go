@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var exportPartitions = flag.Bool("export-partitions", false,
+	"Also write each partition's filesystem to its own file beside the image, such as out.rootfs.ext4 and out.esp.vfat")
+
+// PartitionName names p, the i'th partition, for files and tools that
+// need a name for each partition.
+func PartitionName(p *Partition, i int) string {
+	switch {
+	case p.Mount == "/":
+		return "rootfs"
+	case p.Mount == espMount:
+		return "esp"
+	case p.Mount != "":
+		return strings.Replace(strings.Trim(p.Mount, "/"), "/", "-", -1)
+	case p.Label != "":
+		return strings.Replace(strings.ToLower(p.Label), " ", "-", -1)
+	}
+	return fmt.Sprintf("part%d", i+1)
+}
+
+// ExportName names the file the filesystem of p is exported to, for an
+// image named outfinal.
+func ExportName(outfinal string, p *Partition, i int) string {
+	return fmt.Sprintf("%s.%s.%s", outputStem(outfinal), PartitionName(p, i), p.Fs)
+}
+
+// Exported reports whether ExportPartitions writes out p.
+func Exported(p *Partition) bool {
+	return *exportPartitions && p.Fs != "" && p.Fs != "swap"
+}
+
+// outputStem returns outfinal without its extension, for naming the
+// files that go beside it.
+func outputStem(outfinal string) string {
+	return strings.TrimSuffix(outfinal, filepath.Ext(outfinal))
+}
+
+// ExportPartitions copies the filesystem of each partition among parts
+// out of the raw image, as -export-partitions asks. Swap has nothing in
+// it worth having, and partitions without a filesystem are raw data.
+// Logical volumes stay within their LVM partition.
+func ExportPartitions(raw, outfinal string, parts []*Partition) {
+	f, err := os.Open(raw)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	var offsets, sizes []int64
+	if *noPartition {
+		st, err := f.Stat()
+		if err != nil {
+			Exit(err)
+		}
+		offsets, sizes = []int64{0}, []int64{st.Size()}
+	} else {
+		for _, p := range ReadImageTable(raw).Partitions {
+			offsets = append(offsets, int64(p.Start)*512)
+			sizes = append(sizes, int64(p.Size)*512)
+		}
+	}
+	for i, p := range TablePartitions(parts) {
+		if !Exported(p) {
+			continue
+		}
+		out := ExportName(outfinal, p, i)
+		Log(fmt.Sprintf("Exporting the %s filesystem to %s", p.Fs, out))
+		if err = copySparse(out, io.NewSectionReader(f, offsets[i], sizes[i]), sizes[i]); err != nil {
+			Exit(err)
+		}
+	}
+}
+
+// copySparse copies size bytes from r to a new file, leaving holes
+// where the data is all zeros, since filesystems are mostly free space.
+func copySparse(file string, r io.Reader, size int64) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err = writeSparse(out, r); err != nil {
+		return err
+	}
+	if err = out.Truncate(size); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeSparse copies r to out from its current offset, seeking past
+// the data that's all zeros rather than writing it.
+func writeSparse(out *os.File, r io.Reader) error {
+	var err error
+	buf := make([]byte, 1<<20)
+	zeros := make([]byte, len(buf))
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zeros[:n]) {
+				_, err = out.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = out.Write(buf[:n])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return rerr
+		}
+	}
+	return nil
+}
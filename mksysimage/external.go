@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The formats -converter adds, and what each converter reported
+// writing besides its output, by format.
+var (
+	externalConverters = map[string]bool{}
+	converterArtifacts = map[string][]Artifact{}
+)
+
+type converterList struct{}
+
+func (converterList) String() string { return "" }
+
+func (converterList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New(fmt.Sprintf("Malformed converter %s, expected FORMAT=PROGRAM", value))
+	}
+	if _, ok := converters[parts[0]]; ok && !externalConverters[parts[0]] {
+		return errors.New(fmt.Sprintf("%s is a built in format", parts[0]))
+	}
+	converters[parts[0]] = parts[1]
+	externalConverters[parts[0]] = true
+	return nil
+}
+
+func init() {
+	flag.Var(converterList{}, "converter",
+		"Add an output format as FORMAT=PROGRAM, PROGRAM converting raw images to it, may be repeated")
+}
+
+// A ConverterRequest is what an external converter reads on its
+// stdin, as JSON.
+type ConverterRequest struct {
+	Version  int               `json:"version"` // Of the contract, now 1
+	Input    string            `json:"input"`   // The raw image
+	Output   string            `json:"output"`  // Where the converted image goes
+	Format   string            `json:"format"`
+	Metadata ConverterMetadata `json:"metadata"`
+}
+
+// ConverterMetadata describes the image being converted.
+type ConverterMetadata struct {
+	Name       string            `json:"name"`
+	Version    string            `json:"version,omitempty"`
+	Arch       string            `json:"arch"`
+	DiskSize   uint64            `json:"disk_size"` // In MB
+	KernelArgs string            `json:"kernel_args,omitempty"`
+	Vars       map[string]string `json:"vars,omitempty"`
+}
+
+// A ConverterResponse is what an external converter writes on its
+// stdout, as JSON, once it has written the request's output. Artifacts
+// lists any other files it wrote, which are output along with it.
+type ConverterResponse struct {
+	Artifacts []struct {
+		File   string `json:"file"` // Relative to the output's directory, if not absolute
+		Format string `json:"format"`
+	} `json:"artifacts"`
+}
+
+// convertExternal runs the -converter program for format to convert
+// raw to out, recording the other files it wrote. Anything it prints
+// on stderr goes to the log.
+func convertExternal(raw, out, format string) error {
+	req, err := json.Marshal(ConverterRequest{
+		Version: 1,
+		Input:   raw,
+		Output:  out,
+		Format:  format,
+		Metadata: ConverterMetadata{
+			Name:       outputVars(format).Name,
+			Version:    *imageVersion,
+			Arch:       *arch,
+			DiskSize:   *diskSize,
+			KernelArgs: buildVars.KernelArgs,
+			Vars:       buildVars.Var,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	cmd := exe.Heavy(converters[format])
+	cmd.Stdin = bytes.NewReader(req)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err = cmd.Run(); err != nil {
+		return errors.New(fmt.Sprintf("%s converter %s: %s", format, converters[format], err))
+	}
+	var resp ConverterResponse
+	if err = json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return errors.New(fmt.Sprintf("%s converter %s wrote a bad response: %s", format, converters[format], err))
+	}
+	if _, err = os.Stat(out); err != nil {
+		return errors.New(fmt.Sprintf("%s converter %s didn't write %s", format, converters[format], out))
+	}
+	for _, a := range resp.Artifacts {
+		file := a.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(out), file)
+		}
+		if file == out {
+			continue
+		}
+		if _, err = os.Stat(file); err != nil {
+			return errors.New(fmt.Sprintf("%s converter %s listed %s, which doesn't exist", format, converters[format], file))
+		}
+		if a.Format == "" {
+			a.Format = format
+		}
+		converterArtifacts[format] = append(converterArtifacts[format], Artifact{File: file, Format: a.Format})
+	}
+	return nil
+}
+
+// FinishConverterArtifacts outputs the other files the converter for
+// format wrote, as FinishOutput does its output.
+func FinishConverterArtifacts(format string) {
+	for _, a := range converterArtifacts[format] {
+		FinishOutput(a.File, a.File, a.Format)
+	}
+}
+
+// ConverterOutputs lists the other files converters wrote, in their
+// final form, along with their formats.
+func ConverterOutputs(formats []string) []Artifact {
+	var outputs []Artifact
+	for _, f := range formats {
+		for _, a := range converterArtifacts[f] {
+			outputs = append(outputs, Artifact{File: FinalName(a.File), Format: a.Format})
+		}
+	}
+	return outputs
+}
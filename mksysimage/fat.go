@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The earliest time FAT can store.
+var fatEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// FatClampTime returns the time FAT timestamps are clamped to, so that
+// FAT filesystems come out the same from the same sources: the fixed
+// build time, or with -layout-seed, the earliest FAT can store. It
+// returns false if neither is given.
+func FatClampTime() (time.Time, bool) {
+	if t, ok := FixedBuildTime(); ok {
+		if t.Before(fatEpoch) {
+			t = fatEpoch
+		}
+		return t, true
+	}
+	return fatEpoch, *layoutSeed != ""
+}
+
+// FatMountOptions returns the options to mount FAT filesystems with.
+// FAT stores local times, so when they're clamped, the time zone
+// they're in is fixed too.
+func FatMountOptions() string {
+	// FAT can't store modes, and without quiet, setting one fails.
+	options := "quiet"
+	if _, ok := FatClampTime(); ok {
+		options += ",tz=UTC"
+	}
+	return options
+}
+
+// fatVolumeID returns the volume ID mkfs.vfat gives the filesystem of
+// p, 8 hex digits derived from its UUID or the clamp time, or "" if it
+// makes up a random one.
+func fatVolumeID(p *Partition) string {
+	if uuid := FsUUID(p); uuid != "" {
+		return strings.Replace(uuid, "-", "", -1)[:8]
+	}
+	if t, ok := FatClampTime(); ok {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00volume id %s", t.Unix(), p.Mount)))
+		return fmt.Sprintf("%x", sum[:4])
+	}
+	return ""
+}
+
+// ClampFatTimes clamps the timestamps in the FAT filesystems of image,
+// partitioned as parts, to FatClampTime, if it's given. The kernel sets
+// creation times as files are written, which nothing can change in a
+// mounted filesystem, so the directory entries are rewritten in the
+// image itself once everything is unmounted.
+func ClampFatTimes(image string, parts []*Partition) {
+	clamp, ok := FatClampTime()
+	// The root, all -no-partition images have, is never FAT.
+	if !ok || *noPartition {
+		return
+	}
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	parts = TablePartitions(parts)
+	starts := PartitionStarts(parts)
+	for i, p := range parts {
+		if p.Fs != "vfat" {
+			continue
+		}
+		Log(fmt.Sprintf("Clamping timestamps in the %s partition", describePartition(p)))
+		n, err := clampFat(f, int64(starts[i]*512), clamp)
+		Audit("raw-write", image, fmt.Sprintf("FAT timestamps of %d entries at sector %d", n, starts[i]), err)
+		if err != nil {
+			Exit(err)
+		}
+	}
+}
+
+// A fatVolume is a FAT filesystem at an offset in a file.
+type fatVolume struct {
+	f         *os.File
+	base      int64
+	bits      int   // Of each FAT entry: 12, 16 or 32
+	cluster   int64 // Its size in bytes
+	fatStart  int64 // Offsets from base
+	dataStart int64
+}
+
+// clampFat clamps the timestamps of every directory entry in the FAT
+// filesystem at offset base in f to clamp, returning how many it went
+// through.
+func clampFat(f *os.File, base int64, clamp time.Time) (int, error) {
+	bpb := make([]byte, 512)
+	if _, err := f.ReadAt(bpb, base); err != nil {
+		return 0, err
+	}
+	le := binary.LittleEndian
+	sector := int64(le.Uint16(bpb[11:]))
+	reserved := int64(le.Uint16(bpb[14:]))
+	fats := int64(bpb[16])
+	rootEntries := int64(le.Uint16(bpb[17:]))
+	total := int64(le.Uint16(bpb[19:]))
+	if total == 0 {
+		total = int64(le.Uint32(bpb[32:]))
+	}
+	fatSize := int64(le.Uint16(bpb[22:]))
+	if fatSize == 0 {
+		fatSize = int64(le.Uint32(bpb[36:]))
+	}
+	if sector == 0 || bpb[13] == 0 || bpb[510] != 0x55 || bpb[511] != 0xaa {
+		return 0, errors.New(fmt.Sprintf("No FAT boot sector at offset %d", base))
+	}
+	rootSectors := (rootEntries*32 + sector - 1) / sector
+	v := &fatVolume{f: f, base: base, cluster: sector * int64(bpb[13]),
+		fatStart: reserved * sector}
+	v.dataStart = (reserved + fats*fatSize + rootSectors) * sector
+	switch clusters := (total - v.dataStart/sector) / int64(bpb[13]); {
+	case clusters < 4085:
+		v.bits = 12
+	case clusters < 65525:
+		v.bits = 16
+	default:
+		v.bits = 32
+	}
+	date, tod := fatTimestamp(clamp)
+	clampEntry := func(e []byte) {
+		entryTime := func(date, tod uint16) time.Time {
+			return time.Date(int(date>>9)+1980, time.Month(date>>5&15), int(date&31),
+				int(tod>>11), int(tod>>5&63), int(tod&31)*2, 0, time.UTC)
+		}
+		if entryTime(le.Uint16(e[16:]), le.Uint16(e[14:])).After(clamp) {
+			e[13] = 0
+			le.PutUint16(e[14:], tod)
+			le.PutUint16(e[16:], date)
+		}
+		if entryTime(le.Uint16(e[18:]), 0).After(clamp) {
+			le.PutUint16(e[18:], date)
+		}
+		if entryTime(le.Uint16(e[24:]), le.Uint16(e[22:])).After(clamp) {
+			le.PutUint16(e[22:], tod)
+			le.PutUint16(e[24:], date)
+		}
+	}
+
+	count := 0
+	seen := map[uint32]bool{}
+	var walk func(dir []byte, write func([]byte) error) error
+	walk = func(dir []byte, write func([]byte) error) error {
+		var subdirs []uint32
+		for i := 0; i+32 <= len(dir); i += 32 {
+			e := dir[i : i+32]
+			if e[0] == 0 {
+				break
+			}
+			if e[0] == 0xe5 || e[11] == 0x0f {
+				// Deleted, or part of a long name.
+				continue
+			}
+			clampEntry(e)
+			count++
+			first := uint32(le.Uint16(e[20:]))<<16 | uint32(le.Uint16(e[26:]))
+			if e[11]&0x10 != 0 && e[0] != '.' && first >= 2 && !seen[first] {
+				seen[first] = true
+				subdirs = append(subdirs, first)
+			}
+		}
+		if err := write(dir); err != nil {
+			return err
+		}
+		for _, c := range subdirs {
+			data, chain, err := v.readChain(c)
+			if err != nil {
+				return err
+			}
+			if err = walk(data, func(data []byte) error { return v.writeChain(chain, data) }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if v.bits == 32 {
+		data, chain, err := v.readChain(le.Uint32(bpb[44:]))
+		if err != nil {
+			return 0, err
+		}
+		return count, walk(data, func(data []byte) error { return v.writeChain(chain, data) })
+	}
+	root := make([]byte, rootEntries*32)
+	rootAt := base + v.fatStart + fats*fatSize*sector
+	if _, err := f.ReadAt(root, rootAt); err != nil {
+		return 0, err
+	}
+	return count, walk(root, func(data []byte) error {
+		_, err := f.WriteAt(data, rootAt)
+		return err
+	})
+}
+
+// fatTimestamp encodes t as a FAT date and time of day.
+func fatTimestamp(t time.Time) (date, tod uint16) {
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tod = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tod
+}
+
+// next returns the cluster after c in its chain, or 0 at its end.
+func (v *fatVolume) next(c uint32) (uint32, error) {
+	b := make([]byte, 4)
+	at := v.base + v.fatStart + int64(c)*int64(v.bits)/8
+	if _, err := v.f.ReadAt(b, at); err != nil {
+		return 0, err
+	}
+	var n, end uint32
+	switch v.bits {
+	case 12:
+		n = uint32(binary.LittleEndian.Uint16(b))
+		if c%2 == 1 {
+			n >>= 4
+		}
+		n, end = n&0xfff, 0xff8
+	case 16:
+		n, end = uint32(binary.LittleEndian.Uint16(b)), 0xfff8
+	default:
+		n, end = binary.LittleEndian.Uint32(b)&0x0fffffff, 0x0ffffff8
+	}
+	if n < 2 || n >= end {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// readChain reads the clusters of the chain starting at first.
+func (v *fatVolume) readChain(first uint32) ([]byte, []uint32, error) {
+	var data []byte
+	var chain []uint32
+	seen := map[uint32]bool{}
+	for c := first; c != 0 && !seen[c]; {
+		seen[c] = true
+		chain = append(chain, c)
+		buf := make([]byte, v.cluster)
+		if _, err := v.f.ReadAt(buf, v.offset(c)); err != nil {
+			return nil, nil, err
+		}
+		data = append(data, buf...)
+		var err error
+		if c, err = v.next(c); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, chain, nil
+}
+
+// writeChain writes data back to the clusters of chain.
+func (v *fatVolume) writeChain(chain []uint32, data []byte) error {
+	for i, c := range chain {
+		if _, err := v.f.WriteAt(data[int64(i)*v.cluster:int64(i+1)*v.cluster], v.offset(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offset returns where cluster c is in the file.
+func (v *fatVolume) offset(c uint32) int64 {
+	return v.base + v.dataStart + int64(c-2)*v.cluster
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var requireDigests = flag.Bool("require-digests", false,
+	"Refuse remote sources that aren't pinned with #sha256=DIGEST")
+
+var fetchTimeout = flag.Int("fetch-timeout", 30,
+	"Minutes to give downloading each remote source before failing, so a stalled mirror doesn't hang the build")
+
+// Where remote sources are downloaded to, set up by main.
+var downloadDir string
+
+func init() {
+	resolver := func(scheme string) SourceResolver {
+		return func(root, location, dir string) Source {
+			url, digest := location, ""
+			if i := strings.Index(location, "#sha256="); i >= 0 {
+				url, digest = location[:i], strings.ToLower(location[i+len("#sha256="):])
+			}
+			return &httpSource{tarSource{root, ""}, scheme + ":" + url, digest}
+		}
+	}
+	RegisterSource("http", resolver("http"))
+	RegisterSource("https", resolver("https"))
+}
+
+// An httpSource is a tarball downloaded over HTTP(S). Appending
+// #sha256=DIGEST to the URL pins its contents.
+type httpSource struct {
+	tarSource
+	url, digest string
+}
+
+func (s *httpSource) String() string { return fmt.Sprintf("%s:%s", s.root, s.url) }
+
+func (s *httpSource) Fetch() {
+	// A bundle pins every source it holds.
+	if file, ok := BundledSource(s.url, s.digest); ok {
+		s.path = file
+		return
+	}
+	if s.digest == "" {
+		if *requireDigests {
+			Exit(fmt.Sprintf("Source %s isn't pinned to a digest", s.url))
+		}
+		Log(fmt.Sprintf("Warning: source %s isn't pinned to a digest", s.url))
+	}
+	name := path.Base(s.url)
+	if u, err := url.Parse(s.url); err == nil {
+		name = path.Base(u.Path)
+	}
+	sum := sha256.Sum256([]byte(s.url))
+	file := filepath.Join(downloadDir, hex.EncodeToString(sum[:8])+"-"+name)
+	if CacheLookup(s.digest, file) {
+		Log(fmt.Sprintf("Using cached %s", s.url))
+		s.path = file
+		return
+	}
+	Log(fmt.Sprintf("Downloading %s", s.url))
+	client := &http.Client{Timeout: time.Duration(*fetchTimeout) * time.Minute}
+	resp, err := client.Get(s.url)
+	if err != nil {
+		Exit(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		Exit(fmt.Sprintf("Fetching %s: %s", s.url, resp.Status))
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer out.Close()
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(out, h), resp.Body); err != nil {
+		Exit(errors.New(fmt.Sprintf("Fetching %s: %s", s.url, err)))
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); s.digest != "" && got != s.digest {
+		Exit(fmt.Sprintf("Source %s has digest %s, expected %s", s.url, got, s.digest))
+	}
+	if err = out.Close(); err != nil {
+		Exit(err)
+	}
+	CacheInsert(s.digest, file)
+	s.path = file
+}
+
+// FetchAll fetches every source at once, failing if any of them does.
+func FetchAll(sources []Source) {
+	failures := make([]interface{}, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source Source) {
+			defer wg.Done()
+			// Exit panics, which has to be caught here rather
+			// than in main.
+			defer func() {
+				failures[i] = recover()
+			}()
+			source.Fetch()
+		}(i, source)
+	}
+	wg.Wait()
+	for _, failure := range failures {
+		if failure != nil {
+			Exit(failure)
+		}
+	}
+}
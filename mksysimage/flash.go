@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var flashDescriptors = flag.String("flash-descriptors", "",
+	"Comma separated descriptors of the layout to write beside the image for flashing tools: android, rockchip or genimage")
+
+// A flashDescriptor describes the image's layout in a flashing tool's
+// own terms. The descriptors name the files -export-partitions writes,
+// when it's given, so the partitions can be flashed one by one.
+type flashDescriptor struct {
+	// The suffix of the file written beside the image.
+	suffix string
+	write  func(buf *bytes.Buffer, outfinal string, parts []*Partition)
+}
+
+var flashDescriptorKinds = map[string]flashDescriptor{
+	"android":  {"partition.xml", writeAndroidDescriptor},
+	"rockchip": {"parameter.txt", writeRockchipDescriptor},
+	"genimage": {"genimage.cfg", writeGenimageDescriptor},
+}
+
+// FlashDescriptors returns the descriptors -flash-descriptors asks for.
+func FlashDescriptors() []string {
+	if *flashDescriptors == "" {
+		return nil
+	}
+	return strings.Split(*flashDescriptors, ",")
+}
+
+// CheckFlashDescriptors checks that the descriptors -flash-descriptors
+// asks for exist and can describe parts.
+func CheckFlashDescriptors(parts []*Partition) {
+	for _, kind := range FlashDescriptors() {
+		if _, ok := flashDescriptorKinds[kind]; !ok {
+			Exit(fmt.Sprintf("Unknown flash descriptor %s, expected android, rockchip or genimage", kind))
+		}
+		if *noPartition {
+			Exit("-flash-descriptors describe a partition table, which -no-partition images lack")
+		}
+		// Rockchip's tools write a GPT from parameter.txt.
+		if kind == "rockchip" && !*dps {
+			Exit("rockchip flash descriptors need a -dps layout")
+		}
+	}
+}
+
+// WriteFlashDescriptors writes each descriptor -flash-descriptors asks
+// for beside the image named outfinal.
+func WriteFlashDescriptors(outfinal string, parts []*Partition) {
+	parts = TablePartitions(parts)
+	for _, kind := range FlashDescriptors() {
+		d := flashDescriptorKinds[kind]
+		file := fmt.Sprintf("%s.%s", outputStem(outfinal), d.suffix)
+		Log(fmt.Sprintf("Writing %s flash descriptor %s", kind, file))
+		var buf bytes.Buffer
+		d.write(&buf, outfinal, parts)
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			Exit(err)
+		}
+	}
+}
+
+// flashImage returns the file holding the contents of p, the i'th
+// partition, relative to the descriptors, or "" if there's none.
+func flashImage(outfinal string, p *Partition, i int) string {
+	if !Exported(p) {
+		return ""
+	}
+	return filepath.Base(ExportName(outfinal, p, i))
+}
+
+// writeAndroidDescriptor writes a partition.xml in the format of
+// Qualcomm's ptool, which Android bring-up flashers read.
+func writeAndroidDescriptor(buf *bytes.Buffer, outfinal string, parts []*Partition) {
+	type partition struct {
+		Label    string `xml:"label,attr"`
+		SizeInKb uint64 `xml:"size_in_kb,attr"`
+		Type     string `xml:"type,attr"`
+		Bootable bool   `xml:"bootable,attr"`
+		Readonly bool   `xml:"readonly,attr"`
+		Filename string `xml:"filename,attr"`
+	}
+	var doc struct {
+		XMLName            xml.Name `xml:"configuration"`
+		ParserInstructions struct {
+			Text string `xml:",innerxml"`
+		} `xml:"parser_instructions"`
+		Partitions []partition `xml:"physical_partition>partition"`
+	}
+	doc.ParserInstructions.Text = fmt.Sprintf(`
+    WRITE_PROTECT_BOUNDARY_IN_KB = 0
+    GROW_LAST_PARTITION_TO_FILL_DISK = false
+    ALIGN_PARTITIONS_TO_PERFORMANCE_BOUNDARY = true
+    PERFORMANCE_BOUNDARY_IN_KB = %d
+  `, *alignment*1024)
+	boot := BootPartition(parts)
+	for i, p := range parts {
+		doc.Partitions = append(doc.Partitions, partition{
+			PartitionName(p, i), p.Size * 1024, TableType(p), p == boot,
+			ReadOnlyFs(p.Fs), flashImage(outfinal, p, i)})
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		Exit(err)
+	}
+	buf.WriteString(xml.Header)
+	buf.Write(data)
+	buf.WriteString("\n")
+}
+
+// writeRockchipDescriptor writes a Rockchip parameter.txt, whose
+// mtdparts give each partition's size and start in sectors.
+func writeRockchipDescriptor(buf *bytes.Buffer, outfinal string, parts []*Partition) {
+	var mtdparts []string
+	for i, start := range PartitionStarts(parts) {
+		mtdparts = append(mtdparts, fmt.Sprintf("0x%08x@0x%08x(%s)",
+			parts[i].Size*sectorsPerMiB, start, PartitionName(parts[i], i)))
+	}
+	buf.WriteString("FIRMWARE_VER: 1.0\n")
+	buf.WriteString("MAGIC: 0x5041524B\n")
+	buf.WriteString("ATAG: 0x00200800\n")
+	buf.WriteString("CHECK_MASK: 0x80\n")
+	buf.WriteString("TYPE: GPT\n")
+	fmt.Fprintf(buf, "CMDLINE: mtdparts=rk29xxnand:%s\n", strings.Join(mtdparts, ","))
+}
+
+// writeGenimageDescriptor writes a genimage config that assembles the
+// same layout, from the exported filesystems if there are any.
+func writeGenimageDescriptor(buf *bytes.Buffer, outfinal string, parts []*Partition) {
+	boot := BootPartition(parts)
+	table := "mbr"
+	if *dps {
+		table = "gpt"
+	}
+	fmt.Fprintf(buf, "image %s {\n", filepath.Base(outfinal))
+	fmt.Fprintf(buf, "\thdimage {\n\t\tpartition-table-type = \"%s\"\n\t}\n", table)
+	fmt.Fprintf(buf, "\tsize = %dM\n", *diskSize)
+	for i, start := range PartitionStarts(parts) {
+		p := parts[i]
+		fmt.Fprintf(buf, "\n\tpartition %s {\n", PartitionName(p, i))
+		if image := flashImage(outfinal, p, i); image != "" {
+			fmt.Fprintf(buf, "\t\timage = \"%s\"\n", image)
+		}
+		fmt.Fprintf(buf, "\t\toffset = %d\n", start*512)
+		fmt.Fprintf(buf, "\t\tsize = %dM\n", p.Size)
+		if *dps {
+			fmt.Fprintf(buf, "\t\tpartition-type-uuid = \"%s\"\n", TableType(p))
+		} else {
+			fmt.Fprintf(buf, "\t\tpartition-type = 0x%s\n", TableType(p))
+		}
+		if p == boot {
+			buf.WriteString("\t\tbootable = true\n")
+		}
+		buf.WriteString("\t}\n")
+	}
+	buf.WriteString("}\n")
+}
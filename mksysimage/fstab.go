@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FilesystemUUID returns the UUID of the filesystem made on p.
+func FilesystemUUID(p *Partition) string {
+	if uuid := FsUUID(p); uuid != "" {
+		return uuid
+	}
+	cmd := exe.Priv("blkid", "-p", "-s", "UUID", "-o", "value", p.Device)
+	var uuid bytes.Buffer
+	cmd.Stdout = &uuid
+	if err := cmd.Run(); err != nil {
+		Exit(err)
+	}
+	return strings.TrimSpace(uuid.String())
+}
+
+// AppendFstab adds entries to the /etc/fstab of the image mounted at
+// mountpoint, creating it if the sources didn't.
+func AppendFstab(mountpoint string, entries ...string) {
+	fstab := filepath.Join(mountpoint, "etc/fstab")
+	data, err := ioutil.ReadFile(fstab)
+	if err != nil && !os.IsNotExist(err) {
+		Exit(err)
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	for _, entry := range entries {
+		data = append(data, entry+"\n"...)
+	}
+	if err = ImageMkdirAll(filepath.Dir(fstab), 0755); err != nil {
+		Exit(err)
+	}
+	if err = ImageWriteFile(fstab, data, 0644); err != nil {
+		Exit(err)
+	}
+}
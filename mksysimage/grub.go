@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+var grubInstall = flag.String("grub-install", "grub-install",
+	"The grub-install program, such as grub2-install on Fedora, to install GRUB with")
+
+// The PReP boot partition holding GRUB's core image, which Open Firmware
+// on POWER machines loads, and its size in MB.
+const (
+	prepType    = "41"
+	prepGptType = "9E1A2D38-C612-4316-AA26-8B49521E5A8B"
+	prepSize    = 8
+)
+
+// The BIOS boot partition GRUB's core image goes on with GPT, which
+// has no gap after the MBR to hold it, and its size in MB.
+const (
+	biosBootGptType = "21686148-6449-6E6F-744E-656564454649"
+	biosBootSize    = 1
+)
+
+// The platform GRUB is installed for on each -arch it boots.
+var grubTargets = map[string]string{
+	"amd64":   "i386-pc",
+	"386":     "i386-pc",
+	"ppc64le": "powerpc-ieee1275",
+}
+
+// Where distributions put GRUB's modules, with %s for the platform.
+var grubModuleDirs = []string{
+	"/usr/lib/grub/%s",
+	"/usr/lib/grub2/%s",
+	"/usr/share/grub2/%s",
+}
+
+// The GRUB modules reading each filesystem /boot can be on, which are
+// built into the core image along with the partition tables'.
+var grubFsModules = map[string]string{
+	"ext3":  "ext2",
+	"ext4":  "ext2",
+	"xfs":   "xfs",
+	"btrfs": "btrfs",
+	"f2fs":  "f2fs",
+	"vfat":  "fat",
+}
+
+// The filesystems GRUB can boot from, of those the image can have.
+var grubFs = map[string]bool{
+	"ext3":  true,
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+	"f2fs":  true,
+	"vfat":  true,
+}
+
+func init() {
+	// petitboot, on OPAL machines, reads GRUB's menu too, so one
+	// grub.cfg serves both kinds of POWER machine. On x86, -bootloader
+	// picks it over extlinux.
+	RegisterBootloader(&Bootloader{
+		Name:      "grub",
+		Fs:        grubFs,
+		Programs:  grubPrograms,
+		Check:     checkGrubModules,
+		Partition: GrubPartition,
+		Install:   installGrub,
+		Arches:    []string{"amd64", "386"},
+	}, "ppc64le")
+}
+
+// grubPrograms returns -grub-install and the GRUB programs it runs,
+// named alike, such as grub2-probe beside grub2-install.
+func grubPrograms() []string {
+	programs := []string{*grubInstall}
+	for _, tool := range []string{"mkimage", "probe"} {
+		programs = append(programs, strings.Replace(*grubInstall, "-install", "-"+tool, 1))
+	}
+	return programs
+}
+
+// checkGrubModules fails unless GRUB's modules for -arch's platform
+// are installed, which distributions package apart from grub-install.
+func checkGrubModules() {
+	target := grubTargets[*arch]
+	for _, dir := range grubModuleDirs {
+		if _, err := os.Stat(path.Join(fmt.Sprintf(dir, target), "modinfo.sh")); err == nil {
+			return
+		}
+	}
+	Exit(fmt.Sprintf("GRUB's %s modules aren't installed, such as in /usr/lib/grub/%s", target, target))
+}
+
+// GrubPartition returns the partition GRUB's core image is installed
+// to: the PReP boot partition on POWER, and with GPT, a BIOS boot
+// partition on x86. On an MBR it goes in the gap before the first
+// partition, and nil is returned.
+func GrubPartition() *Partition {
+	if *arch == "ppc64le" {
+		return PrepPartition()
+	}
+	if *dps {
+		return &Partition{Size: biosBootSize, Type: biosBootGptType}
+	}
+	return nil
+}
+
+// PrepPartition returns the PReP boot partition GRUB is installed to.
+func PrepPartition() *Partition {
+	p := &Partition{Size: prepSize, Type: prepType}
+	if *dps {
+		p.Type = prepGptType
+	}
+	return p
+}
+
+// GrubConfig renders a grub.cfg booting the first of entries, whose
+// files are in dir on the filesystem GRUB reads. With more than one
+// entry, or branding, the menu waits five seconds for a choice.
+func GrubConfig(dir string, entries []BootEntry) string {
+	var buf bytes.Buffer
+	timeout := 0
+	if len(entries) > 1 || Branded() {
+		timeout = 5
+	}
+	fmt.Fprintf(&buf, "set default=0\nset timeout=%d\n", timeout)
+	if SerialBoot() {
+		buf.WriteString("serial --speed=115200\nterminal_input serial console\nterminal_output serial console\n")
+	}
+	grubBranding(&buf, dir)
+	if *bootTries > 0 {
+		grubBootCounting(&buf, dir, entries)
+	}
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "\nmenuentry '%s' {\n", grubEntryTitle(e.Label))
+		fmt.Fprintf(&buf, "\tlinux %s %s\n", path.Join(dir, e.Kernel), e.Args)
+		if e.Initrd != "" {
+			fmt.Fprintf(&buf, "\tinitrd %s\n", path.Join(dir, e.Initrd))
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.String()
+}
+
+// grubDir returns where the kernels are on the filesystem holding
+// /boot, as GRUB sees it.
+func grubDir(parts []*Partition) string {
+	if BootPartition(parts).Mount == "/boot" {
+		return "/"
+	}
+	return "/boot"
+}
+
+// writeGrubFile writes a file of GRUB's, such as its menu, to the
+// grub directory in boot.
+func writeGrubFile(boot, name, data string) {
+	if err := ImageMkdirAll(path.Join(boot, "grub"), 0755); err != nil {
+		Exit(err)
+	}
+	if err := ImageWriteFile(path.Join(boot, "grub", name), []byte(data), 0644); err != nil {
+		Exit(err)
+	}
+}
+
+// installGrub writes GRUB's menu, and with -boot-tries its environment
+// block, to /boot/grub and installs GRUB's core image: to the PReP
+// partition on POWER, and on x86, with boot code in the MBR of the
+// image's disk.
+func installGrub(mountpoint string, parts []*Partition, entries []BootEntry) {
+	boot := path.Join(mountpoint, "boot")
+	writeGrubFile(boot, "grub.cfg", GrubConfig(grubDir(parts), entries))
+	installGrubSplash(boot)
+	installBootCounting(mountpoint, boot)
+	target := grubTargets[*arch]
+	args := []string{"--target=" + target, "--boot-directory=" + boot}
+	device := imageDevice
+	if *arch == "ppc64le" {
+		for _, p := range parts {
+			if p.Type == PrepPartition().Type {
+				device = p.Device
+			}
+		}
+		// --no-nvram, since the host's firmware variables are
+		// none of the image's business.
+		args = append(args, "--no-nvram", "--force")
+	} else {
+		// GRUB would probe the host for what to build into the
+		// core image, which has to read the image's /boot.
+		args = append(args, "--modules=part_msdos part_gpt "+grubFsModules[BootPartition(parts).Fs])
+	}
+	err := exe.Priv(*grubInstall, append(args, device)...).Run()
+	Audit("bootloader-install", device, *grubInstall+" "+target, err)
+	if err != nil {
+		Exit(err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var bootTries = flag.Uint("boot-tries", 0,
+	"With GRUB, fall back to the previous kernel, or to slot B with -ab, after this many boots in a row that don't reach boot-complete.target")
+
+// The size of GRUB's environment block, which save_env rewrites in
+// place, and the line it starts with.
+const (
+	grubEnvSize   = 1024
+	grubEnvHeader = "# GRUB Environment Block\n"
+)
+
+// The unit marking a boot successful, so GRUB's count starts over.
+const bootSuccessUnit = "grub-boot-success.service"
+
+const bootSuccessService = `[Unit]
+Description=Mark this boot successful for GRUB
+Requires=boot-complete.target
+After=boot-complete.target
+
+[Service]
+Type=oneshot
+ExecStart=%s %s set boot_success=1
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// Where the image's grub-editenv may be, by the names distributions
+// give it.
+var grubEditenvPaths = []string{
+	"usr/bin/grub-editenv",
+	"usr/bin/grub2-editenv",
+	"bin/grub-editenv",
+	"bin/grub2-editenv",
+}
+
+// CheckBootTries fails unless GRUB can keep count of the boots in
+// parts, which save_env only manages on the filesystems it can write
+// blocks of in place.
+func CheckBootTries(parts []*Partition) {
+	if *bootTries == 0 {
+		return
+	}
+	if *noPartition || ArchBootloader().Name != "grub" {
+		Exit("-boot-tries needs GRUB, as -bootloader grub picks on x86")
+	}
+	switch fs := BootPartition(parts).Fs; fs {
+	case "ext3", "ext4", "vfat":
+	default:
+		Exit(fmt.Sprintf("GRUB can't write its environment block on %s, so -boot-tries needs /boot on ext4 or vfat", fs))
+	}
+}
+
+// bootFallback returns the index of the entry GRUB falls back to: the
+// first booting another kernel than the default, or else slot B's.
+func bootFallback(entries []BootEntry) int {
+	for i, e := range entries {
+		if e.Kernel != entries[0].Kernel || (*abRoot && strings.HasSuffix(e.Label, "-b")) {
+			return i
+		}
+	}
+	Exit("-boot-tries needs a second kernel to fall back to, such as with -all-kernels, or -ab's slot B")
+	return 0
+}
+
+// grubBootCounting writes the lines of a grub.cfg counting the boots
+// since the last successful one in the environment block in dir, and
+// booting the fallback entry once there have been -boot-tries of them.
+// GRUB has no arithmetic, so each count is spelled out. A successful
+// boot of the fallback starts the count over with the default.
+func grubBootCounting(buf *bytes.Buffer, dir string, entries []BootEntry) {
+	env := path.Join(dir, "grub", "grubenv")
+	fmt.Fprintf(buf, "load_env --file %s\n", env)
+	buf.WriteString("if [ \"${boot_success}\" = \"1\" -o -z \"${boot_tries}\" ]; then\n\tset boot_tries=0\nfi\n")
+	for i := uint(0); i < *bootTries; i++ {
+		keyword := "elif"
+		if i == 0 {
+			keyword = "if"
+		}
+		fmt.Fprintf(buf, "%s [ \"${boot_tries}\" = \"%d\" ]; then\n\tset boot_tries=%d\n", keyword, i, i+1)
+	}
+	fmt.Fprintf(buf, "else\n\tset default=%d\nfi\n", bootFallback(entries))
+	buf.WriteString("set boot_success=0\n")
+	fmt.Fprintf(buf, "save_env --file %s boot_tries boot_success\n", env)
+}
+
+// installBootCounting writes GRUB's environment block to the grub
+// directory in boot, and installs and enables the unit marking boots
+// of the image mounted at mountpoint successful.
+func installBootCounting(mountpoint, boot string) {
+	if *bootTries == 0 {
+		return
+	}
+	env := grubEnvHeader + "boot_tries=0\nboot_success=0\n"
+	writeGrubFile(boot, "grubenv", env+strings.Repeat("#", grubEnvSize-len(env)))
+
+	editenv := "/" + grubEditenvPaths[0]
+	found := false
+	for _, p := range grubEditenvPaths {
+		if _, ok := resolveInImage(mountpoint, p); ok {
+			editenv, found = "/"+p, true
+			break
+		}
+	}
+	if !found {
+		Log("Warning: the image has no grub-editenv to mark boots successful with, so every boot counts against -boot-tries")
+	}
+	unit := path.Join(mountpoint, "etc/systemd/system", bootSuccessUnit)
+	service := fmt.Sprintf(bootSuccessService, editenv, "/boot/grub/grubenv")
+	if err := ImageMkdirAll(path.Dir(unit), 0755); err != nil {
+		Exit(err)
+	}
+	if err := ImageWriteFile(unit, []byte(service), 0644); err != nil {
+		Exit(err)
+	}
+	link := path.Join(mountpoint, "etc/systemd/system/multi-user.target.wants", bootSuccessUnit)
+	if err := ImageMkdirAll(path.Dir(link), 0755); err != nil {
+		Exit(err)
+	}
+	ImageRemove(link)
+	if err := ImageSymlink("/etc/systemd/system/"+bootSuccessUnit, link); err != nil {
+		Exit(err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+var hybridMbr = flag.Bool("hybrid-mbr", false,
+	"With -dps, mirror the /boot partition, the ESP and the first others in the MBR, up to three, for firmware that only reads an MBR")
+
+// The MBR types of the GPT types that have one, for partitions mirrored
+// in a hybrid MBR.
+var hybridTypes = map[string]string{
+	prepGptType:           prepType,
+	lvmGptType:            lvmType,
+	raidGptType:           raidType,
+	metadataPartitionType: "da",
+	basicDataType:         "07",
+}
+
+// CheckHybridMbr checks -hybrid-mbr.
+func CheckHybridMbr() {
+	if *hybridMbr && !*dps {
+		Exit("-hybrid-mbr needs a -dps layout")
+	}
+}
+
+// hybridType returns the MBR type of p, one of the partitions of a
+// -dps layout.
+func hybridType(p *Partition) string {
+	switch {
+	case p.Mount == espMount:
+		return "ef"
+	case p.Fs == "vfat":
+		return fatType(&Partition{Size: p.Size})
+	case p.Fs == "swap":
+		return "82"
+	}
+	if t, ok := hybridTypes[p.Type]; ok {
+		return t
+	}
+	return "83"
+}
+
+// WriteHybridMbr replaces the protective MBR of image, partitioned as
+// parts, with a hybrid one. The /boot partition, marked bootable, and
+// the ESP are picked first, then the others in the order of the table.
+// They follow an entry of type ee covering the GPT itself, which tells
+// GPT-aware systems to read the GPT instead.
+func WriteHybridMbr(image string, parts []*Partition) {
+	table := TablePartitions(parts)
+	starts := PartitionStarts(table)
+	boot := BootPartition(parts)
+	var picked []int
+	seen := map[int]bool{}
+	pick := func(match func(p *Partition) bool) {
+		for i, p := range table {
+			if len(picked) < 3 && match(p) && !seen[i] {
+				picked = append(picked, i)
+				seen[i] = true
+			}
+		}
+	}
+	pick(func(p *Partition) bool { return p == boot })
+	pick(func(p *Partition) bool { return p.Mount == espMount })
+	pick(func(p *Partition) bool { return true })
+	sort.Ints(picked)
+
+	entries := make([]byte, 64)
+	entry := func(n int, active bool, kind byte, start, sectors uint64) {
+		if start+sectors > 1<<32 {
+			Exit("Hybrid MBR partitions must end within the first 2 TiB")
+		}
+		e := entries[n*16 : n*16+16]
+		if active {
+			e[0] = 0x80
+		}
+		// Past what CHS can address, so firmware goes by the LBA
+		// fields.
+		copy(e[1:4], []byte{0xfe, 0xff, 0xff})
+		e[4] = kind
+		copy(e[5:8], []byte{0xfe, 0xff, 0xff})
+		binary.LittleEndian.PutUint32(e[8:12], uint32(start))
+		binary.LittleEndian.PutUint32(e[12:16], uint32(sectors))
+	}
+	entry(0, false, 0xee, 1, starts[picked[0]]-1)
+	for n, i := range picked {
+		kind, _ := strconv.ParseUint(hybridType(table[i]), 16, 8)
+		entry(n+1, table[i] == boot, byte(kind), starts[i], table[i].Size*sectorsPerMiB)
+	}
+
+	Log("Writing hybrid MBR")
+	f, err := os.OpenFile(image, os.O_WRONLY, 0)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt(entries, 446)
+	Audit("raw-write", image, fmt.Sprintf("hybrid MBR at offset 446, %d bytes", len(entries)), err)
+	if err != nil {
+		Exit(err)
+	}
+}
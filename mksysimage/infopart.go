@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+var infoSize = flag.Uint64("info-size", 0,
+	"Size in MB of a FAT partition with build info that Windows can read, 0 for none")
+
+var releaseNotes = flag.String("release-notes", "",
+	"Text file copied to the -info-size partition as RELEASE-NOTES.TXT")
+
+const infoLabel = "IMAGE INFO"
+
+// InfoPartition returns the partition -info-size adds to the layout.
+// FAT types are what Windows looks for: FAT16 or FAT32 with LBA on an
+// MBR, and Microsoft basic data on GPT.
+func InfoPartition() *Partition {
+	p := &Partition{Size: *infoSize, Fs: "vfat", Label: infoLabel}
+	p.Type = fatType(p)
+	return p
+}
+
+// BuildInfo describes the image for people, with Windows line endings.
+func BuildInfo(outfinal string, formats []string, kernels []BootKernel, sources []Source) string {
+	var buf bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, format+"\r\n", args...)
+	}
+	line("Image:        %s", path.Base(outfinal))
+	if *imageVersion != "" {
+		line("Version:      %s", *imageVersion)
+	}
+	line("Built:        %s", BuildTime().Format(time.RFC1123))
+	line("Architecture: %s", *arch)
+	line("Formats:      %s", strings.Join(formats, ", "))
+	for _, k := range kernels {
+		line("Kernel:       %s", k.Kernel)
+	}
+	line("Kernel args:  %s", *kernelArgs)
+	line("Image ID:     %s", ImageID())
+	for _, id := range Lineage() {
+		line("Derived from: %s", id)
+	}
+	if verityRootHash != "" {
+		line("Root hash:    %s", verityRootHash)
+	}
+	line("")
+	line("Sources:")
+	for _, s := range sources {
+		line("  %s", s)
+	}
+	return buf.String()
+}
+
+// WriteInfoPartition mounts the info partition among parts and writes
+// the build info and release notes to it.
+func WriteInfoPartition(parts []*Partition, info string) {
+	var p *Partition
+	for _, part := range parts {
+		if part.Label == infoLabel {
+			p = part
+		}
+	}
+	target := TempDir("info")
+	err := exe.Priv("mount", "-t", p.Fs, "-o", FatMountOptions(), p.Device, target).Run()
+	Audit("mount", target, p.Device, err)
+	if err != nil {
+		Exit(err)
+	}
+	Track(&runState.Mounts, target)
+	defer func() {
+		err := exe.Priv("umount", target).Run()
+		Audit("umount", target, p.Device, err)
+		if err == nil {
+			Untrack(&runState.Mounts, target)
+		}
+	}()
+
+	if err = ImageWriteFile(path.Join(target, "INFO.TXT"), []byte(info), 0644); err != nil {
+		Exit(err)
+	}
+	if *releaseNotes != "" {
+		notes, err := ioutil.ReadFile(*releaseNotes)
+		if err != nil {
+			Exit(err)
+		}
+		// Notepad only learned Unix line endings in 2018.
+		notes = bytes.Replace(bytes.Replace(notes, []byte("\r\n"), []byte("\n"), -1),
+			[]byte("\n"), []byte("\r\n"), -1)
+		if err = ImageWriteFile(path.Join(target, "RELEASE-NOTES.TXT"), notes, 0644); err != nil {
+			Exit(err)
+		}
+	}
+}
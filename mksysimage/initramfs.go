@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// BuildInitramfs assembles sources and the manifest directives into a
+// newc cpio archive at out, instead of a disk image, gzipped unless
+// -compress-output compresses it. The kernel runs /init from the
+// archive, so if the sources only provide /sbin/init, /init is made a
+// link to it.
+func BuildInitramfs(out string, plan *BuildPlan, manifest *Manifest) {
+	CheckPrograms(plan.Requirements())
+	Audit("build", out, "started", nil)
+
+	staging := TempDir("initramfs")
+	var err error
+
+	for _, source := range plan.Sources {
+		Log(fmt.Sprintf("Populating %s", source))
+		source.Populate(staging)
+	}
+	buildVars.KernelArgs = *kernelArgs
+	buildVars.Format = "initramfs"
+	buildVars.Arch = *arch
+	for _, d := range manifest.Directives {
+		Log(fmt.Sprintf("Applying %s %s", d.Name, d.Args[0]))
+		d.Apply(staging)
+	}
+	for _, d := range manifest.Fixups {
+		Log(fmt.Sprintf("Fixing up %s", d.Args[0]))
+		d.Apply(staging)
+	}
+
+	if _, err = os.Lstat(path.Join(staging, "init")); os.IsNotExist(err) {
+		if _, err = os.Stat(path.Join(staging, "sbin/init")); err != nil {
+			Exit("The sources provide neither /init nor /sbin/init")
+		}
+		Log("Linking /init to /sbin/init")
+		if err = ImageSymlink("sbin/init", path.Join(staging, "init")); err != nil {
+			Exit(err)
+		}
+	} else if err != nil {
+		Exit(err)
+	}
+
+	// List the files in a fixed order, so the same sources make the
+	// same archive.
+	cmd := exe.Priv("find", ".", "-mindepth", "1")
+	cmd.Dir = staging
+	var list bytes.Buffer
+	cmd.Stdout = &list
+	if err = cmd.Run(); err != nil {
+		Exit(err)
+	}
+	files := strings.Split(strings.TrimSuffix(list.String(), "\n"), "\n")
+	sort.Strings(files)
+
+	Log("Writing initramfs archive")
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		Exit(err)
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	// -compress-output compresses the archive itself, with any
+	// compression the kernel unpacks, rather than gzip twice.
+	var z *gzip.Writer
+	var w io.Writer = f
+	if *compressOutput == "" {
+		z = gzip.NewWriter(f)
+		w = z
+	}
+	cmd = exe.HeavyPriv("cpio", "--quiet", "-o", "-H", "newc", "--reproducible")
+	cmd.Dir = staging
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	cmd.Stdout = w
+	if err = cmd.Run(); err != nil {
+		Exit(err)
+	}
+	if z != nil {
+		if err = z.Close(); err != nil {
+			Exit(err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		Exit(err)
+	}
+	if err = os.Rename(tmp, out); err != nil {
+		Exit(err)
+	}
+	FinishOutput(out, out, "initramfs")
+	Audit("build", out, "populated", nil)
+	Log("Build complete, cleaning up")
+}
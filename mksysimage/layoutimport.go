@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var importLayout = flag.String("import-layout", "",
+	"Take the partition layout from the part lines of a Yocto .wks or kickstart file")
+
+// Options of wks and kickstart part lines that take no value.
+var partSwitches = map[string]bool{
+	"active":      true,
+	"asprimary":   true,
+	"encrypted":   true,
+	"grow":        true,
+	"hidden":      true,
+	"no-table":    true,
+	"noformat":    true,
+	"recommended": true,
+	"use-label":   true,
+	"use-uuid":    true,
+}
+
+// ImportLayout adds the partitions described by a .wks or kickstart
+// file to the layout. The root partition always takes the space left
+// over, so its size is ignored. A bootloader --append line supplies
+// the kernel args unless -kernel-args was given.
+func ImportLayout(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pos := fmt.Sprintf("%s:%d", file, line)
+		fields := splitQuoted(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "part", "partition":
+			if len(fields) < 2 {
+				Exit(fmt.Sprintf("%s: part without a mount point", pos))
+			}
+			importPart(pos, fields[1], partOptions(fields[2:]))
+		case "bootloader":
+			opts := partOptions(fields[1:])
+			if args, ok := opts["append"]; ok && !FlagSet("kernel-args") {
+				*kernelArgs = args
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		Exit(err)
+	}
+}
+
+func importPart(pos, mount string, opts map[string]string) {
+	fstype, ok := opts["fstype"]
+	if fstype == "efi" {
+		fstype = "vfat"
+	}
+	if ok && !supportedFs[fstype] && (!dataFs[fstype] || mount == "/") {
+		Exit(fmt.Sprintf("%s: %s filesystems aren't supported", pos, fstype))
+	}
+	if mount == "/" {
+		if ok && fstype != *fsType {
+			Log(fmt.Sprintf("Warning: %s: using %s rather than %s for %s", pos, *fsType, fstype, mount))
+		}
+		return
+	}
+	if !filepath.IsAbs(mount) {
+		Exit(fmt.Sprintf("%s: %s partitions aren't supported", pos, mount))
+	}
+	if _, ok := opts["grow"]; ok {
+		Log(fmt.Sprintf("Warning: %s: only the root partition grows, %s is fixed size", pos, mount))
+	}
+	size, ok := opts["size"]
+	if !ok {
+		size, ok = opts["fixed-size"]
+	}
+	if !ok || size == "" {
+		Exit(fmt.Sprintf("%s: no size given for %s", pos, mount))
+	}
+	mb, err := parseMegabytes(size)
+	if err != nil {
+		Exit(fmt.Sprintf("%s: %s", pos, err))
+	}
+	spec := fmt.Sprintf("%s:%d", mount, mb)
+	if fstype != "" {
+		spec += ":" + fstype
+	}
+	if err = extraPartitions.Set(spec); err != nil {
+		Exit(fmt.Sprintf("%s: %s", pos, err))
+	}
+}
+
+// partOptions turns "--name=value", "--name value" and "--switch"
+// arguments into a map.
+func partOptions(args []string) map[string]string {
+	opts := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if j := strings.Index(name, "="); j >= 0 {
+			opts[name[:j]] = name[j+1:]
+		} else if partSwitches[name] || i+1 == len(args) {
+			opts[name] = ""
+		} else {
+			opts[name] = args[i+1]
+			i++
+		}
+	}
+	return opts
+}
+
+// parseMegabytes reads a size in MB, which may carry a K, M or G suffix.
+func parseMegabytes(size string) (uint64, error) {
+	num, mult, div := size, uint64(1), uint64(1)
+	switch strings.ToUpper(size[len(size)-1:]) {
+	case "K":
+		num, div = size[:len(size)-1], 1024
+	case "M":
+		num = size[:len(size)-1]
+	case "G":
+		num, mult = size[:len(size)-1], 1024
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Bad size %s", size))
+	}
+	return (n*mult + div - 1) / div, nil
+}
+
+// splitQuoted splits a line into whitespace separated fields, keeping
+// double quoted strings together and dropping the quotes.
+func splitQuoted(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMegabytes(t *testing.T) {
+	for _, c := range []struct {
+		size string
+		want uint64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"512M", 512, true},
+		{"2G", 2048, true},
+		{"2g", 2048, true},
+		{"1024K", 1, true},
+		// Kilobytes round up to whole megabytes.
+		{"1025K", 2, true},
+		{"1K", 1, true},
+		{"M", 0, false},
+		{"12T", 0, false},
+		{"-1", 0, false},
+	} {
+		got, err := parseMegabytes(c.size)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("parseMegabytes(%q) = %d, %v, want %d, ok %v", c.size, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestPartOptions(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		want map[string]string
+	}{
+		{[]string{"--size=512", "--fstype", "ext4"}, map[string]string{"size": "512", "fstype": "ext4"}},
+		// Switches take no value, so don't swallow the next argument.
+		{[]string{"--grow", "--size", "1", "--asprimary"}, map[string]string{"grow": "", "size": "1", "asprimary": ""}},
+		{[]string{"--label"}, map[string]string{"label": ""}},
+		{[]string{"--label=a=b"}, map[string]string{"label": "a=b"}},
+		{nil, map[string]string{}},
+	} {
+		if got := partOptions(c.args); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("partOptions(%q) = %v, want %v", c.args, got, c.want)
+		}
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want []string
+	}{
+		{"part / --size 512", []string{"part", "/", "--size", "512"}},
+		{"  part\t/home  ", []string{"part", "/home"}},
+		{`part / --label "my root"`, []string{"part", "/", "--label", "my root"}},
+		{`--label=" a b "x`, []string{"--label= a b x"}},
+		{`part ""`, []string{"part", ""}},
+		{"", nil},
+	} {
+		if got := splitQuoted(c.line); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitQuoted(%q) = %q, want %q", c.line, got, c.want)
+		}
+	}
+}
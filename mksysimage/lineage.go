@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var imageID = flag.String("image-id", "",
+	"ID recorded in the build metadata, for images derived from this one to name it by, rather than a random UUID")
+
+var parentImage = flag.String("parent-image", "",
+	"The image this one derives from, as a raw image with a metadata partition or an image ID, recorded in the build metadata")
+
+func init() {
+	subcommands["lineage"] = LineageCommand
+}
+
+// The ID of the image being built, and those of its ancestors, once
+// worked out.
+var (
+	thisImageID string
+	lineage     []string
+	lineageRead bool
+)
+
+// ImageID returns the ID of the image being built: -image-id, or a UUID
+// made up for it.
+func ImageID() string {
+	if thisImageID == "" {
+		if strings.ContainsAny(*imageID, " \t\r\n") {
+			Exit(fmt.Sprintf("Bad -image-id %q", *imageID))
+		}
+		thisImageID = *imageID
+		if thisImageID == "" {
+			thisImageID = randomUUID()
+		}
+	}
+	return thisImageID
+}
+
+// Lineage returns the IDs of the images the one being built derives
+// from, parent first. A -parent-image file contributes its own lineage,
+// read from its metadata partition, so the chain is complete without
+// the ancestors at hand.
+func Lineage() []string {
+	if lineageRead || *parentImage == "" {
+		return lineage
+	}
+	lineageRead = true
+	if _, err := os.Stat(*parentImage); err != nil {
+		lineage = []string{*parentImage}
+		return lineage
+	}
+	meta, err := ReadBuildMetadata(*parentImage)
+	if err != nil {
+		Exit(fmt.Sprintf("-parent-image %s: %s", *parentImage, err))
+	}
+	if meta.ImageID == "" {
+		Exit(fmt.Sprintf("-parent-image %s has no image ID in its metadata", *parentImage))
+	}
+	lineage = append([]string{meta.ImageID}, meta.Lineage...)
+	return lineage
+}
+
+// ReadBuildMetadata returns the build metadata in the metadata partition
+// of the raw image, having checked it's properly signed.
+func ReadBuildMetadata(raw string) (*BuildMetadata, error) {
+	problems, ok := checkMetadataSignature(raw)
+	if !ok {
+		return nil, errors.New("no metadata partition")
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, ", "))
+	}
+	data, _ := ReadMetadataPartition(raw)
+	var doc SignedMetadata
+	var meta BuildMetadata
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(doc.Metadata, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// LineageCommand prints the ID of a raw image, as its metadata partition
+// records it, then those of the images it derives from, parent first.
+func LineageCommand(args []string) {
+	if len(args) != 1 {
+		Exit("Usage: lineage image")
+	}
+	meta, err := ReadBuildMetadata(args[0])
+	if err != nil {
+		Exit(fmt.Sprintf("%s: %s", args[0], err))
+	}
+	if meta.ImageID == "" {
+		Exit(fmt.Sprintf("%s was built without an image ID", args[0]))
+	}
+	version := ""
+	if meta.Version != "" {
+		version = ", version " + meta.Version
+	}
+	fmt.Printf("%s (built %s%s)\n", meta.ImageID, meta.Created, version)
+	for _, id := range meta.Lineage {
+		fmt.Printf("%s\n", id)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var lvmGroup = flag.String("lvm", "",
+	"Name of an LVM volume group to hold the root filesystem and any -lv volumes, on a partition taking the space the others leave")
+
+var bootSize = flag.Uint64("boot-size", 512,
+	"Size in MB of the /boot partition -lvm, -verity and -ab layouts get, unless a -partition gives one")
+
+var logicalVolumes partitionList
+
+func init() {
+	flag.Var(&logicalVolumes, "lv",
+		"Additional logical volume in the -lvm volume group given as MOUNT:SIZE[:FS] (size in MB), may be repeated")
+	RegisterPrivilegedCapability("-lvm", func(plan *BuildPlan) []string {
+		if *lvmGroup == "" || plan.Parts == nil {
+			return nil
+		}
+		return []string{"pvcreate", "vgcreate", "lvcreate", "vgchange", "vgs", "blkid"}
+	})
+}
+
+// The partition types of an LVM physical volume.
+const (
+	lvmType    = "8e"
+	lvmGptType = "E6D6D379-F507-44C2-A23C-238F2A3DF928"
+)
+
+// LVM allocates volumes in extents of this many MB, after a MB of
+// metadata at the start of the physical volume.
+const lvmExtent = 4
+
+// The names LVM allows for volume groups.
+var vgNamePattern = regexp.MustCompile(`^[A-Za-z0-9+_.][A-Za-z0-9+_.-]*$`)
+
+// CheckLvm checks the -lvm flags, and points the kernel at the root
+// volume unless -kernel-args says otherwise.
+func CheckLvm() {
+	if *lvmGroup == "" {
+		if len(logicalVolumes) > 0 {
+			Exit("-lv needs -lvm")
+		}
+		return
+	}
+	if !vgNamePattern.MatchString(*lvmGroup) {
+		Exit(fmt.Sprintf("Bad -lvm volume group name %s", *lvmGroup))
+	}
+	if *noPartition {
+		Exit("-lvm needs a partition table")
+	}
+	if *repart {
+		Exit("systemd-repart can't adopt -lvm volumes, so -repart can't be used with them")
+	}
+	if *rootType != "" {
+		Exit("-root-type can't be used with -lvm, whose root is a logical volume")
+	}
+	if !FlagSet("kernel-args") {
+		*kernelArgs = fmt.Sprintf("root=%s ro", VolumeDevice("root"))
+	}
+}
+
+// VolumeDevice returns the device of the logical volume named lv in
+// the -lvm volume group.
+func VolumeDevice(lv string) string {
+	escape := func(name string) string { return strings.Replace(name, "-", "--", -1) }
+	return fmt.Sprintf("/dev/mapper/%s-%s", escape(*lvmGroup), escape(lv))
+}
+
+// SeparateBootPartition returns the /boot partition an -lvm or -raid
+// layout needs, since no bootloader here reads LVM or mdadm arrays,
+// and a -verity one does, since the boot menu can't be in the root it
+// verifies. -ab layouts get one so that the menu is the same whichever
+// slot boots. It returns nil if -partition gives one.
+func SeparateBootPartition() *Partition {
+	for _, p := range extraPartitions {
+		if p.Mount == "/boot" {
+			return nil
+		}
+	}
+	fs := *fsType
+	if !ArchBootloader().Fs[fs] {
+		fs = "ext4"
+	}
+	return &Partition{Mount: "/boot", Size: *bootSize, Fs: fs, Tune: fs == *fsType}
+}
+
+// LvmLayout moves root into the -lvm volume group along with the -lv
+// volumes, on a physical volume taking root's place in the partition
+// table. It returns every partition and volume, root first.
+func LvmLayout(root *Partition, extras []*Partition) []*Partition {
+	pv := &Partition{Size: root.Size, Type: lvmType}
+	if *dps {
+		pv.Type = lvmGptType
+	}
+	seen := map[string]bool{"/": true}
+	for _, p := range extras {
+		seen[p.Mount] = true
+	}
+	names := map[string]string{"root": "/"}
+	var used uint64
+	for i, v := range logicalVolumes {
+		if seen[v.Mount] {
+			Exit(fmt.Sprintf("Duplicate partition for %s", v.Mount))
+		}
+		if v.Type != "" {
+			Exit(fmt.Sprintf("The logical volume for %s can't have a partition type", v.Mount))
+		}
+		seen[v.Mount] = true
+		if v.Fs == "" {
+			v.Fs = WritableFs()
+		}
+		v.Tune = v.Fs == *fsType
+		v.Volume = PartitionName(v, i)
+		if other, ok := names[v.Volume]; ok {
+			Exit(fmt.Sprintf("The logical volumes for %s and %s would both be named %s", other, v.Mount, v.Volume))
+		}
+		names[v.Volume] = v.Mount
+		used += (v.Size + lvmExtent - 1) / lvmExtent * lvmExtent
+	}
+	usable := (pv.Size - 1) / lvmExtent * lvmExtent
+	if used >= usable {
+		Exit("Logical volumes don't fit in the LVM partition")
+	}
+	root.Size, root.Volume = usable-used, "root"
+	parts := append([]*Partition{root, pv}, extras...)
+	return append(parts, logicalVolumes...)
+}
+
+// VolumeStart returns the sector of the image the logical volume p
+// starts at. The physical volume's data starts a MB in, and each volume
+// is allocated contiguously after those made before it, in the order
+// of parts, as CreateVolumes makes them.
+func VolumeStart(parts []*Partition, p *Partition) uint64 {
+	table := TablePartitions(parts)
+	starts := PartitionStarts(table)
+	var start uint64
+	for i, t := range table {
+		if t.Type == lvmType || t.Type == lvmGptType {
+			start = starts[i] + sectorsPerMiB
+		}
+	}
+	for _, v := range parts {
+		if v == p {
+			break
+		}
+		if v.Volume != "" {
+			start += (v.Size + lvmExtent - 1) / lvmExtent * lvmExtent * sectorsPerMiB
+		}
+	}
+	return start
+}
+
+// TablePartitions returns those of parts that are in the partition
+// table, rather than logical volumes, in the order of the table.
+func TablePartitions(parts []*Partition) []*Partition {
+	var table []*Partition
+	for _, p := range parts {
+		if p.Volume == "" {
+			table = append(table, p)
+		}
+	}
+	return table
+}
+
+// CreateVolumes makes the physical volume, volume group and logical
+// volumes of parts, which have their devices once the image is
+// attached, and activates them. The returned function deactivates them.
+func CreateVolumes(parts []*Partition) func() {
+	var pv *Partition
+	for _, p := range parts {
+		if p.Type == lvmType || p.Type == lvmGptType {
+			pv = p
+		}
+	}
+	// Creating a group the host already has would make both
+	// unusable until one is renamed.
+	if exe.Priv("vgs", *lvmGroup).Run() == nil {
+		Exit(fmt.Sprintf("This host already has a volume group %s", *lvmGroup))
+	}
+	Log(fmt.Sprintf("Creating volume group %s", *lvmGroup))
+	for _, args := range [][]string{
+		{"pvcreate", "--yes", "--dataalignment", "1m", pv.Device},
+		{"vgcreate", "--yes", *lvmGroup, pv.Device},
+	} {
+		err := exe.Priv(args[0], args[1:]...).Run()
+		Audit(args[0], *lvmGroup, pv.Device, err)
+		if err != nil {
+			Exit(err)
+		}
+	}
+	Track(&runState.Groups, *lvmGroup)
+	deactivate := func() {
+		Log(fmt.Sprintf("Deactivating volume group %s", *lvmGroup))
+		err := exe.Priv("vgchange", "-an", *lvmGroup).Run()
+		Audit("vgchange", *lvmGroup, "deactivate", err)
+		if err == nil {
+			Untrack(&runState.Groups, *lvmGroup)
+		}
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			deactivate()
+			panic(err)
+		}
+	}()
+	for _, p := range parts {
+		if p.Volume == "" {
+			continue
+		}
+		Log(fmt.Sprintf("Creating logical volume %s for %s", p.Volume, p.Mount))
+		err := exe.Priv("lvcreate", "--yes", "--wipesignatures", "y", "--alloc", "contiguous",
+			"-L", fmt.Sprintf("%dm", p.Size), "-n", p.Volume, *lvmGroup).Run()
+		Audit("lvcreate", p.Volume, *lvmGroup, err)
+		if err != nil {
+			Exit(err)
+		}
+		p.Device = VolumeDevice(p.Volume)
+	}
+	return deactivate
+}
+
+// WriteLvmFstab adds the filesystems of an -lvm layout besides the
+// root to the fstab of the image mounted at mountpoint, since nothing
+// else would find them.
+func WriteLvmFstab(parts []*Partition, mountpoint string) {
+	if *lvmGroup == "" {
+		return
+	}
+	var entries []string
+	for _, p := range MountOrder(parts) {
+		if p.Mount == "/" || ReadOnlyFs(p.Fs) {
+			continue
+		}
+		device := "UUID=" + FilesystemUUID(p)
+		if p.Volume != "" {
+			device = VolumeDevice(p.Volume)
+		}
+		entries = append(entries, fmt.Sprintf("%s %s %s defaults 0 2", device, p.Mount, MountFs(p.Fs)))
+	}
+	AppendFstab(mountpoint, entries...)
+}
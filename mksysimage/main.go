@@ -2,15 +2,16 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 var kernelArgs = flag.String("kernel-args", "root=/dev/sda1 ro",
@@ -29,18 +30,333 @@ var printFs = flag.Bool("print-fs", false,
 	"Print the FS image tree to stdout on completion")
 
 var format = flag.String("format", "raw",
-	"Format of the disk image (raw, vdi, vmdk, vhd)")
+	"Format of the disk image (raw, vdi, vmdk, vhd, qcow2, nspawn, initramfs), or a comma separated list of several")
+
+var keepRaw = flag.Bool("keep-raw", false,
+	"Also keep the raw image when converting to other formats")
 
 var vboxUuid = flag.String("vbox-uuid", "",
 	"If outputting to VDI, the UUID of the disk")
 
 var Usage = func() {
-	fmt.Fprintf(os.Stderr, `Usage: %s outfile kernel root:source...
+	fmt.Fprintf(os.Stderr, `Usage: %[1]s outfile kernel [root:]source...
+       %[1]s -no-partition outfile [root:]source...
+       %[1]s -format initramfs outfile [root:]source...
+       %[1]s -benchmark [-benchmark-size MB] outfile kernel
+       %[1]s audit image -policy file
+       %[1]s verify image -against-report file
+       %[1]s lineage image
+       %[1]s rebless image [-kernel-args args] [-manifest file]
+       %[1]s bundle create file -manifest file
+       %[1]s recover
 
 Multiple sources can be provided. If a source is a tarball, it is
 extracted to the root of the filesystem. If it's a directory, it is
 copied verbatim to the root of the filesystem. Each source is
-overlayed in the FS image at its corresponding root.
+overlayed in the FS image at its corresponding root. The kind of
+source can be given explicitly as root:dir:path or root:tar:path.
+Tarballs can also be fetched from http:// or https:// URLs, pinned
+by appending #sha256=digest. All sources are fetched in parallel
+before the image is built. Tarballs are extracted chrooted into the
+image, in a private mount namespace, so nothing in them can reach
+the build host.
+
+With -output-template, outfile is a directory, and each output is
+named in it after the template, which can use {{.Name}}, {{.Version}},
+{{.Date}}, {{.Arch}} and {{.Format}}. -keep-outputs then removes all
+but the newest outputs differing only in date and version.
+
+-benchmark builds outfile as usual, flags and all, but from a
+synthetic source of -benchmark-size MB, then prints the throughput of
+disk creation, mkfs, population and each format's conversion and
+output, and removes the outputs. Run it with outfile on the storage,
+and with the formats and compression, to be compared.
+
+-quick builds a scratch raw image to outfile for presubmit smoke
+tests, catching manifest, layout and boot menu regressions in well
+under a minute. Remote sources are skipped, and with them, if no
+local source has one, the "auto" kernel, for which an empty
+/boot/vmlinuz-0-quick stands in. There's no conversion, output
+pipeline, update metadata, report, export or size report, and the
+kernel architecture and size budget checks are skipped. It warns if
+the build takes over a minute.
+
+-compress-output, -encrypt-output and -upload-url apply to each output
+in one pass once it's converted: it's compressed, then encrypted, then
+written, hashed for the metadata and uploaded as it streams through.
+With -upload-chunk-size, it's uploaded once written instead, a chunk
+at a time, each a PUT with a Content-Range to the same URL, and failed
+chunks are tried again. An interrupted build leaves OUTPUT.upload.json
+beside the output, listing the chunks it uploaded by checksum, and a
+rerun that writes the same output skips those.
+
+With -fs squashfs or erofs, the root is populated in a directory and
+packed read-only with mksquashfs or mkfs.erofs at the end. extlinux
+can't read those or f2fs, so with them the image needs a
+-partition /boot:SIZE:FS with a filesystem it can. -overlay-size adds an
+empty ext4 partition labelled overlay, for an initramfs to mount over
+the root to make it writable.
+
+Partitions get the usual type for their mount point: on -dps layouts,
+the Discoverable Partitions Specification type systemd-gpt-auto
+looks for, and on an MBR, 83 for Linux. -root-type and a TYPE field in
+-partition set one explicitly, an MBR type byte such as 82, or a GPT
+type GUID with -dps.
+
+mkfs gives each filesystem a random UUID unless -fs-uuid sets the
+root's, or -layout-seed derives them all, so root=UUID=... and fstab
+entries by UUID can be written before the image is built.
+
+FAT filesystems, such as the ESP, get volume IDs derived from
+-layout-seed or SOURCE_DATE_EPOCH rather than random ones. With either,
+their timestamps are clamped once the image is built: to
+SOURCE_DATE_EPOCH if it's set, and otherwise to 1980, the earliest FAT
+can store. They're mounted with tz=UTC, so no host's time zone gets in.
+
+-uefi adds a FAT32 EFI System Partition mounted at /boot/efi, with
+syslinux.efi installed as the firmware's default boot program, along
+with copies of the kernels and initrds, since it can only read its own
+partition. extlinux is still installed for BIOS booting.
+
+-converter FORMAT=PROGRAM adds an output format converted by PROGRAM.
+It's given a JSON request on stdin:
+
+  {"version": 1, "input": RAW, "output": FILE, "format": FORMAT,
+   "metadata": {"name": ..., "version": ..., "arch": ...,
+                "disk_size": MB, "kernel_args": ..., "vars": {...}}}
+
+It must write FILE, then a JSON response on stdout listing any other
+files it wrote, relative to FILE's directory unless absolute:
+
+  {"artifacts": [{"file": NAME, "format": FORMAT}, ...]}
+
+Those are compressed, encrypted, uploaded and reported like FILE. What
+it writes on stderr goes to the log.
+
+-flash-descriptors writes the layout beside the image for flashing
+tools: a ptool partition.xml for android, a parameter.txt for rockchip
+and a genimage.cfg for genimage. With -export-partitions they name the
+exported filesystems, so each partition can be flashed separately.
+
+Images boot with extlinux, except on ppc64le and s390x. ppc64le
+images get a PReP boot partition holding GRUB, which reads
+/boot/grub/grub.cfg, as petitboot does on machines without Open
+Firmware. s390x images get a zipl boot record, and an /etc/zipl.conf
+for rerunning zipl after a kernel update. -bootloader grub, or a
+manifest's bootloader line naming it, boots amd64 and 386 images with
+GRUB instead of extlinux: grub-install writes its boot code to the MBR
+and its core image to the gap after it, or on -dps layouts, to a 1 MiB
+BIOS boot partition, and GRUB reads /boot/grub/grub.cfg. GRUB's i386-pc
+modules must be installed. Otherwise the bootloader must be the one
+-arch uses.
+
+-boot-tries N has GRUB count boots in /boot/grub/grubenv, and after N
+in a row that don't reach boot-complete.target, boot the previous
+kernel, or with -ab, slot B. A grub-boot-success.service, enabled in
+the image, marks a boot successful with the image's grub-editenv,
+which starts the count over. /boot must be on ext4 or vfat, which GRUB
+can write its environment block on.
+
+-xen builds a Xen PV or PVH guest image. Rather than boot code in the
+MBR, it gets a /boot/grub/grub.cfg for pvgrub2 and pygrub, and a
+/boot/grub/menu.lst for GRUB legacy PV-GRUB. Unless -kernel-args is
+given, the root is on /dev/xvda1 and the console on hvc0.
+
+-profile cloud-baseline sets up what cloud images need: the kernel
+console on the serial port as well as the screen, along with the boot
+menu, root= by PARTUUID, DHCP on every wired interface with
+systemd-networkd, and cloud-init configuration to grow the root on
+boot. Files the sources provide are kept, and -kernel-args replaces
+the profile's. The PARTUUIDs derive from -layout-seed when it's given.
+
+-lvm NAME puts the root filesystem in a logical volume of an LVM volume
+group NAME, on a partition taking the space the others leave, with
+each -lv MOUNT:SIZE[:FS] as another volume. Since bootloaders can't
+read LVM, such images get a /boot partition of -boot-size MB unless a
+-partition gives one. The volumes go in the image's fstab, and unless
+-kernel-args is given, root= points at the root volume. The initrd has
+to activate the volume group.
+
+-raid NAME puts the root filesystem on an mdadm RAID1 array
+/dev/md/NAME, made degraded with the root partition as its only member,
+for a second disk to be added with mdadm --add once deployed. Like
+-lvm, it gets a separate /boot partition, and unless -kernel-args is
+given, root= points at the array and rd.md.uuid= names it for dracut.
+The array goes in the image's mdadm.conf, and initramfs-tools is told
+to boot it degraded, or dracut to include mdraid, whichever the image
+has; the initrd has to be built with that configuration and mdadm.
+
+-verity protects a squashfs or erofs root with dm-verity. Its hash
+tree goes on a partition right after it, typed for discovery on -dps
+layouts, and the root hash is logged and written beside the image as
+outfile.roothash. The boot menu goes on a /boot partition of
+-boot-size MB unless a -partition gives one, and is written last,
+with roothash=, systemd.verity_root_data= and systemd.verity_root_hash=
+added to the kernel args. Unless -kernel-args is given, root= is
+/dev/mapper/root. The initrd has to run systemd-veritysetup to open
+it. With -layout-seed, the salt and verity UUID are repeatable too.
+With -verity-key and -verity-cert, the root hash is signed with
+openssl, the signature is written beside it as outfile.roothash.p7s,
+and passed inline in systemd.verity_root_options=, for the kernel to
+check against its keyring before opening the root. The kernel needs
+CONFIG_DM_VERITY_VERIFY_ROOTHASH_SIG and the certificate built in.
+Only the root is verified, so there's no usrhash=.
+
+-ab lays out two root partitions of the same size, slot A and slot B
+after it, along with a -state-size MB ext4 partition labelled state
+for the update client's bookkeeping, which is formatted but not
+mounted. Slot A is populated and boots by default, by PARTUUID unless
+-kernel-args is given; B is left unformatted for the first update to
+write. Each boot entry has a copy suffixed -b booting slot B, with the
+kernels of a /boot partition of -boot-size MB both slots share,
+unless a -partition gives one.
+
+-hybrid-mbr gives a -dps layout a hybrid MBR for old BIOS machines that
+only read an MBR: besides the protective entry, it lists the /boot
+partition, marked bootable, the ESP, and the first of the others, up
+to three in all. GPT-aware systems and firmware still read the GPT.
+Only partitions ending within the first 2 TiB can be listed.
+
+-auto-size sizes the disk image to fit the sources rather than taking
+-disk-size. What they put in the root, along with the kernel and
+initrd, is measured in whole blocks, and grown by the filesystem's
+overhead and then -headroom percent. The other partitions keep their
+sizes, and what the sources put in them isn't counted.
+
+-assemble builds without loop devices, device mapper or mounts, so it
+runs in unprivileged containers. Every partition is populated as a
+plain directory and made from it at the end, by mke2fs -d, mkfs.btrfs
+--rootdir or mcopy, or packed like a read-only root, and the image is
+assembled from them behind a partition table written directly. ext3,
+ext4, btrfs and vfat partitions can be populated this way. extlinux
+can't install without mounting /boot, so partitioned images boot with
+-uefi alone, and -lvm, -subvolume and -info-size aren't available.
+
+Everything in the outputs is dated by one clock: build info, metadata,
+-output-template dates, and the timestamps filesystems keep. It reads
+the time the build started unless -build-time or SOURCE_DATE_EPOCH
+fixes it, in which case files modified later are clamped to it, and
+ext superblocks and FAT directories carry it too. Commands run in UTC
+either way, so the host's time zone doesn't show.
+
+-boot-title, -boot-splash and -boot-colors brand the boot menu, which
+then shows for five seconds even with one entry. syslinux runs
+vesamenu.c32 for it, copied beside syslinux.cfg with the splash, and
+takes the title as the menu's. GRUB draws the splash on its graphical
+terminal, and puts the title at the head of each entry. A black
+background lets the splash show through. zipl's menu can't be branded,
+and Xen PV guests have no console to show a splash on.
+
+ext filesystems are made with a pinned mke2fs.conf rather than the
+host's, so they get the same features whichever distribution builds
+them. -fs-features, -mkfs-args and -compat change them from there, and
+the -notify-url build report lists what each filesystem ended up with.
+
+Partitions start on 1 MiB boundaries, or every -align MiB, with
+padding between them as needed. -first-sector moves the first one, for
+firmware expecting it somewhere particular; the rest still align.
+
+Giving the kernel as "auto" boots the newest /boot/vmlinuz-VERSION
+the sources provide, along with its initrd unless -kernel-initrd is
+given. With -all-kernels, every /boot/vmlinuz-VERSION gets boot
+entries too, after the default kernel. In both cases the bootloader is
+installed after the sources rather than before.
+
+Without a root: prefix, a source goes to /. A relative root is taken
+relative to /, with a warning. Since the first colon ends the root, a
+local path containing a colon needs an explicit root.
+
+Sources can also be listed in a -manifest file, one per line as
+"source root path", along with directives creating other files:
+
+  symlink path target
+  dir path [mode [owner]]
+  node path c|b|p major minor [mode [owner]]
+  template path file [mode [owner]]
+  fixup glob mode|- [owner]
+  format format...
+  bootloader extlinux|grub|zipl|pvgrub
+  entry label [kernel-arg...]
+  subvolume mount name
+  matrix axis value...
+
+Templates are rendered with Go's text/template, and can use the build
+variables .Kernel, .KernelArgs, .Initrd, .Format, .Arch, .DiskSize and
+any -var KEY=VALUE given as .Var.KEY.
+
+Fixups run last, correcting the mode and owner of matching files.
+
+A format line picks the output formats when -format isn't given. With
+several formats, each output replaces outfile's extension with its own.
+
+Each entry line adds a boot menu label whose kernel args are
+-kernel-args plus its own, e.g. "entry debug loglevel=7 console=ttyS0".
+The first entry boots by default.
+
+Each subvolume line, like -subvolume, puts a mount point in a btrfs
+subvolume of the root partition. The one for / becomes the default
+subvolume, and the others are added to /etc/fstab.
+
+Matrix lines make one invocation build every combination of their
+values, one build after another, such as
+
+  matrix arch amd64 arm64
+  matrix flavor dev prod
+  matrix format qcow2 vmdk
+
+The arch axis sets -arch, and the others are template variables,
+.Var.flavor here, except format, which works like a format line: each
+build converts its image to every format rather than building it
+again. Each build's outputs are named after its values, like
+out-amd64-dev.qcow2, or with -output-template, have them added to the
+image name. The builds share -cache-dir, or a cache of the matrix's
+own, and their reports are combined in out.matrix.json, or
+-matrix-report. -matrix-cell builds just one combination, as
+axis=value,... Every build gets the same kernel argument, so with an
+arch axis it must be auto, for each to boot the kernel its sources
+install.
+
+Dockerfile-like spellings are accepted too: "FROM tarball" for a
+source at /, "COPY path root", "OUTPUT format..." and "BOOTLOADER".
+
+The audit command mounts a built image read-only and checks it
+against a policy file, with one rule per line:
+
+  no-world-writable [except-glob...]
+  kernel-min version
+  absent glob
+  package-absent name
+
+It prints PASS or FAIL for each rule, and fails if any rule does.
+
+The verify command checks an image against the artifacts listed in a
+-notify-url build report or -update-metadata file. An image the report
+doesn't list is converted back to raw with qemu-img and compared with
+the raw image it does list. The signature of a metadata partition is
+checked too, against -verify-key if given. Output is as for audit.
+
+Every image gets an ID, -image-id or a random UUID, recorded in the
+metadata partition and -update-metadata along with its lineage: the
+IDs of the images it derives from, parent first. -parent-image names
+the parent by ID, or as a raw image with a metadata partition, whose
+own lineage is carried over. The lineage command prints the ID of a
+raw image, then its lineage, from its metadata partition.
+
+The rebless command rewrites the boot menu of a built image for new
+-kernel-args, and the entry lines of -manifest if given, then
+reinstalls extlinux. It keeps the kernels the image already boots and
+changes nothing outside /boot.
+
+The bundle command fetches the remote sources of -manifest and packs
+them with it into one file. Building with -bundle takes the manifest
+and remote sources from it, checked against their digests, without
+network access. Local sources and templates aren't bundled: the
+bundled manifest looks for them beside the bundle.
+
+Every run keeps a state file in -work-dir listing the loop devices,
+mounts and temporary files it has set up. Runs clean up whatever a
+crashed run left behind before starting; the recover command does only
+that.
 
 Example:
   sudo mksysimage out.raw vmlinuz /:./system/ /etc:conf.tgz
@@ -49,17 +365,61 @@ Example:
 	flag.PrintDefaults()
 }
 
+// A syncBuffer is a bytes.Buffer that can be read while commands are
+// writing to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) WriteString(s string) (int, error) {
+	return b.Write([]byte(s))
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *syncBuffer) WriteTo(w io.Writer) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.WriteTo(w)
+}
+
+// Tail returns up to the last n bytes written.
+func (b *syncBuffer) Tail(n int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data := b.buf.Bytes()
+	if len(data) > n {
+		data = data[len(data)-n:]
+	}
+	return string(data)
+}
+
+// A LoggingExec runs commands, keeping their output for when things go
+// wrong. Combined has stdout and stderr together, as the TUI shows it.
 type LoggingExec struct {
-	Stdout, Stderr bytes.Buffer
+	Stdout, Stderr, Combined syncBuffer
 }
 
 func (l *LoggingExec) Cmd(cmd string, args ...string) *exec.Cmd {
 	header := fmt.Sprintf("\n=== %s %s\n", cmd, args)
 	l.Stdout.WriteString(header)
 	l.Stderr.WriteString(header)
+	l.Combined.WriteString(header)
 	c := exec.Command(cmd, args...)
-	c.Stdout = &l.Stdout
-	c.Stderr = &l.Stderr
+	c.Env = append(os.Environ(), ClockEnv()...)
+	c.Stdout = io.MultiWriter(&l.Stdout, &l.Combined)
+	c.Stderr = io.MultiWriter(&l.Stderr, &l.Combined)
 	return c
 }
 
@@ -92,264 +452,524 @@ func Exit(err interface{}) {
 	panic(err)
 }
 
+// FlagSet reports whether the named flag was given on the command line.
+func FlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
 func Log(entry string) {
+	if logStep(entry) {
+		return
+	}
 	fmt.Fprintln(os.Stderr, entry)
 }
 
-func CheckPrograms(programs ...string) {
-	missing := false
-	for _, program := range programs {
-		Log(fmt.Sprintf("Checking for program %s", program))
-		if _, err := exec.LookPath(program); err != nil {
-			fmt.Fprintln(os.Stderr, "Couldn't find program:", program)
-			missing = true
+// Subcommands run instead of a build when named by the first
+// argument. They take the same flags as a build, before or after their
+// other arguments.
+var subcommands = map[string]func(args []string){}
+
+// parseInterspersed parses flags mixed in with other arguments, and
+// returns the other arguments.
+func parseInterspersed(args []string) []string {
+	var rest []string
+	for {
+		flag.CommandLine.Parse(args)
+		if flag.NArg() == 0 {
+			return rest
 		}
-	}
-	if missing {
-		Exit("Some required programs are missing")
+		rest = append(rest, flag.Arg(0))
+		args = flag.Args()[1:]
 	}
 }
 
-const syslinuxConfig = `
-PROMPT 0
-DEFAULT linux
-LABEL linux
-    LINUX %s
-    APPEND %s
-    %s
-`
+// handleExit reports the error a deferred Exit panicked with, if any.
+func handleExit() {
+	StopTUI()
+	err := recover()
+	SendReport(err)
+	if err != nil {
+		exe.PrintLog()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	} else if *printLog {
+		exe.PrintLog()
+	}
+}
 
 func main() {
+	if len(os.Args) == 4 && os.Args[1] == extractCommand {
+		ExtractArchiveCommand(os.Args[2], os.Args[3])
+		return
+	}
+	if len(os.Args) > 1 && subcommands[os.Args[1]] != nil {
+		run := subcommands[os.Args[1]]
+		args := parseInterspersed(os.Args[2:])
+		defer handleExit()
+		StartRunDir()
+		defer FinishRunDir()
+		run(args)
+		return
+	}
+
 	flag.Parse()
-	if flag.NArg() < 3 {
+	if flag.NArg() < 1 {
 		Usage()
 		return
 	}
 
-	if os.Getuid() != 0 {
+	if os.Getuid() != 0 && !*listSources && !*useSudo && !*printSudoers {
 		Log("Warning: not running as root, image construction will likely fail.")
 		Log("Continuing anyway, in case you have root-equivalent capabilities set.")
 	}
 
-	defer func() {
-		if err := recover(); err != nil {
-			exe.PrintLog()
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		} else if *printLog {
-			exe.PrintLog()
-		}
-	}()
+	defer handleExit()
+	StartReport(flag.Arg(0))
+	StartRunDir()
+	defer FinishRunDir()
+	if *quick {
+		defer StartQuick()()
+	}
 
 	outfinal := flag.Arg(0)
 	outfile := fmt.Sprintf("%s.tmp", outfinal)
-	kernel := flag.Arg(1)
-	sources := flag.Args()[2:]
-
-	if _, err := os.Stat(outfinal); err == nil {
-		Exit("Output file already exists")
+	var manifest Manifest
+	if *bundleFile != "" {
+		bundled := LoadBundle()
+		if *manifestFile == "" {
+			manifest = *readManifest(bundled, filepath.Dir(*bundleFile))
+		}
 	}
-
-	programs := []string{
-		"dd",
-		"kpartx",
-		"losetup",
-		"mkfs.ext3",
-		"mount",
-		"sfdisk",
-		"tar",
-		"umount",
-		"rsync",
-		"extlinux",
+	if *manifestFile != "" {
+		manifest = *ReadManifest(*manifestFile)
 	}
-
-	switch *format {
-	case "raw":
-	case "vdi", "vmdk", "vhd":
-		programs = append(programs, "vboxmanage")
-	default:
-		Exit(fmt.Sprintf("Unknown format %s", *format))
+	if *matrixCell != "" {
+		ApplyMatrixCell(manifest.Matrix)
+	} else if len(manifest.Matrix) > 0 {
+		SkipReport()
+		CheckMatrixKernel(&manifest)
+		RunMatrix(manifest.Matrix, outfinal)
+		return
 	}
 
-	CheckPrograms(programs...)
-
-	Log("Creating filesystem image")
-	err := exe.Cmd("dd",
-		"if=/dev/zero",
-		fmt.Sprintf("of=%s", outfile),
-		"bs=1M",
-		fmt.Sprintf("count=%d", *diskSize)).Run()
-	if err != nil {
-		Exit(err)
+	formatSpec := *format
+	if !FlagSet("format") && manifest.Formats != nil {
+		formatSpec = strings.Join(manifest.Formats, ",")
 	}
-	defer func() {
-		exe.Cmd("rm", "-f", outfile).Run()
-	}()
-	if *format == "vdi" && *vboxUuid != "" {
-		defer func() {
-			Log("Setting disk UUID")
-			if err = exe.Cmd("vboxmanage", "internalcommands", "sethduuid", outfinal, *vboxUuid).Run(); err != nil {
-				Exit(err)
-			}
-		}()
+	if *keepRaw {
+		formatSpec += ",raw"
 	}
-	defer func() {
-		if *format == "raw" {
-			if err = exe.Cmd("mv", "-f", outfile, outfinal).Run(); err != nil {
-				Exit(err)
-			}
-		} else {
-			Log(fmt.Sprintf("Creating %s image", *format))
-			cmd := exe.Cmd("vboxmanage", "convertfromraw",
-				outfile, outfinal,
-				fmt.Sprintf("--format=%s", strings.ToUpper(*format)))
-			if err = cmd.Run(); err != nil {
-				Exit(err)
+	formats := QuickFormats(ParseFormats(formatSpec))
+	if *outputTemplate != "" {
+		outfinal = TemplateOutput(flag.Arg(0), formats[0])
+		outfile = fmt.Sprintf("%s.tmp", outfinal)
+	}
+	ReportOutputs(outfinal, formats)
+	for _, f := range formats {
+		if _, err := os.Stat(FinalName(OutputFile(outfinal, f, formats))); err == nil {
+			Exit("Output file already exists")
+		}
+		if f == "nspawn" {
+			if _, err := os.Stat(NspawnSettingsFile(OutputFile(outfinal, f, formats))); err == nil {
+				Exit("Output nspawn settings file already exists")
 			}
 		}
-	}()
-
-	Log("Creating partition table")
-	cmd := exe.Cmd("sfdisk", outfile)
-	cmd.Stdin = bytes.NewBufferString(";;;*;\n")
-	if err = cmd.Run(); err != nil {
-		Exit(err)
 	}
 
-	Log("Setting up loop device")
-	cmd = exe.Cmd("losetup", "--show", "-f", outfile)
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	if err = cmd.Run(); err != nil {
-		Exit(err)
-	}
-	device := strings.Trim(buf.String(), "\n")
-	defer func() {
-		Log("Tearing down loop device")
-		exe.Cmd("losetup", "-d", device).Run()
-	}()
+	CheckPipeline()
+	CheckUpload()
 
-	Log("Writing syslinux MBR")
-	cmd = exe.Cmd("dd",
-		"if=/usr/lib/extlinux/mbr.bin",
-		fmt.Sprintf("of=%s", device),
-		"bs=440",
-		"count=1")
-	if err = cmd.Run(); err != nil {
-		Exit(err)
+	// Without a partition table there's no bootloader, so no kernel.
+	initramfs := formats[0] == "initramfs"
+	fixedArgs := 2
+	if *noPartition || initramfs {
+		fixedArgs = 1
+	}
+	if flag.NArg() < fixedArgs || (flag.NArg() <= fixedArgs && *manifestFile == "" && *bundleFile == "" && !*benchmark) {
+		SkipReport()
+		Usage()
+		return
+	}
+	var kernel string
+	if fixedArgs == 2 {
+		kernel = flag.Arg(1)
 	}
+	sources := manifest.Sources
+	for _, arg := range flag.Args()[fixedArgs:] {
+		sources = append(sources, ParseSource(arg, "."))
+	}
+	sources = QuickSources(sources)
 
-	Log("Setting up partition loop device")
-	if err = exe.Cmd("kpartx", "-a", "-v", device).Run(); err != nil {
-		Exit(err)
+	var err error
+	StartTUI(path.Base(outfinal))
+	if *benchmark {
+		if initramfs {
+			Exit("-benchmark builds disk images, not an initramfs")
+		}
+		sources = []Source{BenchmarkSource()}
 	}
-	defer func() {
-		Log("Tearing down partition loop device")
-		exe.Cmd("kpartx", "-d", device).Run()
-	}()
+	downloadDir = TempDir("sources")
+	FetchAll(sources)
 
-	partition := fmt.Sprintf("/dev/mapper/%sp1", path.Base(device))
-	Log("Creating filesystem")
-	if err = exe.Cmd("mkfs.ext3", partition).Run(); err != nil {
-		Exit(err)
+	if *listSources {
+		ListSources(sources)
+		return
 	}
 
-	mountpoint, err := ioutil.TempDir("", "mksysimage")
-	if err != nil {
-		Exit(err)
+	if *printSudoers && initramfs {
+		PrintSudoers(&BuildPlan{Sources: sources, Formats: formats})
+		return
 	}
-	mountpoint, err = filepath.Abs(mountpoint)
-	if err != nil {
-		Exit(err)
+	if initramfs {
+		BuildInitramfs(outfinal, &BuildPlan{Sources: sources, Formats: formats}, &manifest)
+		PruneOutputs(filepath.Dir(outfinal), formats)
+		return
 	}
-	defer os.Remove(mountpoint)
 
-	Log("Mounting the partition")
-	if err = exe.Cmd("mount", "-o", "loop", "-t", "ext3", partition, mountpoint).Run(); err != nil {
-		Exit(err)
+	CheckArch()
+	CheckBootloader(&manifest)
+	CheckBranding()
+	if *importLayout != "" {
+		ImportLayout(*importLayout)
 	}
-	defer func() {
-		Log("Unmounting the partition")
-		exe.Cmd("umount", "-l", mountpoint).Run()
-	}()
-
-	Log("Installing extlinux")
-	extlinux := path.Join(mountpoint, "boot")
-	if err = os.MkdirAll(extlinux, 0700); err != nil {
-		Exit(err)
+	// Catch a malformed -compat before anything is built.
+	CompatKernel()
+	CheckKernelArgs(&manifest)
+	if kernel != "" && kernel != autoKernel && !*quick {
+		CheckKernelArch(kernel)
 	}
-	if err = exe.Cmd("cp", kernel, extlinux).Run(); err != nil {
-		Exit(err)
+	if *repart && !*dps {
+		Exit("-repart needs a -dps layout")
 	}
-	var initrdcfg string
-	if *initrd != "" {
-		if err = exe.Cmd("cp", *initrd, extlinux).Run(); err != nil {
-			Exit(err)
+	if *autoSize {
+		var boot []string
+		if kernel != "" && kernel != autoKernel {
+			boot = append(boot, kernel)
+		}
+		if *initrd != "" {
+			boot = append(boot, *initrd)
 		}
-		initrdcfg = fmt.Sprintf("INITRD %s", path.Base(*initrd))
+		MeasureSources(sources, boot...)
 	}
-	cfgfile, err := os.Create(path.Join(extlinux, "syslinux.cfg"))
-	if err != nil {
-		Exit(err)
+	parts := Layout()
+	CheckSubvolumes(parts)
+	ValidateBudgets(parts)
+	CheckFlashDescriptors(parts)
+	CheckBootTries(parts)
+	var signingKey ed25519.PrivateKey
+	if *metadataPartition {
+		signingKey = LoadMetadataKey()
 	}
-	cfg := fmt.Sprintf(syslinuxConfig,
-		path.Base(kernel), *kernelArgs, initrdcfg)
-	if _, err = cfgfile.Write([]byte(cfg)); err != nil {
-		Exit(err)
+	// A bad -image-id or -parent-image had better fail now.
+	ImageID()
+	Lineage()
+
+	plan := &BuildPlan{Sources: sources, Parts: parts, Formats: formats}
+	if *printSudoers {
+		PrintSudoers(plan)
+		return
 	}
-	cfgfile.Close()
-	if err := exe.Cmd("extlinux", "--install", extlinux).Run(); err != nil {
-		Exit(err)
+	CheckPrograms(plan.Requirements())
+	if !*noPartition && ArchBootloader().Check != nil {
+		ArchBootloader().Check()
 	}
+	SetupThrottling(filepath.Dir(outfile))
+	Audit("build", outfinal, "started", nil)
 
-	for _, rootandsource := range sources {
-		parts := strings.SplitN(rootandsource, ":", 2)
-		if len(parts) != 2 {
-			Exit(errors.New(fmt.Sprintf("Malformed source %s", rootandsource)))
+	Log("Creating filesystem image")
+	done := TimeStage("disk creation", *diskSize)
+	err = CreateImage(outfile, *diskSize)
+	done()
+	if err != nil {
+		Exit(err)
+	}
+	if abs, err := filepath.Abs(outfile); err == nil {
+		Track(&runState.Files, abs)
+		defer Untrack(&runState.Files, abs)
+	}
+	defer func() {
+		exe.Cmd("rm", "-f", outfile).Run()
+	}()
+	built := false
+	defer func() {
+		if built && *benchmark {
+			PrintBenchmark(outfinal, formats)
 		}
+	}()
+	defer func() {
+		if built {
+			PruneOutputs(filepath.Dir(outfinal), formats)
+		}
+	}()
+	defer func() {
+		if built && *updateMetadata != "" {
+			Log("Writing update metadata")
+			WriteUpdateMetadata(*updateMetadata, outfinal, formats)
+		}
+	}()
+	defer func() {
+		if built {
+			ClampFatTimes(outfile, parts)
+			ClampExtTimes(outfile, parts)
+		}
+		if built && *exportPartitions {
+			ExportPartitions(outfile, outfinal, parts)
+		}
+		if built {
+			WriteFlashDescriptors(outfinal, parts)
+		}
+		if built && *verity {
+			WriteRootHash(outfinal)
+		}
+		// The raw image goes last, since moving it into place
+		// removes what the other formats are converted from. It's
+		// hashed meanwhile, reading it along with the converters.
+		for _, f := range formats {
+			if f == "raw" && !Streamed() {
+				HashInBackground(outfile, OutputFile(outfinal, f, formats), f)
+			}
+		}
+		for _, f := range formats {
+			if f != "raw" {
+				done := TimeStage("conversion to "+f, *diskSize)
+				Convert(outfile, OutputFile(outfinal, f, formats), f)
+				done()
+			}
+			if f == "vdi" && *vboxUuid != "" {
+				Log("Setting disk UUID")
+				if err = exe.Cmd("vboxmanage", "internalcommands", "sethduuid",
+					OutputFile(outfinal, f, formats), *vboxUuid).Run(); err != nil {
+					Exit(err)
+				}
+			}
+			if f != "raw" {
+				out := OutputFile(outfinal, f, formats)
+				done := TimeStage("output of "+f, *diskSize)
+				FinishOutput(out, out, f)
+				FinishConverterArtifacts(f)
+				done()
+			}
+		}
+		for _, f := range formats {
+			if f == "raw" {
+				done := TimeStage("output of raw", *diskSize)
+				FinishOutput(outfile, OutputFile(outfinal, f, formats), f)
+				done()
+			}
+		}
+	}()
 
-		root := parts[0]
-		source := parts[1]
-
-		Log(fmt.Sprintf("Populating %s from %s", root, source))
-
-		if !filepath.IsAbs(root) {
-			Exit("Given source root isn't absolute")
+	if *noPartition {
+		parts[0].Device = outfile
+	} else if *assemble {
+		StagePartitions(parts)
+		defer func() {
+			if built {
+				AssembleImage(outfile, parts)
+			}
+		}()
+	} else {
+		detach := AttachPartitions(outfile, parts)
+		defer detach()
+	}
+	done = TimeStage("mkfs", *diskSize)
+	for _, p := range parts {
+		// A read-only root is made from the populated root at the end,
+		// as everything populated is with -assemble.
+		if p.Fs == "" || ReadOnlyFs(p.Fs) || (*assemble && p.Mount != "") {
+			continue
+		}
+		Log(fmt.Sprintf("Creating filesystem for %s", p.Mount))
+		mkfs := exe.HeavyPriv(MkfsProgram(p.Fs), MkfsArgs(p, parts)...)
+		var features []string
+		if strings.HasPrefix(p.Fs, "ext") {
+			PinMke2fsConfig(mkfs)
+			features = ExtFeatures(p)
+			Log(fmt.Sprintf("%s features: %s", p.Fs, strings.Join(features, ",")))
 		}
-		root = filepath.Join(mountpoint, root)
-		if err = os.MkdirAll(root, 0700); err != nil {
+		err = mkfs.Run()
+		Audit("mkfs", p.Device, p.Fs, err)
+		if err != nil {
 			Exit(err)
 		}
+		ReportFilesystem(p, features)
+		if p == parts[0] {
+			CreateSubvolumes(p)
+		}
+	}
+	done()
 
-		source, err = filepath.Abs(source)
-		if err != nil {
+	mountpoint := TempDir("mnt")
+
+	for _, p := range MountOrder(parts) {
+		p := p
+		target := filepath.Join(mountpoint, p.Mount)
+		if err = ImageMkdirAll(target, 0755); err != nil {
 			Exit(err)
 		}
-		st, err := os.Stat(source)
+		if ReadOnlyFs(p.Fs) || *assemble {
+			// The partition is populated as a plain directory,
+			// which becomes the root directory of its filesystem.
+			if err = ImageChmod(target, 0755); err != nil {
+				Exit(err)
+			}
+			if err = ImageLchown(target, 0, 0); err != nil {
+				Exit(err)
+			}
+			continue
+		}
+		Log(fmt.Sprintf("Mounting the %s partition", p.Mount))
+		options := "loop"
+		if p.Fs == "vfat" {
+			options += "," + FatMountOptions()
+		}
+		err = exe.Priv("mount", "-o", options, "-t", MountFs(p.Fs), p.Device, target).Run()
+		Audit("mount", target, p.Device, err)
 		if err != nil {
 			Exit(err)
 		}
-		var cmd *exec.Cmd
-		if st.IsDir() {
-			cmd = exe.Cmd("rsync", "-RrvP", ".", root)
-			cmd.Dir = source
-			if err != nil {
-				Exit(err)
+		Track(&runState.Mounts, target)
+		WatchMount(p.Mount, target)
+		defer func() {
+			UnwatchMount(target)
+			Log(fmt.Sprintf("Unmounting the %s partition", p.Mount))
+			err := exe.Priv("umount", "-l", target).Run()
+			Audit("umount", target, p.Device, err)
+			if err == nil {
+				Untrack(&runState.Mounts, target)
 			}
-		} else {
-			cmd = exe.Cmd("tar", "xvf", source)
-			if err != nil {
+		}()
+		if p == parts[0] {
+			defer MountSubvolumes(p, mountpoint)()
+		}
+	}
+
+	boot := path.Join(mountpoint, "boot")
+	var initrdName string
+	var kernels []BootKernel
+	if !*noPartition {
+		if err = ImageMkdirAll(boot, 0700); err != nil {
+			Exit(err)
+		}
+		if *initrd != "" {
+			if err = exe.Priv("cp", *initrd, boot).Run(); err != nil {
 				Exit(err)
 			}
-			cmd.Dir = root
+			initrdName = path.Base(*initrd)
 		}
-		if err = cmd.Run(); err != nil {
+		kernels = []BootKernel{{path.Base(kernel), initrdName}}
+	}
+	if !*noPartition && kernel != autoKernel {
+		if err = exe.Priv("cp", kernel, boot).Run(); err != nil {
 			Exit(err)
 		}
+		if !*allKernels && !ArchBootloader().AfterSources && !*verity && !*assemble {
+			InstallBootloader(mountpoint, parts, kernels, &manifest)
+		}
+	}
+
+	done = TimeStage("population", *benchmarkSize)
+	for _, source := range sources {
+		Log(fmt.Sprintf("Populating %s", source))
+		source.Populate(mountpoint)
+	}
+	done()
+	WriteSubvolumeFstab(parts[0], mountpoint)
+	WriteSwapFstab(parts, mountpoint)
+	WriteLvmFstab(parts, mountpoint)
+	InstallRaidConfig(mountpoint)
+
+	if !*noPartition && (kernel == autoKernel || *allKernels) {
+		found := FindKernels(boot)
+		if kernel == autoKernel {
+			if len(found) == 0 && *quick {
+				found = QuickKernels(boot)
+			} else if len(found) == 0 {
+				Exit("No vmlinuz-* kernel found in /boot")
+			}
+			if initrdName != "" {
+				found[0].Initrd = initrdName
+			}
+			kernels = found[:1]
+		}
+		if *allKernels {
+			for _, k := range found {
+				if k.Kernel != kernels[0].Kernel {
+					kernels = append(kernels, k)
+				}
+			}
+		}
+	}
+	// With -verity, the kernel args aren't known until the root is
+	// packed and hashed.
+	installBoot := func() {
+		if !*noPartition && !*assemble && (kernel == autoKernel || *allKernels || ArchBootloader().AfterSources || *verity) {
+			InstallBootloader(mountpoint, parts, kernels, &manifest)
+		}
+		if *uefi {
+			Log("Installing syslinux.efi")
+			InstallEfiBoot(mountpoint, boot, kernels, &manifest)
+		}
+	}
+	if !*verity {
+		installBoot()
+	}
+
+	if *recoverySize > 0 {
+		InstallRecoveryScript(mountpoint)
+	}
+
+	if len(kernels) > 0 && !*quick {
+		CheckRootArch(mountpoint, boot, kernels)
+		buildVars.Kernel = kernels[0].Kernel
+		buildVars.Initrd = kernels[0].Initrd
+	}
+	buildVars.KernelArgs = *kernelArgs
+	buildVars.Format = strings.Join(formats, ",")
+	buildVars.Arch = *arch
+	buildVars.DiskSize = *diskSize
+	InstallProfile(mountpoint, parts)
+	for _, d := range manifest.Directives {
+		Log(fmt.Sprintf("Applying %s %s", d.Name, d.Args[0]))
+		d.Apply(mountpoint)
+	}
+	for _, d := range manifest.Fixups {
+		Log(fmt.Sprintf("Fixing up %s", d.Args[0]))
+		d.Apply(mountpoint)
+	}
+
+	if *randomSeed {
+		Log("Writing random seeds")
+		WriteRandomSeeds(mountpoint)
+	}
+
+	if *repart {
+		Log("Installing systemd-repart definitions")
+		InstallRepartConfig(mountpoint, parts)
+	}
+
+	if *recoverySize > 0 {
+		Log("Writing recovery archive")
+		WriteRecoveryArchive(mountpoint)
+	}
+
+	if !*noPartition {
+		CheckKernelArgsLayout(mountpoint, parts, &manifest)
+	}
+	if !*quick {
+		CheckBudgets(mountpoint, parts)
+	}
+	if *sizeReport > 0 || *sizeReportJson != "" {
+		Log("Measuring image contents")
+		WriteSizeReport(mountpoint, sources)
 	}
 
 	if *printFs {
-		cmd = exe.Cmd("find", ".")
+		cmd := exe.Cmd("find", ".")
 		cmd.Dir = mountpoint
 		cmd.Stdout = os.Stdout
 		if err = cmd.Run(); err != nil {
@@ -357,5 +977,32 @@ func main() {
 		}
 	}
 
+	ClampMtimes(mountpoint)
+	if ReadOnlyFs(parts[0].Fs) {
+		done = TimeStage("packing the root", *benchmarkSize)
+		WriteReadOnlyRoot(parts[0], mountpoint, parts)
+		done()
+	}
+	if *verity {
+		WriteVerityHash(parts)
+		buildVars.KernelArgs = *kernelArgs
+		installBoot()
+	}
+	if *assemble {
+		PackPartitions(mountpoint, parts)
+	}
+
+	if *infoSize > 0 {
+		Log("Writing build info partition")
+		WriteInfoPartition(parts, BuildInfo(outfinal, formats, kernels, sources))
+	}
+
+	if *metadataPartition {
+		Log("Writing build metadata partition")
+		WriteMetadataPartition(parts, signingKey, boot, kernels, sources)
+	}
+
+	Audit("build", outfinal, "populated", nil)
 	Log("Build complete, cleaning up")
+	built = true
 }
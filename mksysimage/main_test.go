@@ -0,0 +1,10 @@
+package main
+
+// exits reports what f gave up with, if it called Exit.
+func exits(f func()) (err interface{}) {
+	defer func() {
+		err = recover()
+	}()
+	f()
+	return nil
+}
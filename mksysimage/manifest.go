@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+var manifestFile = flag.String("manifest", "",
+	"Manifest file listing sources and other directives for the image")
+
+// A Directive is one line of a manifest: a name followed by its
+// whitespace separated arguments.
+type Directive struct {
+	Pos  string // file:line, for error messages
+	Name string
+	Args []string
+}
+
+// The allowed number of arguments for each directive.
+var directiveArgs = map[string][2]int{
+	"source":     {2, 2},  // source ROOT PATH
+	"symlink":    {2, 2},  // symlink PATH TARGET
+	"dir":        {1, 3},  // dir PATH [MODE [OWNER]]
+	"node":       {4, 6},  // node PATH c|b|p MAJOR MINOR [MODE [OWNER]]
+	"fixup":      {2, 3},  // fixup GLOB MODE|- [OWNER]
+	"template":   {2, 4},  // template PATH FILE [MODE [OWNER]]
+	"format":     {1, 5},  // format FORMAT...
+	"bootloader": {1, 1},  // bootloader extlinux|grub|zipl|pvgrub
+	"entry":      {1, 64}, // entry LABEL [KERNEL-ARG...]
+	"subvolume":  {2, 2},  // subvolume MOUNT NAME
+	"matrix":     {2, 64}, // matrix AXIS VALUE...
+}
+
+type varList map[string]string
+
+func (v varList) String() string {
+	specs := make([]string, 0, len(v))
+	for key, value := range v {
+		specs = append(specs, key+"="+value)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (v varList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New(fmt.Sprintf("Malformed variable %s", value))
+	}
+	v[parts[0]] = parts[1]
+	return nil
+}
+
+// TemplateVars are the build variables available to manifest templates.
+type TemplateVars struct {
+	Kernel     string
+	KernelArgs string
+	Initrd     string
+	Format     string
+	Arch       string
+	DiskSize   uint64
+	Var        varList
+}
+
+var buildVars = TemplateVars{Var: varList{}}
+
+func init() {
+	flag.Var(buildVars.Var, "var",
+		"Set a template variable as KEY=VALUE, available as {{.Var.KEY}}, may be repeated")
+}
+
+// A Manifest describes an image's contents in a file rather than on
+// the command line.
+type Manifest struct {
+	Sources    []Source
+	Directives []*Directive
+	Fixups     []*Directive
+	Formats    []string
+	Entries    []*Directive
+	Bootloader string
+	Matrix     []*Directive
+}
+
+// translateDockerStyle rewrites the Dockerfile-like spellings of
+// directives into their usual form:
+//
+//	FROM tarball         source / tarball
+//	COPY path root       source root path
+//	OUTPUT format...     format format...
+//	BOOTLOADER name      bootloader name
+func (d *Directive) translateDockerStyle() {
+	switch d.Name {
+	case "FROM":
+		d.Name, d.Args = "source", append([]string{"/"}, d.Args...)
+	case "COPY":
+		if len(d.Args) != 2 {
+			d.Fail("COPY takes a source and a destination")
+		}
+		d.Name, d.Args = "source", []string{d.Args[1], d.Args[0]}
+	case "OUTPUT":
+		d.Name = "format"
+	case "BOOTLOADER":
+		d.Name = "bootloader"
+	}
+}
+
+func (d *Directive) Fail(msg string) {
+	Exit(fmt.Sprintf("%s: %s", d.Pos, msg))
+}
+
+func ReadManifest(file string) *Manifest {
+	return readManifest(file, filepath.Dir(file))
+}
+
+// readManifest reads a manifest taking relative paths in it relative
+// to dir.
+func readManifest(file, dir string) *Manifest {
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+
+	m := &Manifest{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		d := &Directive{fmt.Sprintf("%s:%d", file, line), fields[0], fields[1:]}
+		d.translateDockerStyle()
+		limits, ok := directiveArgs[d.Name]
+		if !ok {
+			d.Fail(fmt.Sprintf("Unknown directive %s", d.Name))
+		}
+		if len(d.Args) < limits[0] || len(d.Args) > limits[1] {
+			d.Fail(fmt.Sprintf("Wrong number of arguments to %s", d.Name))
+		}
+		if d.Name != "source" && d.Name != "format" && d.Name != "bootloader" &&
+			d.Name != "entry" && d.Name != "matrix" && !filepath.IsAbs(d.Args[0]) {
+			d.Fail(fmt.Sprintf("Path %s isn't absolute", d.Args[0]))
+		}
+		switch d.Name {
+		case "source":
+			m.Sources = append(m.Sources, ParseSource(d.Args[0]+":"+d.Args[1], dir))
+		case "fixup":
+			if _, err := filepath.Match(d.Args[0], ""); err != nil {
+				d.Fail(fmt.Sprintf("Bad pattern %s", d.Args[0]))
+			}
+			m.Fixups = append(m.Fixups, d)
+		case "format":
+			m.Formats = append(m.Formats, d.Args...)
+		case "entry":
+			for _, e := range m.Entries {
+				if e.Args[0] == d.Args[0] {
+					d.Fail(fmt.Sprintf("Duplicate entry %s", d.Args[0]))
+				}
+			}
+			m.Entries = append(m.Entries, d)
+		case "subvolume":
+			if err := subvolumes.Add(d.Args[0], d.Args[1]); err != nil {
+				d.Fail(err.Error())
+			}
+		case "matrix":
+			CheckMatrixAxis(d, m.Matrix)
+			// Every build converts its image to each format, rather
+			// than building it again.
+			if d.Args[0] == "format" {
+				m.Formats = append(m.Formats, d.Args[1:]...)
+			} else {
+				m.Matrix = append(m.Matrix, d)
+			}
+		case "bootloader":
+			if bootloaders[d.Args[0]] == nil {
+				d.Fail(fmt.Sprintf("Unknown bootloader %s", d.Args[0]))
+			}
+			m.Bootloader = d.Args[0]
+		case "template":
+			if !filepath.IsAbs(d.Args[1]) {
+				d.Args[1] = filepath.Join(dir, d.Args[1])
+			}
+			m.Directives = append(m.Directives, d)
+		default:
+			m.Directives = append(m.Directives, d)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		Exit(err)
+	}
+	return m
+}
+
+// Apply carries out the directive on the image mounted at mountpoint.
+func (d *Directive) Apply(mountpoint string) {
+	if d.Name == "fixup" {
+		d.applyFixup(mountpoint)
+		return
+	}
+	// A dir follows a symlink already there, as mkdir -p would, but
+	// within the image. The others replace it.
+	target, err := ImagePath(mountpoint, d.Args[0], d.Name == "dir")
+	if err != nil {
+		d.Fail(err.Error())
+	}
+	if err := ImageMkdirAll(filepath.Dir(target), 0755); err != nil {
+		Exit(err)
+	}
+	switch d.Name {
+	case "symlink":
+		if st, err := os.Lstat(target); err == nil && !st.IsDir() {
+			ImageRemove(target)
+		}
+		err = ImageSymlink(d.Args[1], target)
+	case "dir":
+		if err = ImageMkdirAll(target, 0755); err == nil {
+			err = d.setAttrs(mountpoint, target, d.Args[1:])
+		}
+	case "node":
+		var mode uint32
+		switch d.Args[1] {
+		case "c":
+			mode = syscall.S_IFCHR
+		case "b":
+			mode = syscall.S_IFBLK
+		case "p":
+			mode = syscall.S_IFIFO
+		default:
+			d.Fail(fmt.Sprintf("Unknown node type %s", d.Args[1]))
+		}
+		major, err1 := strconv.ParseUint(d.Args[2], 10, 32)
+		minor, err2 := strconv.ParseUint(d.Args[3], 10, 32)
+		if err1 != nil || err2 != nil {
+			d.Fail("Bad device number")
+		}
+		ImageRemove(target)
+		err = ImageMknod(target, mode|0600, major, minor)
+		Audit("mknod", target, strings.Join(d.Args[1:4], " "), err)
+		if err == nil {
+			err = d.setAttrs(mountpoint, target, d.Args[4:])
+		}
+	case "template":
+		var tmpl *template.Template
+		if tmpl, err = template.ParseFiles(d.Args[1]); err != nil {
+			break
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, &buildVars); err != nil {
+			break
+		}
+		// Its directory is resolved within the image already, but
+		// writing would still follow a symlink in its place.
+		if st, err := os.Lstat(target); err == nil && st.Mode()&os.ModeSymlink != 0 {
+			if err = ImageRemove(target); err != nil {
+				d.Fail(err.Error())
+			}
+		}
+		if err = ImageWriteFile(target, buf.Bytes(), 0644); err == nil {
+			err = d.setAttrs(mountpoint, target, d.Args[2:])
+		}
+	}
+	if err != nil {
+		d.Fail(err.Error())
+	}
+}
+
+// applyFixup sets the mode and owner of every file in the image matching
+// the fixup's pattern. Symlinks only get their owner changed, since a
+// chmod would follow them, possibly out of the image.
+func (d *Directive) applyFixup(mountpoint string) {
+	matches, _ := ImageGlob(mountpoint, d.Args[0])
+	if len(matches) == 0 {
+		Log(fmt.Sprintf("Warning: %s: %s matches nothing", d.Pos, d.Args[0]))
+	}
+	for _, file := range matches {
+		// The glob follows symlinked directories on the host,
+		// which can lead out of the image.
+		rel, _ := filepath.Rel(mountpoint, file)
+		if inImage, err := ImagePath(mountpoint, rel, false); err != nil || inImage != file {
+			Log(fmt.Sprintf("Warning: %s: skipping %s, which is through a symlink", d.Pos, rel))
+			continue
+		}
+		args := d.Args[1:]
+		if target, _ := ImageReadlink(file); target != "" {
+			args = append([]string{"-"}, args[1:]...)
+		}
+		if err := d.setAttrs(mountpoint, file, args); err != nil {
+			d.Fail(err.Error())
+		}
+	}
+}
+
+// setAttrs applies the optional MODE and OWNER arguments of a
+// directive to file. A MODE of - leaves the mode alone. chmod follows
+// symlinks, so a symlink's mode is never set.
+func (d *Directive) setAttrs(mountpoint, file string, args []string) error {
+	if len(args) > 0 && args[0] != "-" {
+		if target, _ := ImageReadlink(file); target != "" {
+			d.Fail(fmt.Sprintf("Can't set the mode of %s, which is a symlink", file))
+		}
+		mode, err := strconv.ParseUint(args[0], 8, 32)
+		if err != nil {
+			d.Fail(fmt.Sprintf("Bad mode %s", args[0]))
+		}
+		if err = ImageChmod(file, uint32(mode)); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 {
+		uid, gid, err := LookupOwner(mountpoint, args[1])
+		if err != nil {
+			d.Fail(err.Error())
+		}
+		return ImageLchown(file, uid, gid)
+	}
+	return nil
+}
+
+// ImagePath returns where name, a path in the image mounted at
+// mountpoint, is on the host, following the image's symlinks as the
+// image would: absolute ones from its root, and .. no higher than it,
+// so that nothing done at the path reaches the host's files. The last
+// component is only followed with follow set. Components that don't
+// exist yet are taken as they are.
+func ImagePath(mountpoint, name string, follow bool) (string, error) {
+	var resolved []string
+	pending := strings.Split(name, "/")
+	links := 0
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		next := append(append([]string{}, resolved...), c)
+		full := filepath.Join(append([]string{mountpoint}, next...)...)
+		target, err := ImageReadlink(full)
+		if err != nil || target == "" || (len(pending) == 0 && !follow) {
+			resolved = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", errors.New(fmt.Sprintf("Too many levels of symlinks in %s", name))
+		}
+		if filepath.IsAbs(target) {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(append([]string{mountpoint}, resolved...)...), nil
+}
+
+func mkdev(major, minor uint64) int {
+	return int((minor & 0xff) | (major&0xfff)<<8 |
+		(minor&^0xff)<<12 | (major&^0xfff)<<32)
+}
+
+// LookupOwner resolves an owner given as USER[:GROUP], by name or
+// number. Names are looked up in the image's own passwd and group
+// files, not the build host's.
+func LookupOwner(mountpoint, owner string) (uid, gid int, err error) {
+	parts := strings.SplitN(owner, ":", 2)
+	uid, gid = -1, -1
+	if uid, err = lookupId(mountpoint, "etc/passwd", parts[0]); err != nil {
+		return
+	}
+	if len(parts) == 2 {
+		gid, err = lookupId(mountpoint, "etc/group", parts[1])
+	}
+	return
+}
+
+func lookupId(mountpoint, db, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(mountpoint, db))
+	if err != nil {
+		return -1, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 2 && fields[0] == name {
+			return strconv.Atoi(fields[2])
+		}
+	}
+	return -1, errors.New(fmt.Sprintf("No %s in the image's /%s", name, db))
+}
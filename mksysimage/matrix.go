@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var matrixCell = flag.String("matrix-cell", "",
+	"Build just this cell of the manifest's matrix, given as AXIS=VALUE,..., as a matrix build does for each of them")
+
+var matrixReport = flag.String("matrix-report", "",
+	"Write the combined JSON report of a matrix build to this file, rather than to NAME.matrix.json beside the outputs")
+
+// Axes other than arch become template variables, so they must be
+// valid names for those.
+var matrixAxisPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// CheckMatrixAxis fails unless d, a matrix directive, declares a new
+// axis of the matrix declared so far.
+func CheckMatrixAxis(d *Directive, matrix []*Directive) {
+	if !matrixAxisPattern.MatchString(d.Args[0]) {
+		d.Fail(fmt.Sprintf("Bad matrix axis %s", d.Args[0]))
+	}
+	for _, axis := range matrix {
+		if axis.Args[0] == d.Args[0] {
+			d.Fail(fmt.Sprintf("Duplicate matrix axis %s", d.Args[0]))
+		}
+	}
+	seen := map[string]bool{}
+	for _, value := range d.Args[1:] {
+		if seen[value] || strings.ContainsAny(value, ",=/") {
+			d.Fail(fmt.Sprintf("Bad or duplicate value %s of matrix axis %s", value, d.Args[0]))
+		}
+		if _, ok := dpsRootTypes[value]; d.Args[0] == "arch" && !ok {
+			d.Fail(fmt.Sprintf("Unknown architecture %s", value))
+		}
+		seen[value] = true
+	}
+}
+
+// CheckMatrixKernel fails if a matrix with an arch axis is given a
+// kernel by name, since every cell would boot the same one. With auto,
+// each boots the kernel its own sources install.
+func CheckMatrixKernel(manifest *Manifest) {
+	formats := manifest.Formats
+	if FlagSet("format") {
+		formats = strings.Split(*format, ",")
+	}
+	if *noPartition || (len(formats) > 0 && formats[0] == "initramfs") || flag.NArg() < 2 || flag.Arg(1) == autoKernel {
+		return
+	}
+	for _, axis := range manifest.Matrix {
+		if axis.Args[0] == "arch" {
+			Exit(fmt.Sprintf("Every arch of the matrix would boot %s, so give the kernel as %s", flag.Arg(1), autoKernel))
+		}
+	}
+}
+
+// A MatrixCell is one combination of the matrix's values, by axis, in
+// the order the axes are declared.
+type MatrixCell [][2]string
+
+func (c MatrixCell) String() string {
+	specs := make([]string, len(c))
+	for i, v := range c {
+		specs[i] = v[0] + "=" + v[1]
+	}
+	return strings.Join(specs, ",")
+}
+
+// MatrixCells returns every combination of the values of matrix, the
+// first axis varying slowest.
+func MatrixCells(matrix []*Directive) []MatrixCell {
+	cells := []MatrixCell{nil}
+	for _, axis := range matrix {
+		var next []MatrixCell
+		for _, c := range cells {
+			for _, value := range axis.Args[1:] {
+				cell := append(MatrixCell{}, c...)
+				next = append(next, append(cell, [2]string{axis.Args[0], value}))
+			}
+		}
+		cells = next
+	}
+	return cells
+}
+
+// ApplyMatrixCell sets the flags -matrix-cell picks the values of: arch
+// sets -arch, and every other axis a template variable.
+func ApplyMatrixCell(matrix []*Directive) {
+	for _, spec := range strings.Split(*matrixCell, ",") {
+		kv := strings.SplitN(spec, "=", 2)
+		var axis *Directive
+		for _, a := range matrix {
+			if len(kv) == 2 && a.Args[0] == kv[0] {
+				axis = a
+			}
+		}
+		if axis == nil {
+			Exit(fmt.Sprintf("-matrix-cell %s isn't an axis of the manifest's matrix", spec))
+		}
+		known := false
+		for _, value := range axis.Args[1:] {
+			known = known || value == kv[1]
+		}
+		if !known {
+			Exit(fmt.Sprintf("%s isn't a value of matrix axis %s", kv[1], kv[0]))
+		}
+		var err error
+		switch kv[0] {
+		case "arch":
+			err = flag.Set("arch", kv[1])
+		default:
+			err = flag.Set("var", spec)
+		}
+		if err != nil {
+			Exit(err)
+		}
+	}
+}
+
+// A MatrixResult is how the build of one cell of a matrix went.
+type MatrixResult struct {
+	Cell   string       `json:"cell"`
+	Status string       `json:"status"` // success or failure
+	Error  string       `json:"error,omitempty"`
+	Report *BuildReport `json:"report,omitempty"`
+}
+
+// A MatrixReport combines the reports of a matrix build's cells.
+type MatrixReport struct {
+	Started  string         `json:"started"`
+	Finished string         `json:"finished"`
+	Cells    []MatrixResult `json:"cells"`
+}
+
+// matrixOutput names the output of cell: outfinal, or with
+// -output-template, the directory it's in, with the cell's values
+// added to the image name.
+func matrixOutput(outfinal string, cell MatrixCell) (string, string) {
+	var values []string
+	for _, v := range cell {
+		values = append(values, v[1])
+	}
+	suffix := ""
+	if len(values) > 0 {
+		suffix = "-" + strings.Join(values, "-")
+	}
+	if *outputTemplate != "" {
+		return outfinal, ImageName() + suffix
+	}
+	ext := filepath.Ext(outfinal)
+	return strings.TrimSuffix(outfinal, ext) + suffix + ext, ""
+}
+
+// RunMatrix builds every cell of matrix, one after another, each by
+// running this build again with -matrix-cell. They share -cache-dir,
+// or without one, a cache of their own for the matrix, so each pinned
+// source is only downloaded once. It writes their combined report, and
+// fails if any of them did, once they've all been tried.
+func RunMatrix(matrix []*Directive, outfinal string) {
+	self, err := os.Executable()
+	if err != nil {
+		Exit(err)
+	}
+	flags := os.Args[1 : len(os.Args)-flag.NArg()]
+	if n := len(flags); n > 0 && flags[n-1] == "--" {
+		flags = flags[:n-1]
+	}
+	positional := flag.Args()
+	if *cacheDir == "" {
+		flags = append(flags, "-cache-dir", TempDir("cache"))
+	}
+	reports := TempDir("reports")
+	combined := MatrixReport{Started: time.Now().UTC().Format(time.RFC3339)}
+	failed := 0
+	cells := MatrixCells(matrix)
+	for i, cell := range cells {
+		Log(fmt.Sprintf("Building matrix cell %d of %d, %s", i+1, len(cells), cell))
+		out, name := matrixOutput(outfinal, cell)
+		cellReport := filepath.Join(reports, fmt.Sprintf("%d.json", i))
+		args := append([]string{}, flags...)
+		args = append(args, "-matrix-cell", cell.String(), "-report-json", cellReport)
+		if name != "" {
+			args = append(args, "-image-name", name)
+		}
+		args = append(append(args, out), positional[1:]...)
+		cmd := exe.Cmd(self, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		result := MatrixResult{Cell: cell.String(), Status: "success"}
+		if err = cmd.Run(); err != nil {
+			result.Status, result.Error = "failure", err.Error()
+			failed++
+		}
+		if data, err := ioutil.ReadFile(cellReport); err == nil {
+			result.Report = &BuildReport{}
+			if err = json.Unmarshal(data, result.Report); err != nil {
+				Exit(err)
+			}
+			if result.Report.Error != "" {
+				result.Error = result.Report.Error
+			}
+		}
+		combined.Cells = append(combined.Cells, result)
+	}
+	combined.Finished = time.Now().UTC().Format(time.RFC3339)
+
+	file := *matrixReport
+	if file == "" && *outputTemplate != "" {
+		file = filepath.Join(outfinal, ImageName()+".matrix.json")
+	} else if file == "" {
+		file = strings.TrimSuffix(outfinal, filepath.Ext(outfinal)) + ".matrix.json"
+	}
+	data, err := json.MarshalIndent(combined, "", "  ")
+	if err != nil {
+		Exit(err)
+	}
+	if err = ioutil.WriteFile(file, data, 0644); err != nil {
+		Exit(err)
+	}
+	for _, r := range combined.Cells {
+		fmt.Fprintf(os.Stderr, "%-8s %s\n", r.Status, r.Cell)
+	}
+	if failed > 0 {
+		Exit(fmt.Sprintf("%d of %d matrix builds failed, see %s", failed, len(cells), file))
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func matrixAxis(name string, values ...string) *Directive {
+	return &Directive{Pos: "test:1", Name: "matrix", Args: append([]string{name}, values...)}
+}
+
+func TestMatrixCells(t *testing.T) {
+	for _, c := range []struct {
+		matrix []*Directive
+		want   []string
+	}{
+		{nil, []string{""}},
+		{[]*Directive{matrixAxis("arch", "amd64", "arm64")}, []string{"arch=amd64", "arch=arm64"}},
+		{[]*Directive{matrixAxis("arch", "amd64", "arm64"), matrixAxis("flavor", "min", "full")},
+			[]string{"arch=amd64,flavor=min", "arch=amd64,flavor=full", "arch=arm64,flavor=min", "arch=arm64,flavor=full"}},
+	} {
+		var got []string
+		for _, cell := range MatrixCells(c.matrix) {
+			got = append(got, cell.String())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("got cells %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestApplyMatrixCell(t *testing.T) {
+	defer func(cell, a string) {
+		*matrixCell, *arch = cell, a
+		delete(buildVars.Var, "flavor")
+	}(*matrixCell, *arch)
+	matrix := []*Directive{matrixAxis("arch", "amd64", "arm64"), matrixAxis("flavor", "min", "full")}
+	for _, c := range []struct {
+		cell   string
+		arch   string
+		flavor string
+		ok     bool
+	}{
+		{"arch=arm64,flavor=full", "arm64", "full", true},
+		{"flavor=min", "amd64", "min", true},
+		{"arch=riscv64", "", "", false},
+		{"size=small", "", "", false},
+		{"arch", "", "", false},
+	} {
+		*matrixCell, *arch = c.cell, "amd64"
+		delete(buildVars.Var, "flavor")
+		err := exits(func() { ApplyMatrixCell(matrix) })
+		if (err == nil) != c.ok {
+			t.Errorf("-matrix-cell %s: got %v, want ok %v", c.cell, err, c.ok)
+			continue
+		}
+		if c.ok && (*arch != c.arch || buildVars.Var["flavor"] != c.flavor) {
+			t.Errorf("-matrix-cell %s: got -arch %s and flavor %q, want %s and %q",
+				c.cell, *arch, buildVars.Var["flavor"], c.arch, c.flavor)
+		}
+	}
+}
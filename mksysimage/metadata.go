@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var updateMetadata = flag.String("update-metadata", "",
+	"Write update server metadata (version, hashes, size, compatible hardware) to this JSON file")
+
+var imageVersion = flag.String("image-version", "",
+	"Version of the image, recorded in the metadata")
+
+var hwCompat = flag.String("hw-compat", "",
+	"Comma separated hardware IDs the image is compatible with, recorded in the metadata")
+
+// An Artifact is one output file of the build.
+type Artifact struct {
+	File   string `json:"file"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+	Sha1   string `json:"sha1"`
+	Md5    string `json:"md5"`
+}
+
+// UpdateMetadata is what update servers such as hawkBit or Mender need
+// to know to offer an image to devices.
+type UpdateMetadata struct {
+	Version    string     `json:"version"`
+	Created    string     `json:"created"`
+	Compatible []string   `json:"compatible"`
+	Artifacts  []Artifact `json:"artifacts"`
+	ImageID    string     `json:"image_id,omitempty"`
+	Lineage    []string   `json:"lineage,omitempty"`
+}
+
+// Checksum hashes file and describes it as an artifact.
+func Checksum(file, format string) Artifact {
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	a, err := checksum(f, format)
+	if err != nil {
+		Exit(err)
+	}
+	return a
+}
+
+// checksum is Checksum for goroutines, which can't Exit, given the file
+// already open.
+func checksum(f *os.File, format string) (Artifact, error) {
+	h256, h1, h5 := sha256.New(), sha1.New(), md5.New()
+	hashes := newParallelWriter(h256, h1, h5)
+	defer hashes.Close()
+	// Large reads keep the goroutines busy between handing them over.
+	size, err := io.CopyBuffer(hashes, struct{ io.Reader }{f}, make([]byte, 1<<20))
+	if err != nil {
+		return Artifact{}, err
+	}
+	return Artifact{
+		File:   filepath.Base(f.Name()),
+		Format: format,
+		Size:   size,
+		Sha256: hex.EncodeToString(h256.Sum(nil)),
+		Sha1:   hex.EncodeToString(h1.Sum(nil)),
+		Md5:    hex.EncodeToString(h5.Sum(nil)),
+	}, nil
+}
+
+// A parallelWriter writes to all its writers at once, each in a
+// goroutine of its own for as long as the writer is open, so each hash
+// of the same data gets a core of its own.
+type parallelWriter struct {
+	chunks []chan []byte
+	done   chan error
+}
+
+func newParallelWriter(writers ...io.Writer) *parallelWriter {
+	w := &parallelWriter{done: make(chan error, len(writers))}
+	for _, dst := range writers {
+		chunks := make(chan []byte)
+		w.chunks = append(w.chunks, chunks)
+		go func(dst io.Writer) {
+			for p := range chunks {
+				_, err := dst.Write(p)
+				w.done <- err
+			}
+		}(dst)
+	}
+	return w
+}
+
+// Write returns once every writer has written p, so it can be reused.
+func (w *parallelWriter) Write(p []byte) (int, error) {
+	for _, chunks := range w.chunks {
+		chunks <- p
+	}
+	var err error
+	for range w.chunks {
+		if werr := <-w.done; err == nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close stops the goroutines.
+func (w *parallelWriter) Close() error {
+	for _, chunks := range w.chunks {
+		close(chunks)
+	}
+	return nil
+}
+
+func WriteUpdateMetadata(file, outfinal string, formats []string) {
+	meta := UpdateMetadata{
+		Version:    *imageVersion,
+		Created:    BuildTime().Format(time.RFC3339),
+		Compatible: []string{},
+		ImageID:    ImageID(),
+		Lineage:    Lineage(),
+	}
+	for _, id := range strings.Split(*hwCompat, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			meta.Compatible = append(meta.Compatible, id)
+		}
+	}
+	for _, f := range formats {
+		meta.Artifacts = append(meta.Artifacts,
+			OutputArtifact(FinalName(OutputFile(outfinal, f, formats)), f))
+	}
+	for _, a := range ConverterOutputs(formats) {
+		meta.Artifacts = append(meta.Artifacts, OutputArtifact(a.File, a.Format))
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		Exit(err)
+	}
+	if err = ioutil.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		Exit(err)
+	}
+}
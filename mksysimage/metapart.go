@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var metadataPartition = flag.Bool("metadata-partition", false,
+	"Add a 1MB partition holding signed JSON build metadata")
+
+var metadataKey = flag.String("metadata-key", "",
+	"PEM encoded PKCS #8 ed25519 private key signing the -metadata-partition contents")
+
+// The GPT partition type of the metadata partition. With an MBR, it's
+// type da, non-filesystem data.
+const metadataPartitionType = "7CFF982A-997F-4E71-80DF-3C96D9044909"
+
+// BuildMetadata describes what went into an image, so a device can
+// report what's installed on it.
+type BuildMetadata struct {
+	Version    string     `json:"version"`
+	Created    string     `json:"created"`
+	Arch       string     `json:"arch"`
+	KernelArgs string     `json:"kernel_args"`
+	Kernels    []Artifact `json:"kernels"`
+	Sources    []Artifact `json:"sources"`
+	Manifest   string     `json:"manifest,omitempty"`
+	ImageID    string     `json:"image_id,omitempty"`
+	Lineage    []string   `json:"lineage,omitempty"` // The IDs of the images it derives from, parent first
+}
+
+// The metadata partition holds a SignedMetadata document, padded with
+// NUL bytes. The signature covers the bytes of Metadata exactly as
+// they appear.
+type SignedMetadata struct {
+	Metadata  json.RawMessage `json:"metadata"`
+	PublicKey []byte          `json:"public_key"`
+	Signature []byte          `json:"signature"`
+}
+
+// MetadataPartition returns the partition -metadata-partition adds to
+// the layout.
+func MetadataPartition() *Partition {
+	p := &Partition{Size: 1, Type: "da"}
+	if *dps {
+		p.Type = metadataPartitionType
+	}
+	return p
+}
+
+// LoadMetadataKey reads the -metadata-key private key.
+func LoadMetadataKey() ed25519.PrivateKey {
+	if *metadataKey == "" {
+		Exit("-metadata-partition needs a -metadata-key")
+	}
+	data, err := ioutil.ReadFile(*metadataKey)
+	if err != nil {
+		Exit(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		Exit(fmt.Sprintf("No PEM data in %s", *metadataKey))
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		Exit(errors.New(fmt.Sprintf("%s: %s", *metadataKey, err)))
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		Exit(fmt.Sprintf("%s isn't an ed25519 key", *metadataKey))
+	}
+	return priv
+}
+
+// ReadMetadataPartition returns what the metadata partition of the raw
+// image holds, without its padding, or false if it has none.
+func ReadMetadataPartition(raw string) ([]byte, bool) {
+	f, err := os.Open(raw)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	// -no-partition images have no partition table to read.
+	mbr := make([]byte, 512)
+	if _, err = io.ReadFull(f, mbr); err != nil || mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, false
+	}
+	for _, p := range ReadImageTable(raw).Partitions {
+		t := strings.ToUpper(p.Type)
+		if t != metadataPartitionType && t != "DA" {
+			continue
+		}
+		data := make([]byte, p.Size*512)
+		if _, err = f.ReadAt(data, int64(p.Start*512)); err != nil && err != io.EOF {
+			Exit(err)
+		}
+		return bytes.TrimRight(data, "\x00"), true
+	}
+	return nil, false
+}
+
+// WriteMetadataPartition signs the build metadata with key and writes
+// it to the metadata partition among parts. The kernels are file names
+// within boot.
+func WriteMetadataPartition(parts []*Partition, key ed25519.PrivateKey, boot string,
+	kernels []BootKernel, sources []Source) {
+	var p *Partition
+	for _, part := range parts {
+		if part.Type == MetadataPartition().Type {
+			p = part
+		}
+	}
+	meta := BuildMetadata{
+		Version:    *imageVersion,
+		Created:    BuildTime().Format(time.RFC3339),
+		Arch:       *arch,
+		KernelArgs: *kernelArgs,
+		Kernels:    []Artifact{},
+		Sources:    []Artifact{},
+		ImageID:    ImageID(),
+		Lineage:    Lineage(),
+	}
+	for _, k := range kernels {
+		meta.Kernels = append(meta.Kernels, Checksum(path.Join(boot, k.Kernel), "kernel"))
+		if k.Initrd != "" {
+			meta.Kernels = append(meta.Kernels, Checksum(path.Join(boot, k.Initrd), "initrd"))
+		}
+	}
+	for _, source := range sources {
+		a := Artifact{File: source.String(), Format: "dir"}
+		switch s := source.(type) {
+		case *tarSource:
+			a = Checksum(s.path, "tar")
+			a.File = source.String()
+		case *httpSource:
+			a = Checksum(s.path, "tar")
+			a.File = source.String()
+		}
+		meta.Sources = append(meta.Sources, a)
+	}
+	if *manifestFile != "" {
+		data, err := ioutil.ReadFile(*manifestFile)
+		if err != nil {
+			Exit(err)
+		}
+		meta.Manifest = string(data)
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		Exit(err)
+	}
+	doc, err := json.Marshal(SignedMetadata{
+		Metadata:  data,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, data),
+	})
+	if err != nil {
+		Exit(err)
+	}
+	if uint64(len(doc)) > p.Size<<20 {
+		Exit(fmt.Sprintf("Build metadata is %s, too big for its partition", FormatSize(uint64(len(doc)))))
+	}
+	cmd := exe.Priv("dd", fmt.Sprintf("of=%s", p.Device), "bs=1M", "conv=fsync")
+	cmd.Stdin = bytes.NewReader(doc)
+	err = cmd.Run()
+	Audit("raw-write", p.Device, fmt.Sprintf("build metadata, %d bytes", len(doc)), err)
+	if err != nil {
+		Exit(err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The features ext filesystems get, whatever the host's
+// /etc/mke2fs.conf says. Distributions turn on different ones, and
+// newer ones by default as e2fsprogs learns them (orphan_file,
+// metadata_csum_seed), which older kernels and bootloaders can't read.
+// These are the ones every e2fsprogs since 1.43 knows.
+var extBaseFeatures = []string{"sparse_super", "large_file", "filetype", "resize_inode", "dir_index", "ext_attr"}
+
+var extFsFeatures = map[string][]string{
+	"ext3": {"has_journal"},
+	"ext4": {"has_journal", "extent", "huge_file", "flex_bg", "metadata_csum", "64bit", "dir_nlink", "extra_isize"},
+}
+
+// The pinned configuration, once written to the run directory.
+var mke2fsConfig string
+
+// Mke2fsConfig returns the mke2fs.conf ext filesystems are made with,
+// writing it out the first time. The usage types mke2fs picks by size
+// all get the defaults, so small filesystems are made the same as large
+// ones, rather than how some hosts define "small" and "floppy". mke2fs
+// warns about types with nothing in them.
+func Mke2fsConfig() string {
+	if mke2fsConfig != "" {
+		return mke2fsConfig
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[defaults]\n")
+	fmt.Fprintf(&buf, "\tbase_features = %s\n", strings.Join(extBaseFeatures, ","))
+	fmt.Fprintf(&buf, "\tdefault_mntopts = acl,user_xattr\n")
+	fmt.Fprintf(&buf, "\tenable_periodic_fsck = 0\n")
+	fmt.Fprintf(&buf, "\tblocksize = 4096\n")
+	fmt.Fprintf(&buf, "\tinode_size = 256\n")
+	fmt.Fprintf(&buf, "\tinode_ratio = 16384\n")
+	fmt.Fprintf(&buf, "\n[fs_types]\n")
+	for _, fs := range []string{"ext3", "ext4"} {
+		fmt.Fprintf(&buf, "\t%s = {\n\t\tfeatures = %s\n\t}\n", fs, strings.Join(extFsFeatures[fs], ","))
+	}
+	for _, usage := range []string{"floppy", "small", "default", "big", "huge"} {
+		fmt.Fprintf(&buf, "\t%s = {\n\t\tinode_ratio = 16384\n\t}\n", usage)
+	}
+	config := filepath.Join(runDir, "mke2fs.conf")
+	if err := ioutil.WriteFile(config, buf.Bytes(), 0644); err != nil {
+		Exit(err)
+	}
+	mke2fsConfig = config
+	return config
+}
+
+// PinMke2fsConfig makes cmd, which runs mke2fs, use Mke2fsConfig. With
+// -sudo, the sudoers snippet keeps MKE2FS_CONFIG for it.
+func PinMke2fsConfig(cmd *exec.Cmd) *exec.Cmd {
+	cmd.Env = append(cmd.Env, "MKE2FS_CONFIG="+Mke2fsConfig())
+	return cmd
+}
+
+// ExtFeatures returns the features the ext filesystem of p is made
+// with: the pinned ones, less those -compat turns off, with the -O
+// arguments of the tuning flags and -mkfs-args applied in turn.
+func ExtFeatures(p *Partition) []string {
+	on := map[string]bool{}
+	for _, f := range append(extBaseFeatures, extFsFeatures[p.Fs]...) {
+		on[f] = true
+	}
+	args := append(compatArgs(p), tuningArgs(p)...)
+	if p.Mount != "" {
+		args = append(args, mkfsArgs[p.Mount]...)
+	}
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "-O" {
+			continue
+		}
+		for _, f := range strings.Split(args[i+1], ",") {
+			switch {
+			case f == "none":
+				on = map[string]bool{}
+			case strings.HasPrefix(f, "^"):
+				delete(on, f[1:])
+			case f != "":
+				on[f] = true
+			}
+		}
+	}
+	features := make([]string, 0, len(on))
+	for f := range on {
+		features = append(features, f)
+	}
+	sort.Strings(features)
+	return features
+}
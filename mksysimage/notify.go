@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+var notifyUrl = flag.String("notify-url", "",
+	"POST a JSON build report to this URL when the build finishes or fails")
+
+var reportJson = flag.String("report-json", "",
+	"Also write the JSON build report to this file")
+
+// A BuildReport tells a webhook how a build went and where its outputs
+// are.
+type BuildReport struct {
+	Status      string     `json:"status"` // success or failure
+	Error       string     `json:"error,omitempty"`
+	Image       string     `json:"image"`
+	Directory   string     `json:"directory"` // Where the artifacts are
+	Version     string     `json:"version,omitempty"`
+	Started     string     `json:"started"`
+	Finished    string     `json:"finished"`
+	Artifacts   []Artifact `json:"artifacts,omitempty"`
+	Filesystems []FsReport `json:"filesystems,omitempty"`
+}
+
+// A FsReport is a filesystem the build made, with the features it was
+// made with, for ext filesystems.
+type FsReport struct {
+	Mount    string   `json:"mount,omitempty"`
+	Fs       string   `json:"fs"`
+	Features []string `json:"features,omitempty"`
+}
+
+// ReportFilesystem adds the filesystem of p to the report, with its
+// features.
+func ReportFilesystem(p *Partition, features []string) {
+	if report == nil {
+		return
+	}
+	report.Filesystems = append(report.Filesystems, FsReport{p.Mount, p.Fs, features})
+}
+
+// The report of this build, from before anything can fail, and the
+// formats it lists outputs for, once main knows them.
+var report *BuildReport
+var reportFormats []string
+
+// StartReport starts the report of building outfinal. It starts before
+// anything can fail, so that failures checking the arguments are
+// reported too; ReportOutputs fills in the rest once it's known.
+func StartReport(outfinal string) {
+	if (*notifyUrl == "" && *reportJson == "") || *listSources || *printSudoers {
+		return
+	}
+	report = &BuildReport{
+		Image:   filepath.Base(outfinal),
+		Version: *imageVersion,
+		Started: time.Now().UTC().Format(time.RFC3339),
+	}
+	if dir, err := filepath.Abs(filepath.Dir(outfinal)); err == nil {
+		report.Directory = dir
+	}
+}
+
+// ReportOutputs names the outputs of the report: outfinal, which
+// -output-template may have changed, in formats.
+func ReportOutputs(outfinal string, formats []string) {
+	if report == nil {
+		return
+	}
+	dir, err := filepath.Abs(filepath.Dir(outfinal))
+	if err != nil {
+		Exit(err)
+	}
+	report.Image = filepath.Base(outfinal)
+	report.Directory = dir
+	reportFormats = formats
+}
+
+// SkipReport drops the report when there turns out to be no build to
+// report on: -matrix cells report on their own, and usage isn't a build.
+func SkipReport() {
+	report = nil
+}
+
+// SendReport posts the report to -notify-url and writes it to
+// -report-json, with the error the build failed with if any. By now the
+// build is over, so problems sending it are only warnings.
+func SendReport(failure interface{}) {
+	if report == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			Log(fmt.Sprintf("Warning: couldn't send the build report: %s", err))
+		}
+	}()
+	report.Finished = time.Now().UTC().Format(time.RFC3339)
+	if failure != nil {
+		report.Status = "failure"
+		report.Error = fmt.Sprint(failure)
+	} else {
+		report.Status = "success"
+		outfinal := filepath.Join(report.Directory, report.Image)
+		var outputs []Artifact
+		for _, f := range reportFormats {
+			outputs = append(outputs, Artifact{File: FinalName(OutputFile(outfinal, f, reportFormats)), Format: f})
+		}
+		outputs = append(outputs, ConverterOutputs(reportFormats)...)
+		for _, o := range outputs {
+			if a, ok := HashedArtifact(o.File); ok {
+				report.Artifacts = append(report.Artifacts, a)
+			}
+		}
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		Exit(err)
+	}
+	if *reportJson != "" {
+		if err = ioutil.WriteFile(*reportJson, data, 0644); err != nil {
+			Exit(err)
+		}
+	}
+	if *notifyUrl == "" {
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(*notifyUrl, "application/json", bytes.NewReader(data))
+	if err != nil {
+		Exit(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		Exit(fmt.Sprintf("%s answered %s", *notifyUrl, resp.Status))
+	}
+}
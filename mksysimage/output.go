@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var outputTemplate = flag.String("output-template", "",
+	"Name outputs in the outfile directory after this template, such as {{.Name}}-{{.Version}}-{{.Date}}.{{.Format}}")
+
+var imageName = flag.String("image-name", "",
+	"Name of the image for -output-template, by default the manifest's name or \"image\"")
+
+var keepOutputs = flag.Int("keep-outputs", 0,
+	"With -output-template, remove all but this many of the newest outputs of the same name, 0 to keep them all")
+
+// OutputVars are what -output-template can use.
+type OutputVars struct {
+	Name, Version, Date, Arch, Format string
+}
+
+// ImageName returns -image-name, or the default for it.
+func ImageName() string {
+	name := *imageName
+	if name == "" && *manifestFile != "" {
+		name = strings.TrimSuffix(filepath.Base(*manifestFile), filepath.Ext(*manifestFile))
+	}
+	if name == "" {
+		name = "image"
+	}
+	return name
+}
+
+// outputVars fills in the template variables for format. Date and
+// Version are the ones that differ from build to build.
+func outputVars(format string) OutputVars {
+	ext := format
+	if e, ok := formatExtensions[format]; ok {
+		ext = e
+	}
+	return OutputVars{
+		Name:    ImageName(),
+		Version: *imageVersion,
+		Date:    BuildTime().Format("20060102"),
+		Arch:    *arch,
+		Format:  ext,
+	}
+}
+
+func renderOutput(vars OutputVars) string {
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(*outputTemplate)
+	if err != nil {
+		Exit(fmt.Sprintf("Bad -output-template: %s", err))
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, vars); err != nil {
+		Exit(fmt.Sprintf("Bad -output-template: %s", err))
+	}
+	name := buf.String()
+	if name == "" || strings.Contains(name, "/") {
+		Exit(fmt.Sprintf("-output-template gave the bad file name %q", name))
+	}
+	return name
+}
+
+// TemplateOutput names the output for format in dir after
+// -output-template.
+func TemplateOutput(dir, format string) string {
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		Exit(fmt.Sprintf("With -output-template, %s must be a directory", dir))
+	}
+	return filepath.Join(dir, renderOutput(outputVars(format)))
+}
+
+// PruneOutputs removes the older outputs in dir for each format, which
+// -output-template would have named the same but for the date and
+// version, keeping the -keep-outputs newest.
+func PruneOutputs(dir string, formats []string) {
+	if *outputTemplate == "" || *keepOutputs <= 0 {
+		return
+	}
+	for _, f := range formats {
+		vars := outputVars(f)
+		vars.Date, vars.Version = "*", "*"
+		pattern := FinalName(filepath.Join(dir, renderOutput(vars)))
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			Exit(err)
+		}
+		type output struct {
+			file string
+			mod  time.Time
+		}
+		var outputs []output
+		for _, m := range matches {
+			if st, err := os.Stat(m); err == nil && st.Mode().IsRegular() {
+				outputs = append(outputs, output{m, st.ModTime()})
+			}
+		}
+		sort.Slice(outputs, func(i, j int) bool { return outputs[i].mod.After(outputs[j].mod) })
+		for i := *keepOutputs; i < len(outputs); i++ {
+			Log(fmt.Sprintf("Removing old output %s", outputs[i].file))
+			if err = os.Remove(outputs[i].file); err != nil {
+				Log(fmt.Sprintf("Warning: %s", err))
+			}
+			if f == "nspawn" {
+				os.Remove(NspawnSettingsFile(strings.TrimSuffix(outputs[i].file, "."+*encryptOutput)))
+			}
+		}
+	}
+}
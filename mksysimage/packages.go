@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A Requirement is a program the build needs, and what needs it.
+type Requirement struct {
+	Feature string
+	Program string
+}
+
+type Requirements []Requirement
+
+// Need adds programs feature needs to r.
+func (r Requirements) Need(feature string, programs ...string) Requirements {
+	for _, program := range programs {
+		r = append(r, Requirement{feature, program})
+	}
+	return r
+}
+
+// A packageManager installs packages on a family of distributions.
+type packageManager struct {
+	Family  string // ID or ID_LIKE in os-release
+	Install string
+}
+
+// The package managers hints are given for, in the order of the
+// packages in programPackages.
+var packageManagers = []packageManager{
+	{"debian", "apt install"},
+	{"fedora", "dnf install"},
+	{"arch", "pacman -S"},
+	{"suse", "zypper install"},
+	{"alpine", "apk add"},
+}
+
+// programPackages gives the packages providing each program, for each
+// of packageManagers. Space separated packages are all needed, and ""
+// means there's none.
+var programPackages = map[string][]string{
+	"blkid":         {"util-linux", "util-linux", "util-linux", "util-linux", "blkid"},
+	"btrfs":         {"btrfs-progs", "btrfs-progs", "btrfs-progs", "btrfs-progs", "btrfs-progs"},
+	"cp":            {"coreutils", "coreutils", "coreutils", "coreutils", "coreutils"},
+	"cpio":          {"cpio", "cpio", "cpio", "cpio", "cpio"},
+	"dd":            {"coreutils", "coreutils", "coreutils", "coreutils", "coreutils"},
+	"debugfs":       {"e2fsprogs", "e2fsprogs", "e2fsprogs", "e2fsprogs", "e2fsprogs"},
+	"extlinux":      {"extlinux syslinux-common", "syslinux-extlinux", "syslinux", "syslinux", "syslinux"},
+	"find":          {"findutils", "findutils", "findutils", "findutils", "findutils"},
+	"grub-install":  {"grub2-common", "grub2-tools", "grub", "grub2", "grub"},
+	"grub-mkimage":  {"grub-common", "grub2-tools", "grub", "grub2", "grub"},
+	"grub-probe":    {"grub-common", "grub2-tools", "grub", "grub2", "grub"},
+	"grub2-install": {"grub2-common", "grub2-tools", "grub", "grub2", "grub"},
+	"grub2-mkimage": {"grub-common", "grub2-tools", "grub", "grub2", "grub"},
+	"grub2-probe":   {"grub-common", "grub2-tools", "grub", "grub2", "grub"},
+	"gpg":           {"gnupg", "gnupg2", "gnupg", "gpg2", "gnupg"},
+	"ionice":        {"util-linux", "util-linux", "util-linux", "util-linux", "util-linux-misc"},
+	"kpartx":        {"kpartx", "kpartx", "multipath-tools", "kpartx", "multipath-tools"},
+	"lvcreate":      {"lvm2", "lvm2", "lvm2", "lvm2", "lvm2"},
+	"losetup":       {"mount", "util-linux", "util-linux", "util-linux", "losetup"},
+	"mcopy":         {"mtools", "mtools", "mtools", "mtools", "mtools"},
+	"mdadm":         {"mdadm", "mdadm", "mdadm", "mdadm", "mdadm"},
+	"mkfs.btrfs":    {"btrfs-progs", "btrfs-progs", "btrfs-progs", "btrfs-progs", "btrfs-progs"},
+	"mkfs.erofs":    {"erofs-utils", "erofs-utils", "erofs-utils", "erofs-utils", "erofs-utils"},
+	"mkfs.ext3":     {"e2fsprogs", "e2fsprogs", "e2fsprogs", "e2fsprogs", "e2fsprogs"},
+	"mkfs.ext4":     {"e2fsprogs", "e2fsprogs", "e2fsprogs", "e2fsprogs", "e2fsprogs"},
+	"mkfs.f2fs":     {"f2fs-tools", "f2fs-tools", "f2fs-tools", "f2fs-tools", "f2fs-tools"},
+	"mkfs.ntfs":     {"ntfs-3g", "ntfsprogs", "ntfs-3g", "ntfsprogs", "ntfs-3g-progs"},
+	"mkfs.vfat":     {"dosfstools", "dosfstools", "dosfstools", "dosfstools", "dosfstools"},
+	"mkfs.xfs":      {"xfsprogs", "xfsprogs", "xfsprogs", "xfsprogs", "xfsprogs"},
+	"mksquashfs":    {"squashfs-tools", "squashfs-tools", "squashfs-tools", "squashfs-tools", "squashfs-tools"},
+	"mkswap":        {"util-linux", "util-linux", "util-linux", "util-linux", "util-linux-misc"},
+	"mount":         {"mount", "util-linux", "util-linux", "util-linux", "util-linux-misc"},
+	"nice":          {"coreutils", "coreutils", "coreutils", "coreutils", "coreutils"},
+	"ntfs-3g":       {"ntfs-3g", "ntfs-3g", "ntfs-3g", "ntfs-3g", "ntfs-3g"},
+	"pvcreate":      {"lvm2", "lvm2", "lvm2", "lvm2", "lvm2"},
+	"openssl":       {"openssl", "openssl", "openssl", "openssl", "openssl"},
+	"qemu-img":      {"qemu-utils", "qemu-img", "qemu-img", "qemu-tools", "qemu-img"},
+	"rsync":         {"rsync", "rsync", "rsync", "rsync", "rsync"},
+	"sfdisk":        {"fdisk", "util-linux", "util-linux", "util-linux", "sfdisk"},
+	"systemd-run":   {"systemd", "systemd", "systemd", "systemd", ""},
+	"tar":           {"tar", "tar", "tar", "tar", "tar"},
+	"touch":         {"coreutils", "coreutils", "coreutils", "coreutils", "coreutils"},
+	"umount":        {"mount", "util-linux", "util-linux", "util-linux", "util-linux-misc"},
+	"unshare":       {"util-linux", "util-linux", "util-linux", "util-linux", "util-linux-misc"},
+	"veritysetup":   {"cryptsetup-bin", "cryptsetup", "cryptsetup", "cryptsetup", "cryptsetup"},
+	"vgchange":      {"lvm2", "lvm2", "lvm2", "lvm2", "lvm2"},
+	"vgcreate":      {"lvm2", "lvm2", "lvm2", "lvm2", "lvm2"},
+	"vgs":           {"lvm2", "lvm2", "lvm2", "lvm2", "lvm2"},
+	"vboxmanage":    {"virtualbox", "VirtualBox", "virtualbox", "virtualbox", ""},
+	"zipl":          {"s390-tools", "s390utils-base", "", "s390-tools", ""},
+}
+
+// CheckPrograms fails if any program in reqs is missing, listing the
+// missing ones under the features needing them, and how to install
+// them if the host's package manager is known.
+func CheckPrograms(reqs Requirements) {
+	var features []string
+	missing := map[string][]string{}
+	checked := map[string]bool{}
+	for _, r := range reqs {
+		if checked[r.Feature+"\x00"+r.Program] {
+			continue
+		}
+		checked[r.Feature+"\x00"+r.Program] = true
+		Log(fmt.Sprintf("Checking for program %s", r.Program))
+		if _, err := exec.LookPath(r.Program); err == nil {
+			continue
+		}
+		if missing[r.Feature] == nil {
+			features = append(features, r.Feature)
+		}
+		missing[r.Feature] = append(missing[r.Feature], r.Program)
+	}
+	if len(features) == 0 {
+		return
+	}
+	var msg strings.Builder
+	msg.WriteString("Some required programs are missing:")
+	var programs []string
+	for _, feature := range features {
+		fmt.Fprintf(&msg, "\n  for %s: %s", feature, strings.Join(missing[feature], ", "))
+		programs = append(programs, missing[feature]...)
+	}
+	if hint := installHint(programs); hint != "" {
+		fmt.Fprintf(&msg, "\nInstall them with:\n  %s", hint)
+	}
+	Exit(errors.New(msg.String()))
+}
+
+// installHint returns the command installing programs on this host, or
+// "" if its package manager isn't known. Programs no package is known
+// for are left out.
+func installHint(programs []string) string {
+	pm := hostPackageManager()
+	if pm < 0 {
+		return ""
+	}
+	var packages []string
+	seen := map[string]bool{}
+	for _, program := range programs {
+		names := programPackages[strings.ToLower(filepath.Base(program))]
+		if names == nil {
+			continue
+		}
+		for _, name := range strings.Fields(names[pm]) {
+			if !seen[name] {
+				packages = append(packages, name)
+				seen[name] = true
+			}
+		}
+	}
+	if len(packages) == 0 {
+		return ""
+	}
+	return packageManagers[pm].Install + " " + strings.Join(packages, " ")
+}
+
+// hostPackageManager returns the index in packageManagers of the one
+// os-release says this host's distribution uses, or -1.
+func hostPackageManager() int {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "ID=") || strings.HasPrefix(line, "ID_LIKE=") {
+			value := line[strings.Index(line, "=")+1:]
+			ids = append(ids, strings.Fields(strings.Trim(value, `"'`))...)
+		}
+	}
+	for _, id := range ids {
+		for i, pm := range packageManagers {
+			if id == pm.Family {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Partition is one entry in the image's partition table. The root
+// partition always exists; any others come from -partition flags and
+// the options adding special purpose partitions. Those may have no
+// mount point or filesystem.
+type Partition struct {
+	Mount  string // Mount point within the image, if any
+	Size   uint64 // Size in MB
+	Fs     string // Filesystem to create on the partition, if any
+	Type   string // Partition type, if not the usual one for the mount point
+	Label  string // Filesystem label, if any
+	Tune   bool   // Whether the filesystem tuning flags apply
+	Device string // Mapped block device, once the image is attached
+	Volume string // Logical volume name, for those in the -lvm volume group
+}
+
+type partitionList []*Partition
+
+func (l *partitionList) String() string {
+	specs := make([]string, len(*l))
+	for i, p := range *l {
+		specs[i] = fmt.Sprintf("%s:%d", p.Mount, p.Size)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *partitionList) Set(value string) error {
+	fields := strings.Split(value, ":")
+	fs, typ := "", ""
+	if len(fields) == 4 {
+		typ, fields = fields[3], fields[:3]
+		if typ == "" {
+			return errors.New(fmt.Sprintf("Malformed partition %s", value))
+		}
+	}
+	if len(fields) == 3 {
+		fs, fields = fields[2], fields[:2]
+		if fs != "" && (!supportedFs[fs] || ReadOnlyFs(fs)) && !dataFs[fs] {
+			return errors.New(fmt.Sprintf("Unsupported filesystem %s for partition %s", fs, fields[0]))
+		}
+	}
+	if len(fields) != 2 {
+		return errors.New(fmt.Sprintf("Malformed partition %s", value))
+	}
+	mount := filepath.Clean(fields[0])
+	if !filepath.IsAbs(mount) || mount == "/" {
+		return errors.New(fmt.Sprintf("Partition mount point %s must be absolute and not /", fields[0]))
+	}
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || size == 0 {
+		return errors.New(fmt.Sprintf("Bad partition size %s", fields[1]))
+	}
+	*l = append(*l, &Partition{Mount: mount, Size: size, Fs: fs, Type: typ})
+	return nil
+}
+
+var extraPartitions partitionList
+
+var fsType = flag.String("fs", "ext4",
+	"Filesystem for the root and -partition partitions, ext3, ext4, xfs, btrfs or f2fs, or squashfs or erofs for a read-only root")
+
+// The filesystems -fs can make.
+var supportedFs = map[string]bool{
+	"ext3":     true,
+	"ext4":     true,
+	"xfs":      true,
+	"btrfs":    true,
+	"f2fs":     true,
+	"squashfs": true,
+	"erofs":    true,
+}
+
+// The filesystems -partition allows besides those -fs does, which can
+// hold data but not a Linux root.
+var dataFs = map[string]bool{
+	"vfat": true,
+	"ntfs": true,
+}
+
+// The smallest filesystems mkfs will make, in MB.
+var fsMinSizes = map[string]uint64{"xfs": 300, "btrfs": 109}
+
+var rootType = flag.String("root-type", "",
+	"Partition type of the root partition, an MBR type byte or, with -dps, a GPT type GUID, rather than the usual one")
+
+var noPartition = flag.Bool("no-partition", false,
+	"Build a bare root filesystem image, without a partition table or bootloader")
+
+func init() {
+	flag.Var(&extraPartitions, "partition",
+		"Additional partition given as MOUNT:SIZE[:FS[:TYPE]] (size in MB), FS being vfat, ntfs or one -fs allows, and TYPE an MBR type byte or, with -dps, a GPT type GUID, may be repeated")
+}
+
+// Layout returns every partition of the image, root first. The root
+// partition takes whatever space the other partitions leave over.
+func Layout() []*Partition {
+	if !supportedFs[*fsType] {
+		Exit(fmt.Sprintf("Unsupported -fs %s", *fsType))
+	}
+	CheckTuning()
+	CheckAlignment()
+	CheckLvm()
+	CheckXen()
+	CheckProfile()
+	CheckRaid()
+	CheckVerity()
+	CheckAb()
+	CheckHybridMbr()
+	CheckAssemble()
+	for _, p := range extraPartitions {
+		if p.Fs == "" {
+			p.Fs = WritableFs()
+		}
+		p.Tune = p.Fs == *fsType
+		if p.Type != "" {
+			p.Type = checkPartitionType(p.Type, p.Mount)
+		} else if p.Fs == "vfat" {
+			p.Type = fatType(p)
+		} else if p.Fs == "ntfs" {
+			p.Type = ntfsType(p)
+		}
+	}
+	if *noPartition {
+		if len(extraPartitions) > 0 || *uefi || *rootType != "" || *swapSize > 0 || *recoverySize > 0 || *infoSize > 0 ||
+			*overlaySize > 0 || *metadataPartition || *dps {
+			Exit("-no-partition images only have a root filesystem")
+		}
+		if *autoSize {
+			*diskSize = AutoRootSize(nil)
+		}
+		parts := []*Partition{{Mount: "/", Size: *diskSize, Fs: *fsType, Label: *fsLabel, Tune: true}}
+		checkMinSizes(parts)
+		checkAssembleFs(parts)
+		CheckMkfsArgs(parts)
+		return parts
+	}
+	// The hash partition goes right after the root, where
+	// HashPartition looks for it.
+	var extras partitionList
+	if *verity {
+		extras = append(extras, VerityPartition())
+	}
+	extras = append(extras, extraPartitions...)
+	if b := ArchBootloader(); b.Partition != nil {
+		if p := b.Partition(); p != nil {
+			extras = append(extras, p)
+		}
+	}
+	if *uefi {
+		extras = append(extras, EspPartition())
+	}
+	if *lvmGroup != "" || *verity || *abRoot || *raidName != "" {
+		if p := SeparateBootPartition(); p != nil {
+			extras = append(extras, p)
+		}
+	}
+	if *swapSize > 0 {
+		extras = append(extras, SwapPartition())
+	} else if *swapFstab {
+		Exit("-swap-fstab needs -swap-size")
+	}
+	if *recoverySize > 0 {
+		extras = append(extras, RecoveryPartition())
+	}
+	if *overlaySize > 0 {
+		extras = append(extras, OverlayPartition())
+	}
+	if *infoSize > 0 {
+		extras = append(extras, InfoPartition())
+	}
+	if *abRoot {
+		extras = append(extras, StatePartition())
+	}
+	if *metadataPartition {
+		extras = append(extras, MetadataPartition())
+	}
+	seen := map[string]bool{"/": true}
+	for _, p := range extras {
+		if p.Mount == "" {
+			continue
+		}
+		if seen[p.Mount] {
+			Exit(fmt.Sprintf("Duplicate partition for %s", p.Mount))
+		}
+		seen[p.Mount] = true
+	}
+	if *autoSize {
+		AutoDiskSize(extras)
+	}
+	size := RootSize(extras)
+	if size == 0 {
+		Exit("Partitions don't fit in the disk image")
+	}
+	root := &Partition{Mount: "/", Size: size, Fs: *fsType, Label: *fsLabel, Tune: true}
+	if *rootType != "" {
+		root.Type = checkPartitionType(*rootType, "/")
+	} else if *raidName != "" {
+		TypeRaidMember(root)
+	}
+	parts := append([]*Partition{root}, extras...)
+	if *lvmGroup != "" {
+		parts = LvmLayout(root, extras)
+	} else if *abRoot {
+		parts = AbLayout(root, extras)
+	}
+	if !*dps && len(TablePartitions(parts)) > 4 {
+		Exit("MBR partition tables support at most 4 partitions")
+	}
+	checkMinSizes(parts)
+	CheckBootFs(parts)
+	checkAssembleFs(parts)
+	CheckMkfsArgs(parts)
+	return parts
+}
+
+func checkMinSizes(parts []*Partition) {
+	for _, p := range parts {
+		if p.Size < fsMinSizes[p.Fs] {
+			Exit(fmt.Sprintf("The %s partition is %d MB, but %s needs at least %d MB",
+				p.Mount, p.Size, p.Fs, fsMinSizes[p.Fs]))
+		}
+	}
+}
+
+// BootPartition returns the partition holding /boot, which is where
+// the bootloader gets installed.
+func BootPartition(parts []*Partition) *Partition {
+	for _, p := range parts {
+		if p.Mount == "/boot" {
+			return p
+		}
+	}
+	return parts[0]
+}
+
+// MountOrder returns the partitions that get mounted, sorted so that
+// each mount point comes after the mount point containing it.
+func MountOrder(parts []*Partition) []*Partition {
+	var sorted []*Partition
+	for _, p := range parts {
+		if p.Mount != "" {
+			sorted = append(sorted, p)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Mount < sorted[j].Mount
+	})
+	return sorted
+}
+
+// The GPT partition type Windows looks for data partitions with.
+const basicDataType = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+
+// FAT32 needs 65525 clusters, so with the smallest clusters, smaller
+// FAT filesystems are left to mkfs.vfat, which makes them FAT16.
+const fat32MinSize = 33
+
+// fatType returns the partition type of a FAT partition p, or "" if
+// it's the usual DPS type for its mount point.
+func fatType(p *Partition) string {
+	if *dps {
+		if _, ok := dpsMountTypes[p.Mount]; ok {
+			return ""
+		}
+		return basicDataType
+	}
+	if p.Size < fat32MinSize {
+		return "0e"
+	}
+	return "0c"
+}
+
+// ntfsType returns the partition type of an NTFS partition p, which is
+// what Windows mounts, or "" on a DPS layout if its mount point has
+// a type of its own.
+func ntfsType(p *Partition) string {
+	if *dps {
+		if _, ok := dpsMountTypes[p.Mount]; ok {
+			return ""
+		}
+		return basicDataType
+	}
+	return "07"
+}
+
+// MountFs returns the type to mount filesystems of type fs with.
+func MountFs(fs string) string {
+	if fs == "ntfs" {
+		// The kernel's own ntfs driver is read-only, or too new to
+		// count on.
+		return "ntfs-3g"
+	}
+	return fs
+}
+
+// MkfsArgs returns the arguments to mkfs to create the filesystem of p,
+// one of parts.
+func MkfsArgs(p *Partition, parts []*Partition) []string {
+	var args []string
+	if p.Fs == "xfs" && !*noPartition && p == BootPartition(parts) {
+		// extlinux can't read the checksummed v5 format mkfs.xfs
+		// makes by default.
+		args = append(args, "-m", "crc=0,finobt=0")
+	}
+	if p.Fs == "vfat" && p.Size >= fat32MinSize {
+		args = append(args, "-F", "32")
+	}
+	if p.Fs == "ntfs" {
+		// Without quick formatting, mkfs.ntfs zeroes the whole
+		// partition first.
+		args = append(args, "-Q")
+	}
+	if p.Label != "" && p.Fs == "vfat" {
+		args = append(args, "-n", p.Label)
+	} else if p.Label != "" && p.Fs == "f2fs" {
+		args = append(args, "-l", p.Label)
+	} else if p.Label != "" {
+		args = append(args, "-L", p.Label)
+	}
+	args = append(args, layoutArgs(p)...)
+	args = append(args, compatArgs(p)...)
+	args = append(args, tuningArgs(p)...)
+	if p.Mount != "" {
+		args = append(args, mkfsArgs[p.Mount]...)
+	}
+	return append(args, p.Device)
+}
+
+// PartitionTable renders the sfdisk script that creates those of parts
+// in the partition table.
+func PartitionTable(parts []*Partition) string {
+	var buf bytes.Buffer
+	boot := BootPartition(parts)
+	parts = TablePartitions(parts)
+	starts := PartitionStarts(parts)
+	if *dps {
+		buf.WriteString("label: gpt\n")
+	} else {
+		buf.WriteString("label: dos\n")
+	}
+	fmt.Fprintf(&buf, "label-id: %s\n", DiskID())
+	for i, p := range parts {
+		fmt.Fprintf(&buf, "start=%d, size=%dMiB, type=%s", starts[i], p.Size, TableType(p))
+		if *dps {
+			fmt.Fprintf(&buf, ", uuid=%s", PartitionUUID(i+1))
+		}
+		if p == boot && *dps {
+			buf.WriteString(`, attrs="LegacyBIOSBootable"`)
+		} else if p == boot {
+			buf.WriteString(", bootable")
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// An MBR partition type byte, in hex.
+var mbrTypePattern = regexp.MustCompile(`^(?:0x)?[0-9a-fA-F]{1,2}$`)
+
+// checkPartitionType checks a partition type given for the partition
+// mounted at mount, which must suit the partition table, and returns it
+// as sfdisk is given it.
+func checkPartitionType(t, mount string) string {
+	if *dps {
+		if !uuidPattern.MatchString(t) {
+			Exit(fmt.Sprintf("Partition type %s for %s isn't a GPT type GUID", t, mount))
+		}
+		return strings.ToUpper(t)
+	}
+	if !mbrTypePattern.MatchString(t) {
+		Exit(fmt.Sprintf("Partition type %s for %s isn't an MBR type byte", t, mount))
+	}
+	n, _ := strconv.ParseUint(strings.TrimPrefix(t, "0x"), 16, 8)
+	if n == 0 {
+		Exit(fmt.Sprintf("Partition type 0 for %s marks it unused", mount))
+	}
+	return fmt.Sprintf("%02x", n)
+}
+
+// TableType returns the partition type p gets in the partition table,
+// a GPT type GUID for -dps layouts and an MBR type byte otherwise.
+func TableType(p *Partition) string {
+	if p.Type != "" {
+		return p.Type
+	}
+	if *dps {
+		return DpsType(p)
+	}
+	return "83"
+}
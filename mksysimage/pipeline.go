@@ -0,0 +1,310 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var compressOutput = flag.String("compress-output", "",
+	"Compress the outputs with gzip, xz or zstd")
+
+var uploadUrl = flag.String("upload-url", "",
+	"Upload each output with an HTTP PUT to this URL followed by its file name, as it's written")
+
+var compressExtensions = map[string]string{
+	"gzip": "gz",
+	"xz":   "xz",
+	"zstd": "zst",
+}
+
+func init() {
+	RegisterCapability("-compress-output", func(plan *BuildPlan) []string {
+		if *compressOutput == "" || *compressOutput == "gzip" {
+			return nil
+		}
+		return []string{*compressOutput}
+	})
+}
+
+// CheckPipeline fails if the output pipeline flags are malformed.
+func CheckPipeline() {
+	if _, ok := compressExtensions[*compressOutput]; *compressOutput != "" && !ok {
+		Exit(fmt.Sprintf("Unknown compression %s, expected gzip, xz or zstd", *compressOutput))
+	}
+	Recipients()
+}
+
+// Streamed reports whether the outputs go through the pipeline in
+// FinishOutput, rather than staying as the converters wrote them.
+func Streamed() bool {
+	return *compressOutput != "" || *encryptOutput != "" || *uploadUrl != ""
+}
+
+// FinalName names the file an output ends up in, once compressed and
+// encrypted.
+func FinalName(file string) string {
+	if *compressOutput != "" {
+		file += "." + compressExtensions[*compressOutput]
+	}
+	if *encryptOutput != "" {
+		file += "." + *encryptOutput
+	}
+	return file
+}
+
+// The checksums of the outputs FinishOutput wrote, by file.
+var outputArtifacts = map[string]Artifact{}
+
+// Hashes of outputs HashInBackground is working on, by final file.
+var pendingArtifacts = map[string]chan artifactResult{}
+
+type artifactResult struct {
+	Artifact Artifact
+	Err      error
+}
+
+// checksumsWanted reports whether anything will ask for the outputs'
+// checksums.
+func checksumsWanted() bool {
+	return *updateMetadata != "" || *notifyUrl != "" || *reportJson != ""
+}
+
+// HashInBackground starts hashing file, an output that will end up as
+// final, while the build goes on, if anything will want its checksum.
+// Hashing one output while the next is converted, or the raw image as
+// it's read for converting, spares a pass over each afterwards. file
+// is opened before returning, so it can be moved to final meanwhile.
+func HashInBackground(file, final, format string) {
+	if !checksumsWanted() || pendingArtifacts[final] != nil {
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	result := make(chan artifactResult, 1)
+	pendingArtifacts[final] = result
+	go func() {
+		defer f.Close()
+		a, err := checksum(f, format)
+		a.File = filepath.Base(final)
+		result <- artifactResult{a, err}
+	}()
+}
+
+// OutputArtifact describes an output in its final form. Streamed
+// outputs were hashed as they were written and others may be being
+// hashed already, so only what's left is read again.
+func OutputArtifact(file, format string) Artifact {
+	if a, ok := outputArtifacts[file]; ok {
+		return a
+	}
+	if pending := pendingArtifacts[file]; pending != nil {
+		r := <-pending
+		if r.Err != nil {
+			Exit(r.Err)
+		}
+		delete(pendingArtifacts, file)
+		outputArtifacts[file] = r.Artifact
+		return r.Artifact
+	}
+	return Checksum(file, format)
+}
+
+// HashedArtifact is OutputArtifact for outputs hashed as they were
+// finished, which it never reads again, as they may be gone by the time
+// the build's over: -benchmark removes them. It returns false for those
+// that weren't finished.
+func HashedArtifact(file string) (Artifact, bool) {
+	if _, ok := outputArtifacts[file]; !ok && pendingArtifacts[file] == nil {
+		return Artifact{}, false
+	}
+	return OutputArtifact(file, ""), true
+}
+
+// FinishOutput puts the output for format, written to src, in place as
+// FinalName(out). The converters need whole files to work with, but
+// from there on, compressing, encrypting, hashing and uploading take
+// one pass over the output, each stage streaming into the next, so
+// large images are read once rather than once per step.
+func FinishOutput(src, out, format string) {
+	if !Streamed() {
+		if src != out {
+			if err := exe.Cmd("mv", "-f", src, out).Run(); err != nil {
+				Exit(err)
+			}
+		}
+		HashInBackground(out, out, format)
+		return
+	}
+	final := FinalName(out)
+	Log(fmt.Sprintf("Writing %s", final))
+	in, err := os.Open(src)
+	if err != nil {
+		Exit(err)
+	}
+	defer in.Close()
+	tmp := final + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		Exit(err)
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	h256, h1, h5 := sha256.New(), sha1.New(), md5.New()
+	hashes := newParallelWriter(h256, h1, h5)
+	defer hashes.Close()
+	sinks := []io.Writer{f, hashes}
+	// Each stage writes into the one after it, and is closed before
+	// it, so whatever it buffered reaches the file.
+	var stages []io.WriteCloser
+	if *uploadUrl != "" && !ChunkedUpload() {
+		upload := newUploadWriter(filepath.Base(final))
+		stages = append(stages, upload)
+		sinks = append(sinks, upload)
+	}
+	var w io.Writer = io.MultiWriter(sinks...)
+	if *encryptOutput != "" {
+		ew := encryptWriter(w)
+		stages = append(stages, ew)
+		w = ew
+	}
+	if *compressOutput != "" {
+		cw := compressWriter(w)
+		stages = append(stages, cw)
+		w = cw
+	}
+	_, err = io.Copy(w, in)
+	for i := len(stages) - 1; i >= 0; i-- {
+		if cerr := stages[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		Exit(errors.New(fmt.Sprintf("Writing %s: %s", final, err)))
+	}
+	if err = os.Rename(tmp, final); err != nil {
+		Exit(err)
+	}
+	if ChunkedUpload() {
+		UploadChunks(final)
+	}
+	st, err := os.Stat(final)
+	if err != nil {
+		Exit(err)
+	}
+	outputArtifacts[final] = Artifact{
+		File:   filepath.Base(final),
+		Format: format,
+		Size:   st.Size(),
+		Sha256: hex.EncodeToString(h256.Sum(nil)),
+		Sha1:   hex.EncodeToString(h1.Sum(nil)),
+		Md5:    hex.EncodeToString(h5.Sum(nil)),
+	}
+	if src != final {
+		if err = os.Remove(src); err != nil {
+			Exit(err)
+		}
+	}
+}
+
+// A filterWriter pipes what's written to it through a program, whose
+// output goes on to the next stage.
+type filterWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func newFilterWriter(w io.Writer, program string, args ...string) *filterWriter {
+	cmd := exe.Heavy(program, args...)
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		Exit(err)
+	}
+	if err = cmd.Start(); err != nil {
+		Exit(err)
+	}
+	return &filterWriter{stdin, cmd}
+}
+
+func (f *filterWriter) Close() error {
+	err := f.WriteCloser.Close()
+	if werr := f.cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func compressWriter(w io.Writer) io.WriteCloser {
+	switch *compressOutput {
+	case "gzip":
+		return gzip.NewWriter(w)
+	case "xz":
+		return newFilterWriter(w, "xz", "-c", "-T0")
+	}
+	return newFilterWriter(w, "zstd", "-c", "-q", "-T0")
+}
+
+func encryptWriter(w io.Writer) io.WriteCloser {
+	var args []string
+	for _, r := range Recipients() {
+		args = append(args, "-r", r)
+	}
+	if *encryptOutput == "gpg" {
+		args = append([]string{"--batch", "--trust-model", "always", "-e"}, args...)
+	}
+	return newFilterWriter(w, *encryptOutput, args...)
+}
+
+// An uploadWriter streams what's written to it as the body of a PUT.
+type uploadWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func newUploadWriter(name string) *uploadWriter {
+	r, w := io.Pipe()
+	u := &uploadWriter{w, make(chan error, 1)}
+	url := strings.TrimSuffix(*uploadUrl, "/") + "/" + name
+	go func() {
+		req, err := http.NewRequest("PUT", url, r)
+		if err != nil {
+			r.CloseWithError(err)
+			u.done <- err
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = errors.New(fmt.Sprintf("%s answered %s", url, resp.Status))
+			}
+		}
+		// Stop the writes if the server gave up early.
+		r.CloseWithError(err)
+		u.done <- err
+	}()
+	return u
+}
+
+func (u *uploadWriter) Close() error {
+	u.PipeWriter.Close()
+	return <-u.done
+}
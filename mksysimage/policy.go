@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var policyFile = flag.String("policy", "",
+	"Policy file for the audit command to check the image against")
+
+func init() {
+	subcommands["audit"] = AuditCommand
+}
+
+// The allowed number of arguments for each policy rule.
+var ruleArgs = map[string][2]int{
+	"no-world-writable": {0, 64}, // no-world-writable [EXCEPT-GLOB...]
+	"kernel-min":        {1, 1},  // kernel-min VERSION
+	"absent":            {1, 1},  // absent GLOB
+	"package-absent":    {1, 1},  // package-absent NAME
+}
+
+// ReadPolicy reads a policy file. Like a manifest, it has one rule per
+// line, a name followed by whitespace separated arguments.
+func ReadPolicy(file string) []*Directive {
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+
+	var rules []*Directive
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		d := &Directive{fmt.Sprintf("%s:%d", file, line), fields[0], fields[1:]}
+		limits, ok := ruleArgs[d.Name]
+		if !ok {
+			d.Fail(fmt.Sprintf("Unknown rule %s", d.Name))
+		}
+		if len(d.Args) < limits[0] || len(d.Args) > limits[1] {
+			d.Fail(fmt.Sprintf("Wrong number of arguments to %s", d.Name))
+		}
+		rules = append(rules, d)
+	}
+	if err = scanner.Err(); err != nil {
+		Exit(err)
+	}
+	return rules
+}
+
+// AuditCommand checks a built image against -policy, printing a line
+// for each rule and failing if any is violated.
+func AuditCommand(args []string) {
+	if len(args) != 1 || *policyFile == "" {
+		Exit("Usage: audit image -policy file")
+	}
+	rules := ReadPolicy(*policyFile)
+	mountpoint, detach := MountImage(args[0], false)
+	defer detach()
+
+	failed := 0
+	for _, rule := range rules {
+		violations := rule.Check(mountpoint)
+		name := strings.Join(append([]string{rule.Name}, rule.Args...), " ")
+		if len(violations) == 0 {
+			fmt.Printf("PASS %s\n", name)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s\n", name)
+		for _, v := range violations {
+			fmt.Printf("    %s\n", v)
+		}
+	}
+	if failed > 0 {
+		Exit(fmt.Sprintf("%d of %d policy rules violated", failed, len(rules)))
+	}
+}
+
+// Check returns the ways the image mounted at mountpoint violates the
+// rule, if any.
+func (d *Directive) Check(mountpoint string) []string {
+	var violations []string
+	switch d.Name {
+	case "no-world-writable":
+		err := filepath.Walk(mountpoint, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel := "/" + strings.TrimPrefix(file[len(mountpoint):], "/")
+			mode := info.Mode()
+			if mode&os.ModeSymlink != 0 || mode&0002 == 0 ||
+				(mode.IsDir() && mode&os.ModeSticky != 0) {
+				return nil
+			}
+			for _, except := range d.Args {
+				if ok, _ := filepath.Match(except, rel); ok {
+					return nil
+				}
+			}
+			violations = append(violations, fmt.Sprintf("%s is world writable", rel))
+			return nil
+		})
+		if err != nil {
+			Exit(err)
+		}
+	case "kernel-min":
+		kernels := FindKernels(path.Join(mountpoint, "boot"))
+		if len(kernels) == 0 {
+			violations = append(violations, "no /boot/vmlinuz-VERSION kernel to check")
+		}
+		for _, k := range kernels {
+			if compareVersions(kernelVersion(k.Kernel), d.Args[0]) < 0 {
+				violations = append(violations, fmt.Sprintf("/boot/%s is older", k.Kernel))
+			}
+		}
+	case "absent":
+		matches, err := filepath.Glob(path.Join(mountpoint, d.Args[0]))
+		if err != nil {
+			d.Fail(fmt.Sprintf("Bad pattern %s", d.Args[0]))
+		}
+		for _, m := range matches {
+			violations = append(violations, fmt.Sprintf("%s is present", m[len(mountpoint):]))
+		}
+	case "package-absent":
+		installed, ok := InstalledPackages(mountpoint)
+		if !ok {
+			violations = append(violations, "no dpkg or apk package database to check")
+		} else if installed[d.Args[0]] {
+			violations = append(violations, fmt.Sprintf("package %s is installed", d.Args[0]))
+		}
+	}
+	return violations
+}
+
+// InstalledPackages reads the dpkg or apk database of the image, if it
+// has one.
+func InstalledPackages(mountpoint string) (map[string]bool, bool) {
+	installed := map[string]bool{}
+	if data, err := ioutil.ReadFile(path.Join(mountpoint, "var/lib/dpkg/status")); err == nil {
+		for _, stanza := range strings.Split(string(data), "\n\n") {
+			var name string
+			ok := false
+			for _, line := range strings.Split(stanza, "\n") {
+				if strings.HasPrefix(line, "Package: ") {
+					name = strings.TrimPrefix(line, "Package: ")
+				} else if strings.HasPrefix(line, "Status: ") {
+					ok = strings.HasSuffix(line, " installed")
+				}
+			}
+			if name != "" && ok {
+				installed[name] = true
+			}
+		}
+		return installed, true
+	}
+	if data, err := ioutil.ReadFile(path.Join(mountpoint, "lib/apk/db/installed")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "P:") {
+				installed[line[2:]] = true
+			}
+		}
+		return installed, true
+	}
+	return nil, false
+}
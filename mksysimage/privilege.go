@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var useSudo = flag.Bool("sudo", false,
+	"Run unprivileged, using -sudo-cmd for the steps that need root")
+
+var sudoCmd = flag.String("sudo-cmd", "sudo -n",
+	"Command prefix used to run privileged steps with -sudo")
+
+var printSudoers = flag.Bool("print-sudoers", false,
+	"Print a sudoers snippet allowing the commands -sudo runs, then exit")
+
+// The programs -sudo runs with privileges in every build, besides those
+// the features it uses register as privileged capabilities.
+var privilegedPrograms = []string{
+	"chmod",
+	"chown",
+	"cp",
+	"dd",
+	"find",
+	"install",
+	"ln",
+	"mkdir",
+	"mknod",
+	"mount",
+	"rm",
+	"rsync",
+	"tar",
+	"touch",
+	"umount",
+	"unshare",
+}
+
+// Priv is like Cmd, but for commands that need root. With -sudo they
+// get run through -sudo-cmd.
+func (l *LoggingExec) Priv(cmd string, args ...string) *exec.Cmd {
+	if *useSudo {
+		sudo := strings.Fields(*sudoCmd)
+		args = append(append(sudo[1:], cmd), args...)
+		cmd = sudo[0]
+	}
+	return l.Cmd(cmd, args...)
+}
+
+// HeavyPriv is Heavy for commands that also need root.
+func (l *LoggingExec) HeavyPriv(cmd string, args ...string) *exec.Cmd {
+	cmd, args = throttle(cmd, args)
+	return l.Priv(cmd, args...)
+}
+
+// PrintSudoers writes a sudoers snippet granting the invoking user the
+// programs -sudo needs to carry out plan.
+func PrintSudoers(plan *BuildPlan) {
+	programs := append(append([]string{}, privilegedPrograms...), plan.PrivilegedPrograms()...)
+	var paths []string
+	seen := map[string]bool{}
+	for _, program := range programs {
+		path, err := exec.LookPath(program)
+		if err != nil {
+			Exit(fmt.Sprintf("Couldn't find program: %s", program))
+		}
+		if !seen[path] {
+			paths = append(paths, path)
+			seen[path] = true
+		}
+	}
+	name := "USER"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	fmt.Printf(`# Privileged commands run by mksysimage -sudo. Several of these (cp,
+# dd, tar, rsync, install) can overwrite any file, so this grant is
+# root-equivalent: give it only to trusted build accounts.
+%s ALL=(root) NOPASSWD: %s
+# mke2fs is pointed at the pinned configuration, and everything at the
+# build's clock, through the environment.
+Defaults:%s env_keep += "MKE2FS_CONFIG TZ SOURCE_DATE_EPOCH E2FSPROGS_FAKE_TIME"
+`, name, strings.Join(paths, ", "), name)
+}
+
+// The Image* functions change files inside the mounted image, which is
+// owned by root. Without -sudo they are plain system calls.
+
+func ImageMkdirAll(dir string, mode os.FileMode) error {
+	if !*useSudo {
+		return os.MkdirAll(dir, mode)
+	}
+	return exe.Priv("mkdir", "-p", "-m", fmt.Sprintf("%o", mode), dir).Run()
+}
+
+func ImageWriteFile(file string, data []byte, mode os.FileMode) error {
+	if !*useSudo {
+		return ioutil.WriteFile(file, data, mode)
+	}
+	tmp, err := ioutil.TempFile(runDir, "file")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return exe.Priv("install", "-m", fmt.Sprintf("%o", mode), tmp.Name(), file).Run()
+}
+
+func ImageSymlink(target, link string) error {
+	if !*useSudo {
+		return os.Symlink(target, link)
+	}
+	return exe.Priv("ln", "-s", target, link).Run()
+}
+
+func ImageRemove(file string) error {
+	if !*useSudo {
+		return os.Remove(file)
+	}
+	return exe.Priv("rm", "-f", file).Run()
+}
+
+// ImageChmod sets all mode bits, including setuid, setgid and sticky,
+// which os.Chmod would drop.
+func ImageChmod(file string, mode uint32) error {
+	if !*useSudo {
+		return syscall.Chmod(file, mode)
+	}
+	return exe.Priv("chmod", fmt.Sprintf("%o", mode), file).Run()
+}
+
+func ImageLchown(file string, uid, gid int) error {
+	if !*useSudo {
+		return os.Lchown(file, uid, gid)
+	}
+	owner := fmt.Sprint(uid)
+	if gid >= 0 {
+		owner += fmt.Sprintf(":%d", gid)
+	}
+	return exe.Priv("chown", "-h", owner, file).Run()
+}
+
+func ImageMknod(file string, mode uint32, major, minor uint64) error {
+	if !*useSudo {
+		return syscall.Mknod(file, mode, mkdev(major, minor))
+	}
+	var kind string
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		kind = "c"
+	case syscall.S_IFBLK:
+		kind = "b"
+	case syscall.S_IFIFO:
+		return exe.Priv("mknod", "-m", fmt.Sprintf("%o", mode&07777), file, "p").Run()
+	}
+	return exe.Priv("mknod", "-m", fmt.Sprintf("%o", mode&07777), file, kind,
+		fmt.Sprint(major), fmt.Sprint(minor)).Run()
+}
+
+// The image's directories may be readable only by root, as /boot is.
+// The functions below read them directly when they can, and with -sudo,
+// through find run as root when they can't.
+
+// imageFind runs find as root with args, returning the NUL-terminated
+// records its -printf writes.
+func imageFind(args ...string) ([]string, error) {
+	cmd := exe.Priv("find", args...)
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	records := strings.Split(buf.String(), "\x00")
+	return records[:len(records)-1], nil
+}
+
+// ImageReadDir returns the names in dir, sorted.
+func ImageReadDir(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && *useSudo && os.IsPermission(err) {
+		names, err := imageFind("-H", dir, "-mindepth", "1", "-maxdepth", "1", "-printf", `%f\0`)
+		sort.Strings(names)
+		return names, err
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, err
+}
+
+// ImageReadlink returns the target of file if it's a symlink, and ""
+// if it's anything else.
+func ImageReadlink(file string) (string, error) {
+	st, err := os.Lstat(file)
+	if err != nil && *useSudo && os.IsPermission(err) {
+		records, err := imageFind("-P", file, "-maxdepth", "0", "-printf", `%y%l\0`)
+		if err != nil || len(records) != 1 || records[0][0] != 'l' {
+			return "", err
+		}
+		return records[0][1:], nil
+	}
+	if err != nil || st.Mode()&os.ModeSymlink == 0 {
+		return "", err
+	}
+	return os.Readlink(file)
+}
+
+// ImageGlob is filepath.Glob for patterns relative to mountpoint.
+func ImageGlob(mountpoint, pattern string) ([]string, error) {
+	if !*useSudo {
+		return filepath.Glob(filepath.Join(mountpoint, pattern))
+	}
+	matches := []string{mountpoint}
+	for _, c := range strings.Split(pattern, "/") {
+		if c == "" || c == "." {
+			continue
+		}
+		var next []string
+		for _, dir := range matches {
+			// Whatever isn't a directory has nothing to match.
+			names, _ := ImageReadDir(dir)
+			for _, name := range names {
+				ok, err := filepath.Match(c, name)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					next = append(next, filepath.Join(dir, name))
+				}
+			}
+		}
+		matches = next
+	}
+	return matches, nil
+}
+
+// An ImageFile is one of the files ImageWalk goes through.
+type ImageFile struct {
+	Path   string
+	Dev    uint64
+	Ino    uint64
+	Blocks uint64 // Of 512 bytes
+}
+
+// ImageWalk calls fn for each file under start that isn't a directory,
+// leaving out the directories below start that skip reports true for.
+// With -sudo, the whole tree is listed by one find, as any of it may
+// be readable only by root.
+func ImageWalk(start string, skip func(dir string) bool, fn func(f ImageFile)) error {
+	if !*useSudo {
+		return filepath.Walk(start, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if file != start && skip(file) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			st := info.Sys().(*syscall.Stat_t)
+			fn(ImageFile{file, uint64(st.Dev), st.Ino, uint64(st.Blocks)})
+			return nil
+		})
+	}
+	records, err := imageFind("-P", start, "-printf", `%D %i %b %y %p\0`)
+	if err != nil {
+		return err
+	}
+	// find lists each directory before what's in it.
+	var skipped []string
+	for _, record := range records {
+		fields := strings.SplitN(record, " ", 5)
+		if len(fields) != 5 {
+			return errors.New(fmt.Sprintf("Unexpected output from find: %q", record))
+		}
+		file := fields[4]
+		inSkipped := false
+		for _, dir := range skipped {
+			if strings.HasPrefix(file, dir+"/") {
+				inSkipped = true
+				break
+			}
+		}
+		switch {
+		case inSkipped:
+		case fields[3] == "d":
+			if file != start && skip(file) {
+				skipped = append(skipped, file)
+			}
+		default:
+			var f ImageFile
+			f.Path = file
+			f.Dev, _ = strconv.ParseUint(fields[0], 10, 64)
+			f.Ino, _ = strconv.ParseUint(fields[1], 10, 64)
+			f.Blocks, _ = strconv.ParseUint(fields[2], 10, 64)
+			fn(f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"time"
+)
+
+var quick = flag.Bool("quick", false,
+	"Build a scratch raw image for smoke tests, from the local sources only, without conversion, the output pipeline, reports or optional checks")
+
+// A quick build taking longer than this is too slow for presubmit.
+const quickBudget = time.Minute
+
+// The kernel quick builds boot when the local sources have none.
+const quickKernel = "vmlinuz-0-quick"
+
+// QuickFormats cuts the outputs down for -quick: formats become raw,
+// unless it's an initramfs, and the flags for outputs besides the image
+// are cleared. The manifest's directives, the layout and the
+// bootloader's configuration are kept, since regressions in those are
+// what quick builds are for.
+func QuickFormats(formats []string) []string {
+	if !*quick {
+		return formats
+	}
+	*compressOutput, *encryptOutput, *uploadUrl = "", "", ""
+	*notifyUrl, *updateMetadata, *flashDescriptors, *sizeReportJson = "", "", "", ""
+	*exportPartitions, *sizeReport, *keepOutputs = false, 0, 0
+	if formats[0] == "initramfs" {
+		return formats
+	}
+	return []string{"raw"}
+}
+
+// QuickSources skips the remote sources for -quick, which take the
+// longest to fetch.
+func QuickSources(sources []Source) []Source {
+	if !*quick {
+		return sources
+	}
+	var local []Source
+	for _, s := range sources {
+		if _, ok := s.(*httpSource); ok {
+			Log(fmt.Sprintf("Skipping remote source %s", s))
+			continue
+		}
+		local = append(local, s)
+	}
+	return local
+}
+
+// QuickKernels stands in an empty kernel in boot for the kernel the
+// remote sources would have provided, so the bootloader still gets
+// configured.
+func QuickKernels(boot string) []BootKernel {
+	Log(fmt.Sprintf("Warning: no kernel in /boot, booting an empty %s", quickKernel))
+	if err := ImageWriteFile(path.Join(boot, quickKernel), nil, 0644); err != nil {
+		Exit(err)
+	}
+	return []BootKernel{{Kernel: quickKernel}}
+}
+
+// StartQuick starts timing a -quick build. Calling the returned function
+// warns if it went over budget.
+func StartQuick() func() {
+	start := time.Now()
+	return func() {
+		if took := time.Since(start); took > quickBudget {
+			Log(fmt.Sprintf("Warning: the quick build took %s, over its %s budget", took.Round(time.Second), quickBudget))
+		}
+	}
+}
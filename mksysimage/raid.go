@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var raidName = flag.String("raid", "",
+	"Name of an mdadm RAID1 array to put the root filesystem on, made degraded with the root partition as its only member, for a second disk to join once deployed")
+
+func init() {
+	RegisterPrivilegedCapability("-raid", func(plan *BuildPlan) []string {
+		if *raidName == "" || plan.Parts == nil {
+			return nil
+		}
+		return []string{"mdadm"}
+	})
+}
+
+// The partition types of an mdadm array member.
+const (
+	raidType    = "fd"
+	raidGptType = "A19D880F-05FC-4D3B-A006-743F0F84911E"
+)
+
+// The names mdadm allows for arrays under /dev/md.
+var raidNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.][A-Za-z0-9_.-]*$`)
+
+// The array's UUID, picked up front like the partition table's.
+var raidUUID string
+
+// CheckRaid checks -raid, and points the kernel at the array unless
+// -kernel-args says otherwise, telling dracut which array to assemble.
+func CheckRaid() {
+	if *raidName == "" {
+		return
+	}
+	switch {
+	case !raidNamePattern.MatchString(*raidName):
+		Exit(fmt.Sprintf("Bad -raid array name %s", *raidName))
+	case *noPartition:
+		Exit("-raid needs a partition table")
+	case *lvmGroup != "":
+		Exit("-raid can't be used with -lvm")
+	case *repart:
+		Exit("systemd-repart can't grow a -raid array, so -repart can't be used with it")
+	case *rootType != "":
+		Exit("-root-type can't be used with -raid, whose root partition is an array member")
+	case *verity:
+		Exit("-raid can't be used with -verity")
+	case *abRoot:
+		Exit("-raid can't be used with -ab")
+	case *assemble:
+		Exit("-assemble can't make -raid arrays without device mapper")
+	}
+	raidUUID = pickUUID("raid array")
+	if !FlagSet("kernel-args") {
+		*kernelArgs = SetRootArg(*kernelArgs, RaidDevice())
+		*kernelArgs += " rd.md.uuid=" + mdadmUUID(raidUUID)
+	}
+}
+
+// RaidDevice returns the device of the -raid array.
+func RaidDevice() string {
+	return "/dev/md/" + *raidName
+}
+
+// ownArray reports whether the members of array are all partitions of
+// the loop devices in maps that own says are still a crashed run's, so
+// that recovery doesn't stop an array of the host's that has taken its
+// name since.
+func ownArray(array string, maps []string, own map[string]bool) bool {
+	dev, err := filepath.EvalSymlinks(array)
+	if err != nil {
+		return false
+	}
+	members, err := ioutil.ReadDir(filepath.Join("/sys/block", filepath.Base(dev), "slaves"))
+	if err != nil || len(members) == 0 {
+		return false
+	}
+	for _, m := range members {
+		// kpartx's mappings are device mapper devices, named after
+		// the loop device and the partition's number.
+		name, err := ioutil.ReadFile(filepath.Join("/sys/block", m.Name(), "dm/name"))
+		if err != nil || !isLoopPartition(strings.TrimSpace(string(name)), maps, own) {
+			return false
+		}
+	}
+	return true
+}
+
+// isLoopPartition reports whether name is a partition mapping of one of
+// the loop devices in maps that own says are a crashed run's.
+func isLoopPartition(name string, maps []string, own map[string]bool) bool {
+	for _, device := range maps {
+		n := strings.TrimPrefix(name, path.Base(device)+"p")
+		if own[device] && n != name && n != "" && strings.Trim(n, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// mdadmUUID formats a UUID as mdadm writes them, in four groups of
+// eight hex digits.
+func mdadmUUID(uuid string) string {
+	hex := strings.Replace(uuid, "-", "", -1)
+	return strings.Join([]string{hex[0:8], hex[8:16], hex[16:24], hex[24:32]}, ":")
+}
+
+// TypeRaidMember types the root partition of a -raid layout as the
+// array's member.
+func TypeRaidMember(root *Partition) {
+	root.Type = raidType
+	if *dps {
+		root.Type = raidGptType
+	}
+}
+
+// CreateArray makes the -raid array on the root partition, the first
+// of parts, which has its device once the image is attached, and
+// moves the root onto it. The second member is missing, so the array
+// starts degraded. The returned function stops it.
+func CreateArray(parts []*Partition) func() {
+	root := parts[0]
+	if _, err := os.Stat(RaidDevice()); err == nil {
+		Exit(fmt.Sprintf("This host already has an array %s", RaidDevice()))
+	}
+	Log(fmt.Sprintf("Creating RAID1 array %s", *raidName))
+	// --homehost=any, since the array belongs to whichever host the
+	// image is deployed to, not this one.
+	err := exe.Priv("mdadm", "--create", RaidDevice(), "--run", "--level=1", "--raid-devices=2",
+		"--metadata=1.2", "--homehost=any", "--name="+*raidName, "--uuid="+mdadmUUID(raidUUID),
+		root.Device, "missing").Run()
+	Audit("mdadm-create", RaidDevice(), root.Device, err)
+	if err != nil {
+		Exit(err)
+	}
+	Track(&runState.Arrays, RaidDevice())
+	root.Device = RaidDevice()
+	return func() {
+		Log(fmt.Sprintf("Stopping array %s", *raidName))
+		err := exe.Priv("mdadm", "--stop", RaidDevice()).Run()
+		Audit("mdadm-stop", RaidDevice(), "", err)
+		if err == nil {
+			Untrack(&runState.Arrays, RaidDevice())
+		}
+	}
+}
+
+// RaidDataOffset returns the sector the array's data starts at within
+// its member, which starts at sector start of image, as the version 1.2
+// superblock 4 KiB into the member records it.
+func RaidDataOffset(image string, start uint64) uint64 {
+	f, err := os.Open(image)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	sb := make([]byte, 256)
+	if _, err = f.ReadAt(sb, int64(start)*512+4096); err != nil {
+		Exit(err)
+	}
+	if binary.LittleEndian.Uint32(sb) != 0xa92b4efc {
+		Exit(fmt.Sprintf("No mdadm superblock at sector %d of %s", start, image))
+	}
+	return binary.LittleEndian.Uint64(sb[128:])
+}
+
+// InstallRaidConfig lists the -raid array in the mdadm.conf of the
+// image mounted at mountpoint, and has the initramfs generators the
+// image has assemble it, even degraded, as the image first boots with
+// just the one member. The initrd has to be built with them to boot.
+func InstallRaidConfig(mountpoint string) {
+	if *raidName == "" {
+		return
+	}
+	Log(fmt.Sprintf("Configuring mdadm for array %s", *raidName))
+	conf := path.Join(mountpoint, "etc/mdadm.conf")
+	if _, err := os.Stat(path.Join(mountpoint, "etc/mdadm")); err == nil {
+		conf = path.Join(mountpoint, "etc/mdadm/mdadm.conf")
+	}
+	line := fmt.Sprintf("ARRAY %s metadata=1.2 UUID=%s\n", RaidDevice(), mdadmUUID(raidUUID))
+	data, err := ioutil.ReadFile(conf)
+	if err != nil && !os.IsNotExist(err) {
+		Exit(err)
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	if err = ImageWriteFile(conf, append(data, line...), 0644); err != nil {
+		Exit(err)
+	}
+
+	hooks := [][3]string{
+		{"etc/initramfs-tools", "etc/initramfs-tools/conf.d/mdadm", "BOOT_DEGRADED=true\n"},
+		{"etc/dracut.conf.d", "etc/dracut.conf.d/90-mdraid.conf", "add_dracutmodules+=\" mdraid \"\nmdadmconf=\"yes\"\n"},
+	}
+	found := false
+	for _, h := range hooks {
+		if _, err := os.Stat(path.Join(mountpoint, h[0])); err != nil {
+			continue
+		}
+		found = true
+		file := path.Join(mountpoint, h[1])
+		if err := ImageMkdirAll(path.Dir(file), 0755); err != nil {
+			Exit(err)
+		}
+		if err := ImageWriteFile(file, []byte(h[2]), 0644); err != nil {
+			Exit(err)
+		}
+	}
+	if !found {
+		Log("Warning: the image has neither initramfs-tools nor dracut to assemble the -raid array with")
+	}
+	if !imageHasProgram(mountpoint, "mdadm") {
+		Log("Warning: the image has no mdadm to assemble the -raid array with")
+	}
+}
+
+// imageHasProgram reports whether the image mounted at mountpoint has
+// program in one of the usual sbin directories.
+func imageHasProgram(mountpoint, program string) bool {
+	for _, dir := range []string{"sbin", "usr/sbin", "bin", "usr/bin"} {
+		if _, err := os.Lstat(path.Join(mountpoint, dir, program)); err == nil {
+			return true
+		}
+	}
+	return false
+}
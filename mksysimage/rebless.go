@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+func init() {
+	subcommands["rebless"] = ReblessCommand
+}
+
+// ReblessCommand rewrites the boot menu of a built image and
+// reinstalls extlinux, leaving everything but /boot alone. The kernels
+// stay the ones the image boots now; -kernel-args and the entry lines
+// of -manifest give the new menu. syslinux.efi's menu on the ESP of a
+// -uefi image is rewritten too. Images with a squashfs or erofs root, as
+// -verity has, are refused, since their root can't be mounted to write.
+func ReblessCommand(args []string) {
+	if len(args) != 1 {
+		Exit("Usage: rebless image [-kernel-args args] [-manifest file]")
+	}
+	var manifest Manifest
+	if *manifestFile != "" {
+		manifest = *ReadManifest(*manifestFile)
+	}
+	CheckKernelArgs(&manifest)
+	CheckBranding()
+	if ArchBootloader().Name != "extlinux" {
+		Exit(fmt.Sprintf("rebless only handles extlinux images, and %s images boot with %s",
+			*arch, ArchBootloader().Name))
+	}
+	CheckPrograms(Requirements{}.Need("rebless", "kpartx", "losetup", "mount", "sfdisk", "umount", *extlinuxBin))
+
+	mountpoint, detach := MountImage(args[0], true)
+	defer detach()
+	boot := path.Join(mountpoint, "boot")
+	kernels, recovery := readSyslinuxConfig(path.Join(boot, "syslinux.cfg"))
+	if len(kernels) == 0 {
+		Exit(fmt.Sprintf("%s boots no kernels to rebless", args[0]))
+	}
+
+	entries := BootEntries(kernels, &manifest)
+	if recovery && *recoverySize == 0 {
+		entries = append(entries, RecoveryEntry(kernels[0]))
+	}
+	Log(fmt.Sprintf("Reinstalling extlinux for %s", kernels[0].Kernel))
+	installExtlinuxEntries(boot, entries)
+	esp := path.Join(mountpoint, espMount, "EFI/BOOT")
+	if _, err := os.Stat(path.Join(esp, "syslinux.cfg")); err == nil {
+		Log("Rewriting the EFI System Partition's boot menu")
+		WriteEfiMenu(esp, entries)
+	}
+}
+
+// readSyslinuxConfig returns the kernels a syslinux.cfg written by
+// SyslinuxConfig boots, in order, and whether it has a recovery entry.
+func readSyslinuxConfig(file string) (kernels []BootKernel, recovery bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	var label string
+	var entry *BootKernel
+	done := func() {
+		if entry == nil {
+			return
+		}
+		if label == "recovery" {
+			recovery = true
+		} else if !containsKernel(kernels, *entry) {
+			kernels = append(kernels, *entry)
+		}
+		entry = nil
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "LABEL":
+			done()
+			label, entry = fields[1], &BootKernel{}
+		case "LINUX", "KERNEL":
+			if entry != nil {
+				entry.Kernel = fields[1]
+			}
+		case "INITRD":
+			if entry != nil {
+				entry.Initrd = fields[1]
+			}
+		}
+	}
+	done()
+	if err = scanner.Err(); err != nil {
+		Exit(err)
+	}
+	return kernels, recovery
+}
+
+func containsKernel(kernels []BootKernel, k BootKernel) bool {
+	for _, x := range kernels {
+		if x == k {
+			return true
+		}
+	}
+	return false
+}
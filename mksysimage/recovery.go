@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+)
+
+var recoverySize = flag.Uint64("recovery-size", 0,
+	"Size in MB of a recovery partition holding a copy of the root filesystem for factory resets, 0 for none")
+
+const (
+	recoveryLabel   = "recovery"
+	recoveryArchive = "rootfs.tar.gz"
+	recoveryScript  = "/usr/lib/mksysimage/factory-reset"
+)
+
+func init() {
+	RegisterPrivilegedCapability("-recovery-size", func(plan *BuildPlan) []string {
+		if *recoverySize == 0 || plan.Parts == nil {
+			return nil
+		}
+		return []string{"tar"}
+	})
+}
+
+// The recovery boot entry runs this as init. It puts the root
+// filesystem back the way it was built: files from the archive are
+// restored, and anything else is removed. Other partitions are left
+// alone.
+const factoryResetScript = `#!/bin/sh
+export PATH=/usr/sbin:/usr/bin:/sbin:/bin
+mount -t proc proc /proc
+mount -t tmpfs tmpfs /tmp
+mount -o remount,rw / &&
+mount -o ro LABEL=%[1]s /recovery || {
+	echo "Factory reset failed, starting a shell"
+	exec sh
+}
+echo "Restoring the root filesystem"
+tar -C / --numeric-owner --overwrite -xzpf /recovery/%[2]s
+tar -tzf /recovery/%[2]s | sed -e 's|^\./||' -e 's|/$||' | sort > /tmp/restored
+cd / && find . -xdev | sed -e 's|^\./||' | sort | comm -13 /tmp/restored - |
+while read -r file; do
+	if [ -e "/$file" ] && ! mountpoint -q "/$file"; then
+		rm -rf "/$file"
+	fi
+done
+umount /recovery
+sync
+echo "Factory reset complete, rebooting"
+echo b > /proc/sysrq-trigger
+`
+
+// RecoveryPartition returns the partition -recovery-size adds to the
+// layout.
+func RecoveryPartition() *Partition {
+	return &Partition{Mount: "/recovery", Size: *recoverySize, Fs: WritableFs(), Label: recoveryLabel}
+}
+
+// RecoveryEntry returns the boot entry that restores the root
+// filesystem of kernel.
+func RecoveryEntry(kernel BootKernel) BootEntry {
+	return BootEntry{"recovery", kernel.Kernel, kernel.Initrd,
+		fmt.Sprintf("%s ro init=%s", *kernelArgs, recoveryScript)}
+}
+
+// InstallRecoveryScript puts the script the recovery boot entry runs
+// into the image. It has to happen before WriteRecoveryArchive, so that
+// the script survives a reset.
+func InstallRecoveryScript(mountpoint string) {
+	script := path.Join(mountpoint, recoveryScript)
+	if err := ImageMkdirAll(path.Dir(script), 0755); err != nil {
+		Exit(err)
+	}
+	data := fmt.Sprintf(factoryResetScript, recoveryLabel, recoveryArchive)
+	if err := ImageWriteFile(script, []byte(data), 0755); err != nil {
+		Exit(err)
+	}
+}
+
+// WriteRecoveryArchive stores a copy of the root filesystem, as
+// populated, in the recovery partition.
+func WriteRecoveryArchive(mountpoint string) {
+	archive := path.Join(mountpoint, "recovery", recoveryArchive)
+	err := exe.HeavyPriv("tar", "-C", mountpoint, "--one-file-system",
+		"--numeric-owner", "-czpf", archive, ".").Run()
+	Audit("recovery-archive", archive, "", err)
+	if err != nil {
+		Exit(err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var layoutSeed = flag.String("layout-seed", "",
+	"Derive filesystem UUIDs and directory hash seeds from this, so builds from similar sources lay out their blocks alike")
+
+// SourceDateEpoch returns the time the SOURCE_DATE_EPOCH environment
+// variable gives, in seconds since 1970, if it's set. Reproducible
+// builds set it to the time of the last change to the sources.
+func SourceDateEpoch() (time.Time, bool) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || secs < 0 {
+		Exit(fmt.Sprintf("Malformed SOURCE_DATE_EPOCH %s", value))
+	}
+	return time.Unix(secs, 0).UTC(), true
+}
+
+// SeededUUID derives a random-looking but repeatable UUID for purpose
+// from -layout-seed.
+func SeededUUID(purpose string) string {
+	sum := sha256.Sum256([]byte(*layoutSeed + "\x00" + purpose))
+	return formatUUID(sum[:16])
+}
+
+// formatUUID formats 16 random bytes as a version 4 UUID.
+func formatUUID(b []byte) string {
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// randomUUID makes up a version 4 UUID.
+func randomUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		Exit(err)
+	}
+	return formatUUID(b)
+}
+
+// The identifiers of the partition table, picked up front so that
+// PARTUUIDs are known before the image is built.
+var (
+	diskID  string
+	partIDs = map[int]string{}
+)
+
+// pickUUID returns a UUID for purpose, derived from -layout-seed if
+// it's given and random otherwise.
+func pickUUID(purpose string) string {
+	if *layoutSeed != "" {
+		return SeededUUID(purpose)
+	}
+	return randomUUID()
+}
+
+// DiskID returns the identifier of the partition table: a GUID for
+// GPT, or a 32 bit disk signature for MBR.
+func DiskID() string {
+	if diskID == "" {
+		diskID = pickUUID("disk id")
+		if !*dps {
+			diskID = "0x" + diskID[:8]
+		}
+	}
+	return diskID
+}
+
+// PartitionUUID returns the PARTUUID of the n'th partition in the
+// table, counting from 1. MBR partitions have the disk signature and
+// their number as theirs.
+func PartitionUUID(n int) string {
+	if !*dps {
+		return fmt.Sprintf("%s-%02x", strings.TrimPrefix(DiskID(), "0x"), n)
+	}
+	if partIDs[n] == "" {
+		partIDs[n] = pickUUID(fmt.Sprintf("partition %d", n))
+	}
+	return partIDs[n]
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// FsUUID returns the UUID the filesystem of p gets, or "" if mkfs
+// makes up a random one.
+func FsUUID(p *Partition) string {
+	if p.Mount == "/" && *fsUUID != "" {
+		return strings.ToLower(*fsUUID)
+	}
+	if *layoutSeed != "" {
+		return SeededUUID("uuid " + seedKey(p))
+	}
+	return ""
+}
+
+// seedKey returns what tells p apart from the image's other
+// filesystems in what -layout-seed derives for it: its mount point, or
+// for those not mounted, such as swap and the -ab state partition, its
+// label, which each of those has.
+func seedKey(p *Partition) string {
+	if p.Mount != "" || p.Label == "" {
+		return p.Mount
+	}
+	return "label " + p.Label
+}
+
+// layoutArgs returns the mkfs arguments that make p lay files out the
+// same way in every build with the same -layout-seed. ext filesystems
+// place new directories and order their entries by a hash seeded from
+// the superblock, so fixing the seed, along with the order sources are
+// copied in, fixes where files end up. -fs-uuid fixes the root's UUID
+// too, and without -layout-seed, its hash seed is taken from the UUID,
+// so the superblock doesn't differ by a random seed either.
+func layoutArgs(p *Partition) []string {
+	if p.Fs == "vfat" {
+		if id := fatVolumeID(p); id != "" {
+			return []string{"-i", id}
+		}
+		return nil
+	}
+	uuid := FsUUID(p)
+	if uuid == "" {
+		return nil
+	}
+	switch p.Fs {
+	case "xfs":
+		return []string{"-m", "uuid=" + uuid}
+	case "btrfs", "f2fs", "swap", "erofs":
+		return []string{"-U", uuid}
+	}
+	if !strings.HasPrefix(p.Fs, "ext") {
+		return nil
+	}
+	seed := uuid
+	if *layoutSeed != "" {
+		seed = SeededUUID("hash_seed " + seedKey(p))
+	}
+	return []string{"-U", uuid, "-E", "hash_seed=" + seed}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"path"
+)
+
+var randomSeed = flag.Bool("random-seed", false,
+	"Give the image its own random seed, so copies of different builds don't share entropy")
+
+// Where systemd-boot and systemd-random-seed look for a seed, the
+// former on the ESP.
+const (
+	loaderSeedFile = "loader/random-seed"
+	systemSeedFile = "var/lib/systemd/random-seed"
+)
+
+// seedFiles returns where the seeds go in the image. Without -uefi,
+// the image's /boot stands in for the ESP.
+func seedFiles() []string {
+	esp := "boot"
+	if *uefi {
+		esp = espMount[1:]
+	}
+	return []string{path.Join(esp, loaderSeedFile), systemSeedFile}
+}
+
+// The size systemd uses for its seed files.
+const seedSize = 512
+
+// WriteRandomSeeds writes fresh random seed files into the image.
+// Devices flashed from the same image still start out with the same
+// seed; systemd mixes it with its own entropy and rewrites it on first
+// boot.
+func WriteRandomSeeds(mountpoint string) {
+	for _, file := range seedFiles() {
+		seed := make([]byte, seedSize)
+		if _, err := rand.Read(seed); err != nil {
+			Exit(err)
+		}
+		target := path.Join(mountpoint, file)
+		if err := ImageMkdirAll(path.Dir(target), 0755); err != nil {
+			Exit(err)
+		}
+		err := ImageWriteFile(target, seed, 0600)
+		Audit("random-seed", target, "", err)
+		if err != nil {
+			Exit(err)
+		}
+	}
+}
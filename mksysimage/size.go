@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var maxImageSize = flag.Uint64("max-image-size", 0,
+	"Fail if the populated image holds more than this many MB, 0 for no limit")
+
+var sizeReport = flag.Int("size-report", 0,
+	"Print the N largest files and directories in the image, by source")
+
+var sizeReportJson = flag.String("size-report-json", "",
+	"Write the size report as JSON to this file")
+
+type budgetList map[string]uint64
+
+func (b budgetList) String() string {
+	specs := make([]string, 0, len(b))
+	for mount, size := range b {
+		specs = append(specs, fmt.Sprintf("%s:%d", mount, size))
+	}
+	sort.Strings(specs)
+	return strings.Join(specs, ",")
+}
+
+func (b budgetList) Set(value string) error {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return errors.New(fmt.Sprintf("Malformed budget %s", value))
+	}
+	size, err := strconv.ParseUint(value[i+1:], 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Bad budget size %s", value[i+1:]))
+	}
+	b[filepath.Clean(value[:i])] = size
+	return nil
+}
+
+var budgets = budgetList{}
+
+func init() {
+	flag.Var(budgets, "budget",
+		"Fail if the partition mounted at MOUNT holds more than SIZE MB, given as MOUNT:SIZE, may be repeated")
+}
+
+// A SizeEntry is a file or directory and the disk space it takes up.
+type SizeEntry struct {
+	Path string `json:"path"`
+	Size uint64 `json:"size"`
+}
+
+// A SizeTally holds the disk usage of a tree in the image.
+type SizeTally struct {
+	Total uint64
+	Files []SizeEntry
+	Dirs  []SizeEntry
+}
+
+// MeasureTree walks the tree at root, which lives in the image mounted
+// at mountpoint, and totals the space its files use. Directories in
+// skip (paths within the image) are not descended into, which keeps
+// other partitions out of a partition's tally. Hard links are only
+// counted once.
+func MeasureTree(mountpoint, root string, skip map[string]bool) *SizeTally {
+	tally := &SizeTally{}
+	dirs := map[string]uint64{}
+	seen := map[[2]uint64]bool{}
+	inImage := func(file string) string {
+		return "/" + strings.TrimPrefix(strings.TrimPrefix(file, mountpoint), "/")
+	}
+	skipDir := func(dir string) bool {
+		return skip[inImage(dir)]
+	}
+	err := ImageWalk(filepath.Join(mountpoint, root), skipDir, func(f ImageFile) {
+		id := [2]uint64{f.Dev, f.Ino}
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		rel := inImage(f.Path)
+		size := f.Blocks * 512
+		tally.Total += size
+		tally.Files = append(tally.Files, SizeEntry{rel, size})
+		for dir := filepath.Dir(rel); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			dirs[dir] += size
+			if dir == root {
+				break
+			}
+		}
+	})
+	if err != nil {
+		Exit(err)
+	}
+	for dir, size := range dirs {
+		if dir != root {
+			tally.Dirs = append(tally.Dirs, SizeEntry{dir, size})
+		}
+	}
+	sortBySize(tally.Files)
+	sortBySize(tally.Dirs)
+	return tally
+}
+
+func sortBySize(entries []SizeEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Size != entries[j].Size {
+			return entries[i].Size > entries[j].Size
+		}
+		return entries[i].Path < entries[j].Path
+	})
+}
+
+func PrintLargest(title string, entries []SizeEntry, n int) {
+	fmt.Fprintf(os.Stderr, "Largest %s:\n", title)
+	for i, e := range entries {
+		if i == n {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  %10s  %s\n", FormatSize(e.Size), e.Path)
+	}
+}
+
+func FormatSize(size uint64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+func ValidateBudgets(parts []*Partition) {
+	for mount := range budgets {
+		found := false
+		for _, p := range parts {
+			found = found || p.Mount == mount
+		}
+		if !found {
+			Exit(fmt.Sprintf("Budget given for %s, which isn't a partition", mount))
+		}
+	}
+}
+
+// CheckBudgets fails the build if the image as a whole, or any
+// partition with a -budget, uses more space than allowed.
+func CheckBudgets(mountpoint string, parts []*Partition) {
+	over := false
+	check := func(what string, limit uint64, tally *SizeTally) {
+		if limit == 0 || tally.Total <= limit<<20 {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s uses %s, over its budget of %dM\n",
+			what, FormatSize(tally.Total), limit)
+		PrintLargest("directories", tally.Dirs, 10)
+		PrintLargest("files", tally.Files, 10)
+		over = true
+	}
+	if *maxImageSize > 0 {
+		check("The image", *maxImageSize, MeasureTree(mountpoint, "/", nil))
+	}
+	for _, p := range parts {
+		if limit, ok := budgets[p.Mount]; ok {
+			skip := map[string]bool{}
+			for _, other := range parts {
+				skip[other.Mount] = other != p
+			}
+			check(fmt.Sprintf("Partition %s", p.Mount), limit,
+				MeasureTree(mountpoint, p.Mount, skip))
+		}
+	}
+	if over {
+		Exit("Image is over its size budget")
+	}
+}
+
+// A SizeReportEntry is a file or directory in the size report, with the
+// space each source contributed to it.
+type SizeReportEntry struct {
+	Path    string            `json:"path"`
+	Size    uint64            `json:"size"`
+	Sources map[string]uint64 `json:"sources"`
+}
+
+type SizeReport struct {
+	Total   uint64            `json:"total"`
+	Sources map[string]uint64 `json:"sources"`
+	Dirs    []SizeReportEntry `json:"dirs"`
+	Files   []SizeReportEntry `json:"files"`
+}
+
+// WriteSizeReport prints the largest files and directories in the
+// image, and writes them as JSON if asked. Each file is attributed to
+// the last source that provided it, anything else to mksysimage itself.
+func WriteSizeReport(mountpoint string, sources []Source) {
+	owners := map[string]string{}
+	for _, source := range sources {
+		for _, e := range source.Contents() {
+			if !e.Dir {
+				owners[e.Path] = source.String()
+			}
+		}
+	}
+	owner := func(file string) string {
+		if o, ok := owners[file]; ok {
+			return o
+		}
+		return "(mksysimage)"
+	}
+
+	n := *sizeReport
+	if n <= 0 {
+		n = 20
+	}
+	tally := MeasureTree(mountpoint, "/", nil)
+	report := &SizeReport{Total: tally.Total, Sources: map[string]uint64{}}
+	for _, f := range tally.Files {
+		report.Sources[owner(f.Path)] += f.Size
+	}
+	for i, d := range tally.Dirs {
+		if i == n {
+			break
+		}
+		entry := SizeReportEntry{d.Path, d.Size, map[string]uint64{}}
+		for _, f := range tally.Files {
+			if strings.HasPrefix(f.Path, d.Path+"/") {
+				entry.Sources[owner(f.Path)] += f.Size
+			}
+		}
+		report.Dirs = append(report.Dirs, entry)
+	}
+	for i, f := range tally.Files {
+		if i == n {
+			break
+		}
+		report.Files = append(report.Files, SizeReportEntry{
+			f.Path, f.Size, map[string]uint64{owner(f.Path): f.Size}})
+	}
+
+	if *sizeReport > 0 {
+		fmt.Fprintf(os.Stderr, "Image contents use %s\n", FormatSize(report.Total))
+		fmt.Fprintf(os.Stderr, "By source:\n")
+		for _, e := range sortedSources(report.Sources) {
+			fmt.Fprintf(os.Stderr, "  %10s  %s\n", FormatSize(e.Size), e.Path)
+		}
+		fmt.Fprintf(os.Stderr, "Largest directories:\n")
+		for _, d := range report.Dirs {
+			fmt.Fprintf(os.Stderr, "  %10s  %s\n", FormatSize(d.Size), d.Path)
+			for _, e := range sortedSources(d.Sources) {
+				fmt.Fprintf(os.Stderr, "  %10s    from %s\n", FormatSize(e.Size), e.Path)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Largest files:\n")
+		for _, f := range report.Files {
+			fmt.Fprintf(os.Stderr, "  %10s  %s (from %s)\n",
+				FormatSize(f.Size), f.Path, owner(f.Path))
+		}
+	}
+	if *sizeReportJson != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			Exit(err)
+		}
+		if err = ioutil.WriteFile(*sizeReportJson, append(data, '\n'), 0644); err != nil {
+			Exit(err)
+		}
+	}
+}
+
+func sortedSources(sizes map[string]uint64) []SizeEntry {
+	var entries []SizeEntry
+	for source, size := range sizes {
+		entries = append(entries, SizeEntry{source, size})
+	}
+	sortBySize(entries)
+	return entries
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var listSources = flag.Bool("list-sources", false,
+	"List what each source would put in the image, then exit without building")
+
+// A Source provides files to overlay into the image at its root. Each
+// kind of source is registered under a scheme, which may prefix the
+// location in a root:scheme:location argument.
+type Source interface {
+	// Root is the absolute path within the image the source goes to.
+	Root() string
+	String() string
+	// Fetch readies the source for the other methods. It runs
+	// before any privileged work starts, so it's where anything
+	// slow or likely to fail belongs.
+	Fetch()
+	// Contents lists everything the source would put into the
+	// image, without touching the image.
+	Contents() []SourceEntry
+	// Populate copies the source into the image mounted at mountpoint.
+	Populate(mountpoint string)
+	// Programs lists the programs Populate runs, once fetched.
+	Programs() []string
+}
+
+// A SourceEntry is one path that a source puts into the image.
+type SourceEntry struct {
+	Path string // Absolute path within the image
+	Size int64
+	Dir  bool
+}
+
+// A SourceResolver makes the Source for a location. Relative local
+// paths are taken relative to dir.
+type SourceResolver func(root, location, dir string) Source
+
+var sourceSchemes = map[string]SourceResolver{}
+
+// RegisterSource makes a kind of source available under scheme.
+func RegisterSource(scheme string, resolver SourceResolver) {
+	sourceSchemes[scheme] = resolver
+}
+
+func init() {
+	RegisterSource("dir", func(root, location, dir string) Source {
+		return &dirSource{root, localPath(location, dir)}
+	})
+	RegisterSource("tar", func(root, location, dir string) Source {
+		return &tarSource{root, localPath(location, dir)}
+	})
+}
+
+// ParseSource resolves a [root:]source argument. The root defaults to
+// /, and a relative one is taken relative to /. A source without a
+// registered scheme is a local directory or tarball, told apart by
+// looking at it. Relative paths are taken relative to dir.
+func ParseSource(rootandsource, dir string) Source {
+	parts := strings.SplitN(rootandsource, ":", 2)
+	if len(parts) != 2 || sourceSchemes[parts[0]] != nil {
+		parts = []string{"/", rootandsource}
+	}
+	if parts[0] == "" {
+		Exit(errors.New(fmt.Sprintf("Malformed source %s", rootandsource)))
+	}
+	if !filepath.IsAbs(parts[0]) {
+		abs := filepath.Join("/", parts[0])
+		Log(fmt.Sprintf("Warning: source root %s isn't absolute, using %s", parts[0], abs))
+		parts[0] = abs
+	}
+	root, location := filepath.Clean(parts[0]), parts[1]
+	if i := strings.Index(location, ":"); i > 0 {
+		if resolver, ok := sourceSchemes[location[:i]]; ok {
+			return resolver(root, location[i+1:], dir)
+		}
+	}
+	path := localPath(location, dir)
+	st, err := os.Stat(path)
+	if err != nil {
+		Exit(err)
+	}
+	if st.IsDir() {
+		return &dirSource{root, path}
+	}
+	return &tarSource{root, path}
+}
+
+func localPath(location, dir string) string {
+	if !filepath.IsAbs(location) {
+		location = filepath.Join(dir, location)
+	}
+	path, err := filepath.Abs(location)
+	if err != nil {
+		Exit(err)
+	}
+	return path
+}
+
+// A dirSource is a local directory, copied verbatim.
+type dirSource struct {
+	root, path string
+}
+
+func (s *dirSource) Root() string   { return s.root }
+func (s *dirSource) String() string { return fmt.Sprintf("%s:%s", s.root, s.path) }
+
+func (s *dirSource) Fetch() {
+	if st, err := os.Stat(s.path); err != nil {
+		Exit(err)
+	} else if !st.IsDir() {
+		Exit(fmt.Sprintf("%s isn't a directory", s.path))
+	}
+}
+
+func (s *dirSource) Contents() []SourceEntry {
+	var entries []SourceEntry
+	err := filepath.Walk(s.path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.path, file)
+		entries = append(entries, SourceEntry{
+			filepath.Join(s.root, rel), info.Size(), info.IsDir()})
+		return nil
+	})
+	if err != nil {
+		Exit(err)
+	}
+	return entries
+}
+
+func (s *dirSource) Programs() []string { return []string{"rsync"} }
+
+func (s *dirSource) Populate(mountpoint string) {
+	root := filepath.Join(mountpoint, s.root)
+	if err := ImageMkdirAll(root, 0700); err != nil {
+		Exit(err)
+	}
+	cmd := exe.HeavyPriv("rsync", "-RrvP", ".", root)
+	cmd.Dir = s.path
+	if err := cmd.Run(); err != nil {
+		Exit(err)
+	}
+}
+
+// A tarSource is a local, possibly compressed, tarball, extracted at
+// its root.
+type tarSource struct {
+	root, path string
+}
+
+func (s *tarSource) Root() string   { return s.root }
+func (s *tarSource) String() string { return fmt.Sprintf("%s:%s", s.root, s.path) }
+
+func (s *tarSource) Fetch() {
+	if _, err := os.Stat(s.path); err != nil {
+		Exit(err)
+	}
+}
+
+func (s *tarSource) Contents() []SourceEntry {
+	var entries []SourceEntry
+	archive, closer := OpenTarball(s.path)
+	defer closer()
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			Exit(errors.New(fmt.Sprintf("Reading %s: %s", s.path, err)))
+		}
+		entries = append(entries, SourceEntry{
+			filepath.Join(s.root, hdr.Name), hdr.Size, hdr.Typeflag == tar.TypeDir})
+	}
+	return entries
+}
+
+func (s *tarSource) Programs() []string {
+	programs := ExtractPrograms()
+	f, err := os.Open(s.path)
+	if err != nil {
+		return programs
+	}
+	defer f.Close()
+	magic := make([]byte, 6)
+	f.Read(magic)
+	if prog := decompressor(magic); prog != "" {
+		programs = append(programs, prog)
+	}
+	return programs
+}
+
+func (s *tarSource) Populate(mountpoint string) {
+	ExtractArchive(s.path, mountpoint, s.root)
+}
+
+// OpenTarball opens a possibly compressed tarball for reading. The
+// returned function releases it.
+func OpenTarball(file string) (*tar.Reader, func()) {
+	r, closer := OpenDecompressed(file)
+	return tar.NewReader(r), closer
+}
+
+// OpenDecompressed opens a possibly compressed file, decompressing it
+// as it's read. The returned function releases it.
+func OpenDecompressed(file string) (io.Reader, func()) {
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	in := bufio.NewReader(f)
+	magic, _ := in.Peek(6)
+	closer := func() { f.Close() }
+	var r io.Reader = in
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			Exit(err)
+		}
+		r = gz
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		r = bzip2.NewReader(in)
+	case decompressor(magic) != "":
+		cmd := exec.Command(decompressor(magic), "-dc")
+		cmd.Stdin = in
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			Exit(err)
+		}
+		if err = cmd.Start(); err != nil {
+			Exit(err)
+		}
+		r = out
+		closer = func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+			f.Close()
+		}
+	}
+	return r, closer
+}
+
+// decompressor returns the program decompressing a file starting with
+// magic, for the formats the standard library can't read.
+func decompressor(magic []byte) string {
+	// No xz or zstd in the standard library, so let tar's usual
+	// helpers do the decompression.
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return "xz"
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	}
+	return ""
+}
+
+// ListSources prints every path each source contributes, noting where
+// a source replaces a file put down by an earlier one.
+func ListSources(sources []Source) {
+	owners := map[string]Source{}
+	for _, source := range sources {
+		fmt.Printf("%s:\n", source)
+		var total int64
+		for _, e := range source.Contents() {
+			if e.Dir {
+				fmt.Printf("  %10s  %s/\n", "-", e.Path)
+				continue
+			}
+			total += e.Size
+			note := ""
+			if prev, ok := owners[e.Path]; ok {
+				note = fmt.Sprintf(" (replaces %s)", prev)
+			}
+			owners[e.Path] = source
+			fmt.Printf("  %10s  %s%s\n", FormatSize(uint64(e.Size)), e.Path, note)
+		}
+		fmt.Printf("  %10s  total\n", FormatSize(uint64(total)))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var overlaySize = flag.Uint64("overlay-size", 0,
+	"With -fs squashfs or erofs, size in MB of an empty ext4 partition labelled overlay, for the initramfs to make the root writable with")
+
+const overlayLabel = "overlay"
+
+// ReadOnlyFs reports whether fs is packed from a populated directory,
+// rather than made empty and populated mounted.
+func ReadOnlyFs(fs string) bool {
+	return fs == "squashfs" || fs == "erofs"
+}
+
+// WritableFs returns the filesystem for partitions other than root,
+// which can't be read-only since nothing would populate them.
+func WritableFs() string {
+	if ReadOnlyFs(*fsType) {
+		return "ext4"
+	}
+	return *fsType
+}
+
+// MkfsProgram returns the program creating filesystems of type fs.
+func MkfsProgram(fs string) string {
+	switch fs {
+	case "squashfs":
+		return "mksquashfs"
+	case "swap":
+		return "mkswap"
+	}
+	return "mkfs." + fs
+}
+
+// OverlayPartition returns the partition -overlay-size adds to the
+// layout. Mounting it over the root is up to the image's initramfs.
+func OverlayPartition() *Partition {
+	if !ReadOnlyFs(*fsType) {
+		Exit("-overlay-size needs -fs squashfs or erofs")
+	}
+	return &Partition{Size: *overlaySize, Fs: "ext4", Label: overlayLabel}
+}
+
+// WriteReadOnlyRoot packs the root filesystem, populated in the plain
+// directory mountpoint, into the root partition p. The other partitions
+// are mounted within it, so their contents are left out, leaving their
+// mount points empty.
+func WriteReadOnlyRoot(p *Partition, mountpoint string, parts []*Partition) {
+	var others []string
+	for _, other := range MountOrder(parts) {
+		if other != p {
+			others = append(others, strings.TrimPrefix(filepath.Clean(other.Mount), "/"))
+		}
+	}
+	var args []string
+	switch p.Fs {
+	case "squashfs":
+		args = []string{mountpoint, p.Device, "-noappend", "-no-progress", "-wildcards"}
+		for _, rel := range others {
+			args = append(args, "-e", rel+"/*")
+		}
+		args = append(args, mkfsArgs[p.Mount]...)
+	case "erofs":
+		if p.Label != "" {
+			args = append(args, "-L", p.Label)
+		}
+		args = append(args, layoutArgs(p)...)
+		// Paths are matched relative to the source directory.
+		for _, rel := range others {
+			args = append(args, "--exclude-regex=^"+regexp.QuoteMeta(rel)+"/.")
+		}
+		args = append(args, mkfsArgs[p.Mount]...)
+		args = append(args, p.Device, mountpoint)
+	}
+	program := MkfsProgram(p.Fs)
+	Log(fmt.Sprintf("Packing the root filesystem with %s", program))
+	err := exe.HeavyPriv(program, args...).Run()
+	Audit("mkfs", p.Device, p.Fs, err)
+	if err != nil {
+		Exit(fmt.Sprintf("%s: %s", program, err))
+	}
+}
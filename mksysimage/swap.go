@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var swapSize = flag.Uint64("swap-size", 0,
+	"Size in MB of a swap partition, 0 for none")
+
+var swapFstab = flag.Bool("swap-fstab", false,
+	"Add the -swap-size partition to the image's /etc/fstab")
+
+const swapLabel = "swap"
+
+func init() {
+	RegisterPrivilegedCapability("-swap-fstab", func(plan *BuildPlan) []string {
+		if !*swapFstab || plan.Parts == nil {
+			return nil
+		}
+		return []string{"blkid"}
+	})
+}
+
+// SwapPartition returns the partition -swap-size adds to the layout.
+// On a DPS layout, systemd finds and enables it by its type, so only
+// images booting something else need -swap-fstab.
+func SwapPartition() *Partition {
+	p := &Partition{Size: *swapSize, Fs: "swap", Label: swapLabel, Type: "82"}
+	if *dps {
+		p.Type = dpsMountTypes["swap"]
+	}
+	return p
+}
+
+// WriteSwapFstab adds the swap partition among parts to the image's
+// /etc/fstab, for -swap-fstab.
+func WriteSwapFstab(parts []*Partition, mountpoint string) {
+	if !*swapFstab {
+		return
+	}
+	for _, p := range parts {
+		if p.Fs == "swap" {
+			Log("Adding the swap partition to /etc/fstab")
+			AppendFstab(mountpoint, fmt.Sprintf("UUID=%s\tnone\tswap\tsw\t0 0", FilesystemUUID(p)))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+var niceness = flag.Int("nice", 0,
+	"Run heavy steps (image writes, copies, conversions) at this niceness")
+
+var ioniceClass = flag.String("ionice", "",
+	"Run heavy steps under this IO scheduling class (idle, best-effort[:LEVEL], realtime[:LEVEL])")
+
+var ioLimit = flag.String("io-limit", "",
+	"Cap the read and write bandwidth of heavy steps on the output disk (e.g. 50M), using a systemd scope")
+
+// The block devices -io-limit applies to once throttling is set up:
+// the one holding the output, and the image's loop device while it's
+// attached. Writes to the loop device are charged to whichever cgroup
+// issued them, not to the disk behind it.
+var ioLimitDevices []string
+
+func init() {
+	RegisterPrivilegedCapability("throttling", func(plan *BuildPlan) []string {
+		return ThrottlePrograms()
+	})
+}
+
+// ThrottlePrograms returns the programs needed by the throttling flags,
+// checking their values as it goes.
+func ThrottlePrograms() []string {
+	var programs []string
+	if *niceness != 0 {
+		programs = append(programs, "nice")
+	}
+	if *ioniceClass != "" {
+		class := strings.SplitN(*ioniceClass, ":", 2)[0]
+		if class != "idle" && class != "best-effort" && class != "realtime" {
+			Exit(fmt.Sprintf("Unknown IO scheduling class %s", class))
+		}
+		programs = append(programs, "ionice")
+	}
+	if *ioLimit != "" {
+		programs = append(programs, "systemd-run")
+	}
+	return programs
+}
+
+// SetupThrottling finds the block device behind dir, which -io-limit
+// applies to, along with the loop device ThrottleDevice adds.
+func SetupThrottling(dir string) {
+	if *ioLimit == "" {
+		return
+	}
+	st, err := os.Stat(dir)
+	if err != nil {
+		Exit(err)
+	}
+	dev := st.Sys().(*syscall.Stat_t).Dev
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	ioLimitDevices = []string{fmt.Sprintf("/dev/block/%d:%d", major, minor)}
+}
+
+// ThrottleDevice applies -io-limit to device too, until the returned
+// function is called when it's torn down.
+func ThrottleDevice(device string) func() {
+	if len(ioLimitDevices) == 0 {
+		return func() {}
+	}
+	ioLimitDevices = append(ioLimitDevices, device)
+	return func() {
+		ioLimitDevices = ioLimitDevices[:len(ioLimitDevices)-1]
+	}
+}
+
+// Heavy is like Cmd, but for IO or CPU intensive commands, which get
+// run under any requested throttling.
+func (l *LoggingExec) Heavy(cmd string, args ...string) *exec.Cmd {
+	cmd, args = throttle(cmd, args)
+	return l.Cmd(cmd, args...)
+}
+
+// throttle wraps a command line in the throttling commands asked for.
+func throttle(cmd string, args []string) (string, []string) {
+	if *ioniceClass != "" {
+		class := strings.SplitN(*ioniceClass, ":", 2)
+		ionice := []string{"-c", class[0]}
+		if len(class) == 2 {
+			ionice = append(ionice, "-n", class[1])
+		}
+		args = append(append(ionice, cmd), args...)
+		cmd = "ionice"
+	}
+	if *niceness != 0 {
+		args = append([]string{"-n", fmt.Sprint(*niceness), cmd}, args...)
+		cmd = "nice"
+	}
+	if len(ioLimitDevices) > 0 {
+		scope := []string{"--scope", "--quiet"}
+		for _, device := range ioLimitDevices {
+			limit := fmt.Sprintf("%s %s", device, *ioLimit)
+			scope = append(scope, "-p", "IOReadBandwidthMax="+limit, "-p", "IOWriteBandwidthMax="+limit)
+		}
+		args = append(append(scope, "--", cmd), args...)
+		cmd = "systemd-run"
+	}
+	return cmd, args
+}
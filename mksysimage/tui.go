@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unsafe"
+)
+
+var tui = flag.Bool("tui", false,
+	"Show the build steps, partition usage and command log on a full screen display")
+
+// A tuiStep is a step of the build as Log reported it.
+type tuiStep struct {
+	Name    string
+	Started time.Time
+}
+
+// A tuiScreen redraws the build's progress on the terminal until it's
+// stopped. Everything goes to stderr, as Log does without it.
+type tuiScreen struct {
+	mu      sync.Mutex
+	title   string
+	started time.Time
+	steps   []tuiStep
+	mounts  [][2]string // Name and mount point of partitions whose usage is shown
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// The screen while -tui is showing, or nil. Log and the goroutines
+// building the image read it while StopTUI may be clearing it, so it's
+// guarded by screenMu.
+var (
+	screenMu sync.Mutex
+	screen   *tuiScreen
+)
+
+// currentScreen returns the screen while -tui is showing, or nil.
+func currentScreen() *tuiScreen {
+	screenMu.Lock()
+	defer screenMu.Unlock()
+	return screen
+}
+
+// logStep has the screen show entry as the next step, if it's showing.
+func logStep(entry string) bool {
+	screenMu.Lock()
+	defer screenMu.Unlock()
+	if screen == nil {
+		return false
+	}
+	screen.Step(entry)
+	return true
+}
+
+// StartTUI takes over the terminal for -tui. Without a terminal, it
+// warns and the build logs as usual.
+func StartTUI(title string) {
+	if !*tui {
+		return
+	}
+	if _, _, ok := terminalSize(); !ok {
+		Log("Warning: -tui needs a terminal on stderr, logging instead")
+		return
+	}
+	s := &tuiScreen{
+		title:   title,
+		started: time.Now(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	// The alternate screen leaves the user's scrollback alone.
+	fmt.Fprint(os.Stderr, "\x1b[?1049h\x1b[?25l")
+	screenMu.Lock()
+	screen = s
+	screenMu.Unlock()
+	go s.run()
+}
+
+// StopTUI gives the terminal back, then logs the steps with how long
+// each took, since the alternate screen takes them with it.
+func StopTUI() {
+	screenMu.Lock()
+	s := screen
+	screen = nil
+	screenMu.Unlock()
+	if s == nil {
+		return
+	}
+	close(s.done)
+	<-s.stopped
+	fmt.Fprint(os.Stderr, "\x1b[?25h\x1b[?1049l")
+	s.mu.Lock()
+	steps := s.steps
+	s.mu.Unlock()
+	for i, step := range steps {
+		end := time.Now()
+		if i+1 < len(steps) {
+			end = steps[i+1].Started
+		}
+		Log(fmt.Sprintf("%s (%s)", step.Name, end.Sub(step.Started).Round(time.Second)))
+	}
+}
+
+// Step starts the next step of the build.
+func (s *tuiScreen) Step(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, tuiStep{name, time.Now()})
+}
+
+// WatchMount shows how full the partition name mounted at target is,
+// and UnwatchMount stops before it's unmounted.
+func WatchMount(name, target string) {
+	if s := currentScreen(); s != nil {
+		s.mu.Lock()
+		s.mounts = append(s.mounts, [2]string{name, target})
+		s.mu.Unlock()
+	}
+}
+
+func UnwatchMount(target string) {
+	if s := currentScreen(); s != nil {
+		s.mu.Lock()
+		for i, m := range s.mounts {
+			if m[1] == target {
+				s.mounts = append(s.mounts[:i], s.mounts[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *tuiScreen) run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.draw()
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// draw redraws the screen: a title line, the latest steps, a bar per
+// mounted partition and as much of the command log as fits below.
+func (s *tuiScreen) draw() {
+	rows, cols, ok := terminalSize()
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	now := time.Now()
+	lines = append(lines, fmt.Sprintf("mksysimage %s  %s", s.title, now.Sub(s.started).Round(time.Second)))
+	lines = append(lines, "")
+
+	shown := s.steps
+	if keep := rows / 3; len(shown) > keep {
+		shown = shown[len(shown)-keep:]
+	}
+	for i, step := range shown {
+		if i+1 < len(shown) {
+			lines = append(lines, fmt.Sprintf(" done  %s (%s)", step.Name,
+				shown[i+1].Started.Sub(step.Started).Round(time.Second)))
+		} else {
+			lines = append(lines, fmt.Sprintf(" >>>>  %s (%s)", step.Name,
+				now.Sub(step.Started).Round(time.Second)))
+		}
+	}
+
+	if len(s.mounts) > 0 {
+		lines = append(lines, "")
+	}
+	for _, m := range s.mounts {
+		var st syscall.Statfs_t
+		if syscall.Statfs(m[1], &st) != nil || st.Blocks == 0 {
+			continue
+		}
+		total := st.Blocks * uint64(st.Bsize)
+		used := (st.Blocks - st.Bfree) * uint64(st.Bsize)
+		lines = append(lines, fmt.Sprintf(" %s %s %d/%d MB", progressBar(used, total, cols/3),
+			m[0], used>>20, total>>20))
+	}
+
+	lines = append(lines, "", " Command log "+strings.Repeat("-", cols))
+	if room := rows - len(lines); room > 0 {
+		log := commandLogLines(exe.Combined.Tail(rows * cols * 4))
+		if len(log) > room {
+			log = log[len(log)-room:]
+		}
+		lines = append(lines, log...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i == rows {
+			break
+		}
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(truncate(line, cols))
+		buf.WriteString("\x1b[K")
+	}
+	buf.WriteString("\x1b[J")
+	os.Stderr.Write(buf.Bytes())
+}
+
+// progressBar draws used out of total in width characters.
+func progressBar(used, total uint64, width int) string {
+	if width < 3 {
+		width = 3
+	}
+	inside := width - 2
+	full := int(used * uint64(inside) / total)
+	return "[" + strings.Repeat("#", full) + strings.Repeat(".", inside-full) + "]" +
+		fmt.Sprintf(" %3d%%", used*100/total)
+}
+
+// commandLogLines splits command output into lines for the screen.
+// Progress meters overwrite their line with carriage returns, so only
+// the last of those is kept, and other control characters are dropped.
+func commandLogLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if i := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); i >= 0 {
+			line = line[i+1:]
+		}
+		lines = append(lines, strings.Map(func(r rune) rune {
+			if r == '\t' {
+				return ' '
+			}
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, line))
+	}
+	return lines
+}
+
+func truncate(line string, cols int) string {
+	runes := []rune(line)
+	if len(runes) > cols {
+		return string(runes[:cols])
+	}
+	return line
+}
+
+// terminalSize returns the size of the terminal on stderr, if it is one.
+func terminalSize() (rows, cols int, ok bool) {
+	var ws struct{ Row, Col, X, Y uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stderr.Fd(),
+		syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	return int(ws.Row), int(ws.Col), errno == 0 && ws.Row > 0 && ws.Col > 0
+}
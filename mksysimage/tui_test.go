@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandLogLines(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want []string
+	}{
+		{"one\ntwo\n", []string{"one", "two"}},
+		// Only the last state of a progress meter is kept.
+		{" 10%\r 50%\r100%\ndone\n", []string{"100%", "done"}},
+		{"copying\r\n", []string{"copying"}},
+		{"a\tb\x1b[0m\x07c", []string{"a b[0mc"}},
+		{"", []string{""}},
+	} {
+		if got := commandLogLines(c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("commandLogLines(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}
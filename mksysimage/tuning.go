@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var fsLabel = flag.String("fs-label", "",
+	"Label of the root filesystem")
+
+var fsUUID = flag.String("fs-uuid", "",
+	"UUID of the root filesystem, rather than a random one or one from -layout-seed")
+
+var reservedBlocks = flag.String("reserved-blocks", "",
+	"Percentage of ext filesystems reserved for root, rather than mke2fs's 5")
+
+var inodeRatio = flag.Uint64("inode-ratio", 0,
+	"Bytes per inode of ext filesystems, rather than mke2fs's default")
+
+var fsFeatures = flag.String("fs-features", "",
+	"Comma separated filesystem features to turn on, or off with a ^ prefix, passed to mkfs -O")
+
+// mkfsArgList holds extra mkfs arguments by mount point.
+type mkfsArgList map[string][]string
+
+func (l mkfsArgList) String() string {
+	specs := make([]string, 0, len(l))
+	for mount, args := range l {
+		specs = append(specs, mount+"="+strings.Join(args, " "))
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l mkfsArgList) Set(value string) error {
+	mount := "/"
+	if strings.HasPrefix(value, "/") {
+		i := strings.Index(value, "=")
+		if i < 0 {
+			return errors.New(fmt.Sprintf("Malformed mkfs args %s, expected [MOUNT=]ARGS", value))
+		}
+		mount, value = filepath.Clean(value[:i]), value[i+1:]
+	}
+	l[mount] = append(l[mount], strings.Fields(value)...)
+	return nil
+}
+
+var mkfsArgs = mkfsArgList{}
+
+func init() {
+	flag.Var(mkfsArgs, "mkfs-args",
+		"Extra arguments to mkfs for the root, or as MOUNT=ARGS for another partition, may be repeated")
+}
+
+// CheckMkfsArgs fails if -mkfs-args names a partition not among parts.
+func CheckMkfsArgs(parts []*Partition) {
+	for mount := range mkfsArgs {
+		found := false
+		for _, p := range parts {
+			found = found || p.Mount == mount
+		}
+		if !found {
+			Exit(fmt.Sprintf("-mkfs-args for %s, but there's no such partition", mount))
+		}
+	}
+}
+
+// CheckTuning fails if the tuning flags given don't apply to -fs.
+func CheckTuning() {
+	ext := strings.HasPrefix(*fsType, "ext")
+	if *fsUUID != "" {
+		if !uuidPattern.MatchString(*fsUUID) {
+			Exit(fmt.Sprintf("Bad -fs-uuid %s, expected xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx", *fsUUID))
+		}
+		if *fsType == "squashfs" {
+			Exit("squashfs has no UUID to set with -fs-uuid")
+		}
+	}
+	if *reservedBlocks != "" {
+		if pct, err := strconv.ParseFloat(*reservedBlocks, 64); err != nil || pct < 0 || pct > 50 {
+			Exit(fmt.Sprintf("Bad -reserved-blocks %s, expected a percentage up to 50", *reservedBlocks))
+		}
+		if !ext {
+			Exit("-reserved-blocks only applies to ext filesystems")
+		}
+	}
+	if *inodeRatio != 0 && !ext {
+		Exit("-inode-ratio only applies to ext filesystems")
+	}
+	if *fsFeatures != "" && *fsType != "btrfs" && *fsType != "f2fs" && !ext {
+		Exit(fmt.Sprintf("-fs-features doesn't apply to %s", *fsType))
+	}
+}
+
+// tuningArgs returns the mkfs arguments for the tuning flags, for the
+// partitions -fs applies to.
+func tuningArgs(p *Partition) []string {
+	if !p.Tune {
+		return nil
+	}
+	var args []string
+	if *reservedBlocks != "" {
+		args = append(args, "-m", *reservedBlocks)
+	}
+	if *inodeRatio != 0 {
+		args = append(args, "-i", strconv.FormatUint(*inodeRatio, 10))
+	}
+	if *fsFeatures != "" {
+		args = append(args, "-O", *fsFeatures)
+	}
+	return args
+}
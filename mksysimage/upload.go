@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var uploadChunkSize = flag.Uint64("upload-chunk-size", 0,
+	"With -upload-url, upload each output in chunks of this many MB once it's written, retrying failed chunks and skipping those an earlier run uploaded unchanged")
+
+// How many times a chunk is tried before the upload fails.
+const uploadTries = 3
+
+// The file beside an output recording which of its chunks are uploaded.
+const uploadStateSuffix = ".upload.json"
+
+// An uploadState records the chunks of an output uploaded so far, by
+// their sha256 digests, "" for those that aren't. An interrupted build
+// leaves it behind, and a rerun writing the same output, as
+// reproducible builds do, skips the chunks whose digests still match.
+type uploadState struct {
+	URL    string   `json:"url"`
+	Size   int64    `json:"size"`
+	Chunk  int64    `json:"chunk"`
+	Chunks []string `json:"chunks"`
+}
+
+// CheckUpload fails if -upload-chunk-size is given without -upload-url.
+func CheckUpload() {
+	if *uploadChunkSize != 0 && *uploadUrl == "" {
+		Exit("-upload-chunk-size needs -upload-url")
+	}
+}
+
+// ChunkedUpload reports whether outputs are uploaded in chunks once
+// they're written, rather than as they stream through the pipeline.
+func ChunkedUpload() bool {
+	return *uploadUrl != "" && *uploadChunkSize != 0
+}
+
+// UploadChunks uploads file in -upload-chunk-size chunks, each a PUT of
+// its byte range with a Content-Range header, as resumable upload
+// endpoints take them.
+func UploadChunks(file string) {
+	url := strings.TrimSuffix(*uploadUrl, "/") + "/" + filepath.Base(file)
+	f, err := os.Open(file)
+	if err != nil {
+		Exit(err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		Exit(err)
+	}
+	chunk := int64(*uploadChunkSize) << 20
+	n := (st.Size() + chunk - 1) / chunk
+	if n == 0 {
+		n = 1
+	}
+	stateFile := file + uploadStateSuffix
+	var state uploadState
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil || json.Unmarshal(data, &state) != nil ||
+		state.URL != url || state.Size != st.Size() || state.Chunk != chunk || int64(len(state.Chunks)) != n {
+		state = uploadState{URL: url, Size: st.Size(), Chunk: chunk, Chunks: make([]string, n)}
+	}
+
+	Log(fmt.Sprintf("Uploading %s in %d chunks", filepath.Base(file), n))
+	buf := make([]byte, chunk)
+	skipped := 0
+	for i := int64(0); i < n; i++ {
+		size, err := f.ReadAt(buf, i*chunk)
+		if err != nil && err != io.EOF {
+			Exit(err)
+		}
+		sum := sha256.Sum256(buf[:size])
+		digest := hex.EncodeToString(sum[:])
+		if state.Chunks[i] == digest {
+			skipped++
+			continue
+		}
+		if err = putChunk(url, buf[:size], i*chunk, st.Size()); err != nil {
+			Exit(errors.New(fmt.Sprintf("Uploading %s: %s", file, err)))
+		}
+		state.Chunks[i] = digest
+		if data, err = json.Marshal(state); err == nil {
+			err = ioutil.WriteFile(stateFile, data, 0644)
+		}
+		if err != nil {
+			Exit(err)
+		}
+	}
+	if skipped > 0 {
+		Log(fmt.Sprintf("Skipped %d of the chunks, which an earlier run uploaded", skipped))
+	}
+	os.Remove(stateFile)
+}
+
+// putChunk PUTs data, the bytes of an output of size bytes from start
+// on, to url, trying again a little later when it fails.
+func putChunk(url string, data []byte, start, size int64) error {
+	var err error
+	for try := 1; try <= uploadTries; try++ {
+		if try > 1 {
+			Log(fmt.Sprintf("Warning: %s, trying again", err))
+			time.Sleep(time.Duration(try) * 5 * time.Second)
+		}
+		var req *http.Request
+		req, err = http.NewRequest("PUT", url, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if size > 0 {
+			req.Header.Set("Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d", start, start+int64(len(data))-1, size))
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		// Resumable upload endpoints answer 308 for each chunk but
+		// the last.
+		if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusPermanentRedirect {
+			return nil
+		}
+		err = errors.New(fmt.Sprintf("%s answered %s", url, resp.Status))
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var againstReport = flag.String("against-report", "",
+	"Build report or -update-metadata file the verify command checks an image against")
+
+var verifyKey = flag.String("verify-key", "",
+	"PEM encoded ed25519 public key the verify command requires the metadata partition to be signed with")
+
+// The formats verify can convert back to raw with qemu-img, and what
+// qemu-img calls them.
+var qemuFormats = map[string]string{
+	"vdi":   "vdi",
+	"vmdk":  "vmdk",
+	"vhd":   "vpc",
+	"qcow2": "qcow2",
+}
+
+func init() {
+	subcommands["verify"] = VerifyCommand
+}
+
+// VerifyCommand checks that a built image is exactly what a build
+// report recorded, and that its metadata partition, if any, is
+// properly signed.
+func VerifyCommand(args []string) {
+	if len(args) != 1 || *againstReport == "" {
+		Exit("Usage: verify image -against-report file")
+	}
+	image := args[0]
+	data, err := ioutil.ReadFile(*againstReport)
+	if err != nil {
+		Exit(err)
+	}
+	var report struct {
+		Artifacts []Artifact `json:"artifacts"`
+	}
+	if err = json.Unmarshal(data, &report); err != nil {
+		Exit(fmt.Sprintf("Reading %s: %s", *againstReport, err))
+	}
+
+	failed := 0
+	check := func(name string, problems []string) {
+		if len(problems) == 0 {
+			fmt.Printf("PASS %s\n", name)
+			return
+		}
+		failed++
+		fmt.Printf("FAIL %s\n", name)
+		for _, p := range problems {
+			fmt.Printf("    %s\n", p)
+		}
+	}
+
+	// The image is compared as built if the report lists it, and
+	// otherwise converted back to the raw image the report lists.
+	raw := ""
+	if a := findArtifact(report.Artifacts, filepath.Base(image), ""); a != nil {
+		Log(fmt.Sprintf("Checksumming %s", image))
+		check("checksum "+a.File, compareArtifact(*a, Checksum(image, a.Format)))
+		if a.Format == "raw" || a.Format == "nspawn" {
+			raw = image
+		}
+	} else if a := findArtifact(report.Artifacts, "", "raw"); a != nil && qemuFormats[imageFormat(image)] != "" {
+		CheckPrograms(Requirements{}.Need("verify", "qemu-img"))
+		raw = filepath.Join(TempDir("verify"), "image.raw")
+		Log(fmt.Sprintf("Converting %s back to raw", image))
+		err := exe.Heavy("qemu-img", "convert", "-f", qemuFormats[imageFormat(image)],
+			"-O", "raw", image, raw).Run()
+		if err != nil {
+			Exit(err)
+		}
+		check("checksum "+a.File+" (converted back to raw)", compareArtifact(*a, Checksum(raw, "raw")))
+	} else {
+		Exit(fmt.Sprintf("%s lists neither %s nor a raw image to compare it with",
+			*againstReport, filepath.Base(image)))
+	}
+
+	if raw != "" {
+		if problems, ok := checkMetadataSignature(raw); ok {
+			check("metadata signature", problems)
+		}
+	}
+	if failed > 0 {
+		Exit(fmt.Sprintf("%s doesn't match %s", image, *againstReport))
+	}
+}
+
+// imageFormat guesses an image's format from its extension.
+func imageFormat(image string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(image), "."))
+}
+
+// findArtifact finds the artifact with the given file name or format.
+func findArtifact(artifacts []Artifact, file, format string) *Artifact {
+	for i, a := range artifacts {
+		if (file != "" && a.File == file) || (format != "" && a.Format == format) {
+			return &artifacts[i]
+		}
+	}
+	return nil
+}
+
+// compareArtifact lists how got differs from what was recorded. Hashes
+// the record leaves out aren't compared.
+func compareArtifact(want, got Artifact) []string {
+	var problems []string
+	if want.Size != got.Size {
+		problems = append(problems, fmt.Sprintf("size is %d, expected %d", got.Size, want.Size))
+	}
+	for _, h := range []struct{ name, want, got string }{
+		{"sha256", want.Sha256, got.Sha256},
+		{"sha1", want.Sha1, got.Sha1},
+		{"md5", want.Md5, got.Md5},
+	} {
+		if h.want != "" && h.want != h.got {
+			problems = append(problems, fmt.Sprintf("%s is %s, expected %s", h.name, h.got, h.want))
+		}
+	}
+	return problems
+}
+
+// checkMetadataSignature checks the signature of the metadata partition
+// in the raw image, returning false if there isn't one.
+func checkMetadataSignature(raw string) ([]string, bool) {
+	data, ok := ReadMetadataPartition(raw)
+	if !ok {
+		return nil, false
+	}
+	var doc SignedMetadata
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return []string{fmt.Sprintf("can't read the metadata: %s", err)}, true
+	}
+	if len(doc.PublicKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(ed25519.PublicKey(doc.PublicKey), doc.Metadata, doc.Signature) {
+		return []string{"the signature doesn't match the metadata"}, true
+	}
+	if *verifyKey != "" && !bytes.Equal(doc.PublicKey, loadVerifyKey()) {
+		return []string{fmt.Sprintf("signed with a key other than %s", *verifyKey)}, true
+	}
+	return nil, true
+}
+
+// loadVerifyKey reads the -verify-key public key.
+func loadVerifyKey() ed25519.PublicKey {
+	data, err := ioutil.ReadFile(*verifyKey)
+	if err != nil {
+		Exit(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		Exit(fmt.Sprintf("No PEM data in %s", *verifyKey))
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		Exit(fmt.Sprintf("%s: %s", *verifyKey, err))
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		Exit(fmt.Sprintf("%s isn't an ed25519 key", *verifyKey))
+	}
+	return pub
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareArtifact(t *testing.T) {
+	got := Artifact{File: "a.img", Size: 10, Sha256: "aa", Sha1: "bb", Md5: "cc"}
+	for _, c := range []struct {
+		want     Artifact
+		problems []string
+	}{
+		{Artifact{Size: 10, Sha256: "aa", Sha1: "bb", Md5: "cc"}, nil},
+		// Hashes the record leaves out aren't compared.
+		{Artifact{Size: 10, Sha256: "aa"}, nil},
+		{Artifact{Size: 12, Sha256: "ab", Md5: "cc"},
+			[]string{"size is 10, expected 12", "sha256 is aa, expected ab"}},
+		{Artifact{Size: 10, Sha1: "ba", Md5: "cd"},
+			[]string{"sha1 is bb, expected ba", "md5 is cc, expected cd"}},
+	} {
+		if problems := compareArtifact(c.want, got); !reflect.DeepEqual(problems, c.problems) {
+			t.Errorf("compareArtifact(%+v) = %q, want %q", c.want, problems, c.problems)
+		}
+	}
+}
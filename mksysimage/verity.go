@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var verity = flag.Bool("verity", false,
+	"With -fs squashfs or erofs, protect the root with dm-verity, its hash tree on a partition after it, and add the kernel args systemd-veritysetup needs")
+
+var verityKey = flag.String("verity-key", "",
+	"PEM encoded private key signing the -verity root hash, for systemd-veritysetup to have the kernel check against its keyring")
+
+var verityCert = flag.String("verity-cert", "",
+	"PEM encoded certificate of -verity-key, which the kernel booting the image has to trust")
+
+// The device the root is opened as, and the root hash and its
+// signature once the hash tree is written.
+const verityDevice = "/dev/mapper/root"
+
+var (
+	verityRootHash      string
+	verityRootSignature []byte
+)
+
+func init() {
+	RegisterPrivilegedCapability("-verity", func(plan *BuildPlan) []string {
+		if !*verity || plan.Parts == nil {
+			return nil
+		}
+		return []string{"veritysetup"}
+	})
+	RegisterCapability("-verity-key", func(plan *BuildPlan) []string {
+		if *verityKey == "" || plan.Parts == nil {
+			return nil
+		}
+		return []string{"openssl"}
+	})
+}
+
+// CheckVerity checks -verity, and unless -kernel-args says otherwise,
+// points root= at the verity device.
+func CheckVerity() {
+	if (*verityKey != "" || *verityCert != "") && !*verity {
+		Exit("-verity-key and -verity-cert need -verity")
+	}
+	if !*verity {
+		return
+	}
+	if (*verityKey == "") != (*verityCert == "") {
+		Exit("-verity-key and -verity-cert go together")
+	}
+	switch {
+	case !ReadOnlyFs(*fsType):
+		Exit("-verity needs -fs squashfs or erofs, since nothing can change a verified root")
+	case *noPartition:
+		Exit("-verity needs a partition table for the hash partition")
+	case *lvmGroup != "":
+		Exit("-verity can't be used with -lvm")
+	case ArchBootloader().AfterSources:
+		Exit(fmt.Sprintf("-verity can't be used with %s, which keeps its config in the root filesystem",
+			ArchBootloader().Name))
+	}
+	if !FlagSet("kernel-args") {
+		*kernelArgs = SetRootArg(*kernelArgs, verityDevice)
+	}
+}
+
+// VerityPartition returns the partition holding the root's hash tree,
+// which goes right after the root.
+func VerityPartition() *Partition {
+	p := &Partition{Size: verityHashSize(*diskSize)}
+	if *dps {
+		p.Type = dpsRootVerityTypes[*arch]
+	}
+	return p
+}
+
+// verityHashSize returns the size in MB of the hash tree of a root of
+// up to size MB. With 4 KiB blocks and SHA-256, each level of the tree
+// is 1/128 the size of the one below it, so all of them take under
+// 1/127 of the data.
+func verityHashSize(size uint64) uint64 {
+	return (size+126)/127 + 1
+}
+
+// HashPartition returns the partition among parts holding the root's
+// hash tree.
+func HashPartition(parts []*Partition) *Partition {
+	return TablePartitions(parts)[1]
+}
+
+// WriteVerityHash writes the hash tree of the packed root to its
+// partition among parts, and adds the root hash and the partitions
+// holding the root and its hash tree to -kernel-args. The bootloader,
+// outside the root, is installed afterwards to boot with them.
+func WriteVerityHash(parts []*Partition) {
+	hash := HashPartition(parts)
+	args := []string{"format", "--data-block-size=4096", "--hash-block-size=4096",
+		"--uuid=" + pickUUID("verity")}
+	if *layoutSeed != "" {
+		salt := sha256.Sum256([]byte(*layoutSeed + "\x00verity salt"))
+		args = append(args, fmt.Sprintf("--salt=%x", salt))
+	}
+	args = append(args, parts[0].Device, hash.Device)
+	Log("Writing the root's dm-verity hash tree")
+	cmd := exe.HeavyPriv("veritysetup", args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	Audit("veritysetup", hash.Device, "format", err)
+	if err != nil {
+		Exit(fmt.Sprintf("veritysetup: %s", err))
+	}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "Root hash:") {
+			verityRootHash = strings.TrimSpace(strings.TrimPrefix(line, "Root hash:"))
+		}
+	}
+	if verityRootHash == "" {
+		Exit("veritysetup didn't print the root hash")
+	}
+	Log(fmt.Sprintf("Root hash: %s", verityRootHash))
+	*kernelArgs = fmt.Sprintf("%s roothash=%s systemd.verity_root_data=PARTUUID=%s systemd.verity_root_hash=PARTUUID=%s",
+		*kernelArgs, verityRootHash, PartitionUUID(1), PartitionUUID(2))
+	if *verityKey != "" {
+		verityRootSignature = signRootHash()
+		// The initrd can't read the signature from the image before
+		// the root is open, so it's passed inline.
+		*kernelArgs += " systemd.verity_root_options=root-hash-signature=base64:" +
+			base64.StdEncoding.EncodeToString(verityRootSignature)
+	}
+}
+
+// signRootHash returns the detached PKCS #7 signature of the root hash
+// by -verity-key, as the kernel checks it: over the hash's hex digits,
+// without a newline, with no certificates or attributes.
+func signRootHash() []byte {
+	Log(fmt.Sprintf("Signing the root hash with %s", *verityKey))
+	cmd := exe.Cmd("openssl", "smime", "-sign", "-nocerts", "-noattr", "-binary",
+		"-inkey", *verityKey, "-signer", *verityCert, "-outform", "der")
+	cmd.Stdin = strings.NewReader(verityRootHash)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		Exit(fmt.Sprintf("openssl: %s", err))
+	}
+	return stdout.Bytes()
+}
+
+// WriteRootHash writes the root hash beside the image, for signing or
+// for update servers to check installed images against, and with
+// -verity-key its signature, as systemd-sysupdate and systemd-dissect
+// look for it.
+func WriteRootHash(outfinal string) {
+	file := outputStem(outfinal) + ".roothash"
+	Log(fmt.Sprintf("Writing the root hash to %s", file))
+	if err := ioutil.WriteFile(file, []byte(verityRootHash+"\n"), 0644); err != nil {
+		Exit(err)
+	}
+	if verityRootSignature == nil {
+		return
+	}
+	if err := ioutil.WriteFile(file+".p7s", verityRootSignature, 0644); err != nil {
+		Exit(err)
+	}
+}
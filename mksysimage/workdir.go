@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var workDir = flag.String("work-dir",
+	filepath.Join(os.TempDir(), fmt.Sprintf("mksysimage-%d", os.Getuid())),
+	"Directory each run keeps its temporary files in, under a directory of its own")
+
+var gcDays = flag.Int("gc-days", 7,
+	"Remove run directories abandoned in -work-dir more than this many days ago, 0 to keep them")
+
+// A BuildState is kept in the state file of each run directory, saying
+// what the run has created and not yet torn down, so that what a
+// crashed run left behind can be cleaned up.
+type BuildState struct {
+	Pid     int               `json:"pid"`
+	Started string            `json:"started"`
+	Dirs    []string          `json:"dirs"`
+	Files   []string          `json:"files,omitempty"`  // Files outside the run directory
+	Loops   []string          `json:"loops,omitempty"`  // Loop devices
+	Images  map[string]string `json:"images,omitempty"` // The image of each loop device
+	Maps    []string          `json:"maps,omitempty"`   // Loop devices with partition mappings
+	Groups  []string          `json:"groups,omitempty"` // Active LVM volume groups
+	Arrays  []string          `json:"arrays,omitempty"` // Running mdadm arrays
+	Mounts  []string          `json:"mounts,omitempty"`
+}
+
+// Track records in the state file that item has been set up, and
+// Untrack that it's been torn down again.
+func Track(list *[]string, item string) {
+	*list = append(*list, item)
+	saveRunState()
+}
+
+func Untrack(list *[]string, item string) {
+	for i, x := range *list {
+		if x == item {
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			break
+		}
+	}
+	saveRunState()
+}
+
+// TrackLoop records that the loop device device has been set up on
+// image, by the image's real path, as the kernel gives it.
+func TrackLoop(device, image string) {
+	if abs, err := filepath.Abs(image); err == nil {
+		image = abs
+	}
+	if real, err := filepath.EvalSymlinks(image); err == nil {
+		image = real
+	}
+	if runState.Images == nil {
+		runState.Images = map[string]string{}
+	}
+	runState.Images[device] = image
+	Track(&runState.Loops, device)
+}
+
+func init() {
+	subcommands["recover"] = RecoverCommand
+}
+
+// The number of crashed runs cleaned up after when this one started.
+var recoveredRuns int
+
+// RecoverCommand reports on cleaning up after crashed runs, which
+// happens at the start of every run anyway.
+func RecoverCommand(args []string) {
+	if len(args) != 0 {
+		Exit("Usage: recover")
+	}
+	Log(fmt.Sprintf("Cleaned up after %d crashed runs", recoveredRuns))
+}
+
+// RecoverRuns cleans up after the runs in base that died leaving
+// devices, mounts or files behind.
+func RecoverRuns(base string) {
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		Exit(err)
+	}
+	for _, e := range entries {
+		dir := filepath.Join(base, e.Name())
+		if !e.IsDir() || !runDirPattern.MatchString(e.Name()) {
+			continue
+		}
+		state, ok := ReadRunState(dir)
+		if !ok || processAlive(state.Pid) ||
+			len(state.Files)+len(state.Loops)+len(state.Maps)+len(state.Groups)+len(state.Arrays)+len(state.Mounts) == 0 {
+			continue
+		}
+		RecoverRun(dir, state)
+		recoveredRuns++
+	}
+}
+
+// RecoverRun tears down what a crashed run left set up, in the reverse
+// of the order it was set up in, then removes its directory.
+func RecoverRun(dir string, state BuildState) {
+	Log(fmt.Sprintf("Cleaning up after crashed run %s", dir))
+	for i := len(state.Mounts) - 1; i >= 0; i-- {
+		Log(fmt.Sprintf("Unmounting %s", state.Mounts[i]))
+		Audit("umount", state.Mounts[i], "recover",
+			exe.Priv("umount", "-l", state.Mounts[i]).Run())
+	}
+	for _, group := range state.Groups {
+		Log(fmt.Sprintf("Deactivating volume group %s", group))
+		Audit("vgchange", group, "recover", exe.Priv("vgchange", "-an", group).Run())
+	}
+	// Loop devices are numbered anew after a reboot, so the run's may
+	// have gone to something else on the host since.
+	own := map[string]bool{}
+	for _, device := range state.Loops {
+		if own[device] = ownLoop(device, state.Images[device]); !own[device] {
+			Log(fmt.Sprintf("Warning: %s is no longer the loop device of %s, leaving it alone",
+				device, state.Images[device]))
+		}
+	}
+	for _, array := range state.Arrays {
+		if !ownArray(array, state.Maps, own) {
+			Log(fmt.Sprintf("Warning: %s is no longer on the run's loop devices, leaving it alone", array))
+			continue
+		}
+		Log(fmt.Sprintf("Stopping array %s", array))
+		Audit("mdadm-stop", array, "recover", exe.Priv("mdadm", "--stop", array).Run())
+	}
+	for _, device := range state.Maps {
+		if !own[device] {
+			continue
+		}
+		Log(fmt.Sprintf("Removing partition mappings of %s", device))
+		Audit("kpartx-delete", device, "recover", exe.Priv("kpartx", "-d", device).Run())
+	}
+	for _, device := range state.Loops {
+		if !own[device] {
+			continue
+		}
+		Log(fmt.Sprintf("Detaching %s", device))
+		Audit("losetup-detach", device, "recover", exe.Priv("losetup", "-d", device).Run())
+	}
+	for _, file := range state.Files {
+		Log(fmt.Sprintf("Removing %s", file))
+		os.Remove(file)
+	}
+	removeRunDir(dir)
+}
+
+// ownLoop reports whether the loop device device is still backed by
+// image, which a crashed run set it up on.
+func ownLoop(device, image string) bool {
+	if image == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(filepath.Join("/sys/block", filepath.Base(device), "loop/backing_file"))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSuffix(strings.TrimSpace(string(data)), " (deleted)") == image
+}
+
+const stateFile = "state.json"
+
+// The names StartRunDir gives run directories, a UTC time and a pid.
+// Nothing else in -work-dir is cleaned up, since it may be shared.
+var runDirPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}-[0-9]+$`)
+
+// The directory of this run within -work-dir, and its state.
+var runDir string
+var runState BuildState
+
+// StartRunDir creates the directory for this run's temporary files,
+// first cleaning up after old runs.
+func StartRunDir() {
+	if err := os.MkdirAll(*workDir, 0700); err != nil {
+		Exit(err)
+	}
+	// Mounts are listed by their real path.
+	base, err := filepath.EvalSymlinks(*workDir)
+	if err != nil {
+		Exit(err)
+	}
+	RecoverRuns(base)
+	CollectGarbage(base)
+	now := time.Now().UTC()
+	runDir = filepath.Join(base,
+		fmt.Sprintf("%s-%d", now.Format("20060102-150405"), os.Getpid()))
+	if err = os.Mkdir(runDir, 0700); err != nil {
+		Exit(err)
+	}
+	runState = BuildState{Pid: os.Getpid(), Started: now.Format(time.RFC3339)}
+	saveRunState()
+}
+
+// TempDir creates a directory for one step of the run.
+func TempDir(name string) string {
+	dir, err := ioutil.TempDir(runDir, name)
+	if err != nil {
+		Exit(err)
+	}
+	runState.Dirs = append(runState.Dirs, dir)
+	saveRunState()
+	return dir
+}
+
+func saveRunState() {
+	data, err := json.MarshalIndent(runState, "", "  ")
+	if err != nil {
+		Exit(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(runDir, stateFile), append(data, '\n'), 0600); err != nil {
+		Exit(err)
+	}
+}
+
+// FinishRunDir removes the run directory, unless something is still
+// mounted in it.
+func FinishRunDir() {
+	if runDir == "" {
+		return
+	}
+	removeRunDir(runDir)
+}
+
+func removeRunDir(dir string) bool {
+	if mounts := mountsUnder(dir); len(mounts) > 0 {
+		Log(fmt.Sprintf("Warning: leaving %s in place, %s is still mounted", dir, mounts[0]))
+		return false
+	}
+	err := os.RemoveAll(dir)
+	if err != nil && *useSudo {
+		// Steps run with -sudo leave files owned by root.
+		err = exe.Priv("rm", "-rf", dir).Run()
+	}
+	if err != nil {
+		Log(fmt.Sprintf("Warning: couldn't remove %s: %s", dir, err))
+		return false
+	}
+	return true
+}
+
+// CollectGarbage removes the directories of runs in base that died
+// more than -gc-days ago. Only directories named like runs' and
+// holding a state file are removed; anything else is logged and left.
+func CollectGarbage(base string) {
+	if *gcDays <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		Exit(err)
+	}
+	for _, e := range entries {
+		dir := filepath.Join(base, e.Name())
+		if !e.IsDir() || time.Since(e.ModTime()) < time.Duration(*gcDays)*24*time.Hour {
+			continue
+		}
+		state, ok := ReadRunState(dir)
+		if !runDirPattern.MatchString(e.Name()) || !ok {
+			Log(fmt.Sprintf("Skipping %s in -work-dir, which isn't a run directory", dir))
+			continue
+		}
+		if processAlive(state.Pid) {
+			continue
+		}
+		if removeRunDir(dir) {
+			Log(fmt.Sprintf("Removed abandoned run directory %s", dir))
+		}
+	}
+}
+
+// ReadRunState reads the state file of a run directory.
+func ReadRunState(dir string) (BuildState, bool) {
+	var state BuildState
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		return state, false
+	}
+	return state, json.Unmarshal(data, &state) == nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// mountsUnder lists the mount points at or below dir.
+func mountsUnder(dir string) []string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mount := unescapeMountinfo(fields[4])
+		if mount == dir || strings.HasPrefix(mount, dir+"/") {
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts
+}
+
+// unescapeMountinfo undoes the octal escapes of spaces and the like in
+// /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"path"
+)
+
+var xen = flag.Bool("xen", false,
+	"Build a Xen PV or PVH guest, booted by pygrub or PV-GRUB from its GRUB menu rather than from the MBR")
+
+func init() {
+	// Xen's bootloaders read the guest's menu from outside, so there's
+	// nothing to install beyond it.
+	RegisterBootloader(&Bootloader{
+		Name:     "pvgrub",
+		Fs:       grubFs,
+		Programs: func() []string { return nil },
+		Install:  installXenMenus,
+	})
+}
+
+// CheckXen checks -xen, and unless -kernel-args says otherwise, boots
+// the root from the first Xen disk with the console on Xen's.
+func CheckXen() {
+	if !*xen {
+		return
+	}
+	if *arch != "amd64" && *arch != "386" {
+		Exit(fmt.Sprintf("Xen PV and PVH guests are x86, not %s", *arch))
+	}
+	if *noPartition {
+		Exit("-xen needs a partition table to boot from")
+	}
+	if *uefi {
+		Exit("Xen PV and PVH guests don't boot with UEFI, so -xen and -uefi can't be used together")
+	}
+	if !FlagSet("kernel-args") {
+		root := "/dev/xvda1"
+		if *lvmGroup != "" {
+			root = VolumeDevice("root")
+		}
+		*kernelArgs = fmt.Sprintf("root=%s ro console=hvc0", root)
+	}
+}
+
+// MenuLst renders the menu.lst of GRUB legacy, which the older pygrub
+// and PV-GRUB read, booting the first of entries, whose files are in
+// dir on the partition numbered part from 0.
+func MenuLst(dir string, part int, entries []BootEntry) string {
+	var buf bytes.Buffer
+	timeout := 0
+	if len(entries) > 1 {
+		timeout = 5
+	}
+	fmt.Fprintf(&buf, "default 0\ntimeout %d\n", timeout)
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "\ntitle %s\n\troot (hd0,%d)\n", e.Label, part)
+		fmt.Fprintf(&buf, "\tkernel %s %s\n", path.Join(dir, e.Kernel), e.Args)
+		if e.Initrd != "" {
+			fmt.Fprintf(&buf, "\tinitrd %s\n", path.Join(dir, e.Initrd))
+		}
+	}
+	return buf.String()
+}
+
+// installXenMenus writes both /boot/grub/grub.cfg, for pvgrub2 and
+// recent pygrub, and /boot/grub/menu.lst, for GRUB legacy PV-GRUB.
+func installXenMenus(mountpoint string, parts []*Partition, entries []BootEntry) {
+	boot := path.Join(mountpoint, "boot")
+	dir := grubDir(parts)
+	part := 0
+	for i, p := range TablePartitions(parts) {
+		if p == BootPartition(parts) {
+			part = i
+		}
+	}
+	writeGrubFile(boot, "grub.cfg", GrubConfig(dir, entries))
+	writeGrubFile(boot, "menu.lst", MenuLst(dir, part, entries))
+	Audit("bootloader-install", path.Join(boot, "grub"), "pvgrub", nil)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+)
+
+// The filesystems zipl can map the kernels' blocks on, of those the
+// image can have.
+var ziplFs = map[string]bool{
+	"ext3": true,
+	"ext4": true,
+	"xfs":  true,
+}
+
+func init() {
+	RegisterBootloader(&Bootloader{
+		Name:         "zipl",
+		Fs:           ziplFs,
+		Programs:     func() []string { return []string{"zipl"} },
+		Install:      installZipl,
+		AfterSources: true,
+	}, "s390x")
+}
+
+// ZiplConfig renders a zipl.conf booting the first of entries, whose
+// files are in boot, from a menu. target lines, if any, go in the
+// menu, for running zipl against a disk other than the one boot is on.
+func ZiplConfig(boot string, entries []BootEntry, target ...string) string {
+	var buf bytes.Buffer
+	buf.WriteString("[defaults]\ndefaultmenu = menu\n")
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "\n[%s]\ntarget = %s\nimage = %s\n", e.Label, boot, path.Join(boot, e.Kernel))
+		if e.Initrd != "" {
+			fmt.Fprintf(&buf, "ramdisk = %s\n", path.Join(boot, e.Initrd))
+		}
+		fmt.Fprintf(&buf, "parameters = \"%s\"\n", e.Args)
+	}
+	prompt, timeout := 0, 0
+	if len(entries) > 1 {
+		prompt, timeout = 1, 5
+	}
+	fmt.Fprintf(&buf, "\n:menu\ntarget = %s\ndefault = 1\nprompt = %d\ntimeout = %d\n", boot, prompt, timeout)
+	for i, e := range entries {
+		fmt.Fprintf(&buf, "%d = %s\n", i+1, e.Label)
+	}
+	for _, line := range target {
+		fmt.Fprintf(&buf, "%s\n", line)
+	}
+	return buf.String()
+}
+
+// installZipl writes /etc/zipl.conf for the image to rerun zipl with,
+// and runs zipl against the image's disk to write its boot record.
+func installZipl(mountpoint string, parts []*Partition, entries []BootEntry) {
+	conf := path.Join(mountpoint, "etc/zipl.conf")
+	if err := ImageMkdirAll(path.Dir(conf), 0755); err != nil {
+		Exit(err)
+	}
+	if err := ImageWriteFile(conf, []byte(ZiplConfig("/boot", entries)), 0644); err != nil {
+		Exit(err)
+	}
+	// The host's zipl can't tell what the loop device is, so the
+	// config describes it as a SCSI disk.
+	hostConf := filepath.Join(TempDir("zipl"), "zipl.conf")
+	cfg := ZiplConfig(path.Join(mountpoint, "boot"), entries,
+		"targetbase = "+imageDevice,
+		"targettype = SCSI",
+		"targetblocksize = 512",
+		"targetoffset = 0")
+	if err := ioutil.WriteFile(hostConf, []byte(cfg), 0644); err != nil {
+		Exit(err)
+	}
+	err := exe.Priv("zipl", "--config", hostConf).Run()
+	Audit("bootloader-install", imageDevice, "zipl", err)
+	if err != nil {
+		Exit(err)
+	}
+}